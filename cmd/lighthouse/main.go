@@ -2,33 +2,78 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/LSariol/LightHouse/internal/api"
 	"github.com/LSariol/LightHouse/internal/builder"
 	"github.com/LSariol/LightHouse/internal/cli"
 	"github.com/LSariol/LightHouse/internal/config"
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/forge"
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/notify"
+	"github.com/LSariol/LightHouse/internal/proxy"
+	"github.com/LSariol/LightHouse/internal/selfupdate"
 	"github.com/LSariol/LightHouse/internal/watcher"
-	"github.com/lsariol/coveclient"
 	dockerclient "github.com/docker/docker/client"
+	"github.com/lsariol/coveclient"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		runSelfUpdate(os.Args[2:])
+		return
+	}
+
 	var envPath string
-	envPath, err := config.Load()
+	envPath, err := config.LoadEnvFile()
+	if err != nil {
+		panic(err)
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := logging.Setup(os.Stdout, cfg.Log.Format, cfg.Log.Level); err != nil {
+		panic(err)
+	}
+	settings := config.NewStore(cfg, os.Args[1:])
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dockerClient, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
 	if err != nil {
 		panic(err)
 	}
 
+	bus := events.NewBus(cfg.Retention.BuildLogs)
+
+	var builder *builder.Builder = builder.NewBuilder(settings, dockerClient, nil, bus, ctx)
+	if cfg.Proxy.Enabled {
+		builder.Proxy = proxy.New()
+	}
+
+	// Cove holds every secret, so it comes up before anything that needs one.
+	if err := builder.StartCove(); err != nil {
+		slog.Error("cove is not healthy", "err", err)
+	}
+
 	// Build Dependencies
-	var coveClient *coveclient.Client = watcher.NewCoveClient()
-	fmt.Println(coveClient.ClientSecret)
+	var coveClient *coveclient.Client = watcher.NewCoveClient(cfg.Cove)
+	builder.CC = coveClient
 
 	if err := config.SaveClientSecret(envPath, coveClient.ClientSecret); err != nil {
 		panic(err)
@@ -42,43 +87,145 @@ func main() {
 
 	client := &http.Client{
 		Transport: tr,
-		Timeout:   10 * time.Second,
+		Timeout:   cfg.Timeouts.HTTP,
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
+	var watcher *watcher.Watcher = watcher.NewWatcher(settings, coveClient, client, builder, ctx)
+	builder.BeforeSelfUpdate = watcher.RecordSelfUpdate
 
-	dockerClient, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
-	if err != nil {
+	prometheus.MustRegister(builder.Collector())
+
+	if err := watcher.Load(); err != nil {
 		panic(err)
 	}
 
-	var builder *builder.Builder = builder.NewBuilder(dockerClient, coveClient, ctx)
-	var watcher *watcher.Watcher = watcher.NewWatcher(coveClient, client, builder, ctx)
+	if err := builder.StartAllContainers(); err != nil {
+		slog.Error("some containers failed to start", "err", err)
+	}
+
+	if builder.Proxy != nil {
+		if err := builder.SyncRoutes(); err != nil {
+			slog.Error("failed to load routes", "err", err)
+		}
+		go func() {
+			opts := proxy.Options{
+				HTTPAddr:      cfg.Proxy.HTTPAddr,
+				HTTPSAddr:     cfg.Proxy.HTTPSAddr,
+				TLS:           cfg.Proxy.TLS,
+				CertDir:       cfg.Proxy.CertDir,
+				ACMECache:     cfg.Proxy.ACMECache,
+				ACMEEmail:     cfg.Proxy.ACMEEmail,
+				ACMEDirectory: cfg.Proxy.ACMEDirectory,
+			}
+			if err := builder.Proxy.Run(ctx, opts); err != nil {
+				slog.Error("proxy stopped", "err", err)
+			}
+		}()
+	}
 
-	builder.StartAllContainers()
+	go func() {
+		if err := watcher.Run(); err != nil && ctx.Err() == nil {
+			slog.Error("watcher stopped", "err", err)
+			os.Exit(1)
+		}
+	}()
+	go builder.WatchContainers()
+	go watcher.RunReconciler()
 
-	go watcher.Run()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go watcher.WatchReload(hup)
 
-	ok, err := builder.IsContainerRunning("cove")
+	notifier, err := notify.Load(cfg.Paths.Notify, coveClient)
 	if err != nil {
 		panic(err)
 	}
+	notifier.Start(ctx, bus)
 
-	if !ok {
-		builder.StartContainer("cove")
+	if cfg.GitHub.CommitStatus {
+		github := forge.NewGitHub(cfg.GitHub.APIURL, client, watcher.Token)
+		reporter := forge.NewReporter(github, watcher.RepoFullName, cfg.API.PublicURL)
+		reporter.Start(ctx, bus)
 	}
 
-	//__________________________________________________________
-
-	// containers, _ := dockerHandler.ListContainers(ctx)
-
-	// fmt.Println(containers)
+	// The updater waits for this daemon to serve /healthz, so its result is
+	// read alongside the API server rather than before it.
+	go reportSelfUpdate(ctx, dockerClient, watcher)
+
+	server := api.NewServer(cfg.API.ListenAddress, bus)
+	server.HandleContainers(api.ContainerSource{
+		Resolve:   watcher.ResolveContainers,
+		Builder:   builder,
+		AllowRead: cfg.API.Containers,
+		AllowExec: cfg.API.Exec,
+	})
+	server.HandleApprovals(api.ApprovalSource{
+		List:        watcher.Approvals,
+		Approve:     watcher.Approve,
+		Reject:      watcher.Reject,
+		AllowDecide: cfg.API.Approve,
+	})
+	server.HandlePorts(builder.Ports)
+	if builder.Proxy != nil {
+		server.HandleRoutes(builder.Proxy)
+	}
+	go func() {
+		if err := server.Run(ctx); err != nil {
+			slog.Error("api server stopped", "err", err)
+		}
+	}()
 
 	cmd := cli.NewCLI(watcher)
 	go cmd.Run()
 
 	<-ctx.Done()
-	log.Println("Shutting Down...")
+	slog.Info("shutting down")
+
+}
+
+// runSelfUpdate is the entry point of the helper container that swaps the
+// daemon container for a newly built one.
+func runSelfUpdate(args []string) {
+
+	opts, err := selfupdate.ParseArgs(args)
+	if err != nil {
+		slog.Error("invalid self-update arguments", "err", err)
+		os.Exit(2)
+	}
+
+	dockerClient, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		slog.Error("docker client", "err", err)
+		os.Exit(1)
+	}
+
+	err = selfupdate.Run(context.Background(), dockerClient, opts)
+	if errors.Is(err, selfupdate.ErrRolledBack) {
+		slog.Error("self-update rolled back", "err", err)
+		os.Exit(selfupdate.ExitRolledBack)
+	}
+	if err != nil {
+		slog.Error("self-update failed", "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("self-update complete", "image", opts.Image)
+}
+
+// reportSelfUpdate records how the last self-update went once its updater
+// has exited. A rolled back update restores the commit deployed before it.
+func reportSelfUpdate(ctx context.Context, docker *dockerclient.Client, w *watcher.Watcher) {
 
+	done, rolledBack, err := selfupdate.Result(ctx, docker)
+	if err != nil {
+		slog.Warn("failed to read self-update result", "err", err)
+	}
+	if !done {
+		return
+	}
+
+	if !rolledBack {
+		slog.Info("self-update finished")
+	}
+	w.FinishSelfUpdate(rolledBack)
 }
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+// ApprovalSource gives the API the commits waiting for approval and the
+// means to decide on them.
+type ApprovalSource struct {
+	List    func() []models.PendingApproval
+	Approve func(name string, sha string) (string, error)
+	Reject  func(name string, sha string) ([]string, error)
+
+	// AllowDecide enables approving and rejecting. The API has no
+	// authentication, so it is off unless asked for.
+	AllowDecide bool
+}
+
+// HandleApprovals adds GET /approvals and the approve and reject routes.
+func (s *Server) HandleApprovals(src ApprovalSource) {
+
+	h := &approvalHandler{src: src}
+	s.mux.HandleFunc("GET /approvals", h.handleList)
+	s.mux.HandleFunc("POST /repos/{name}/approve", h.handleApprove)
+	s.mux.HandleFunc("POST /repos/{name}/reject", h.handleReject)
+}
+
+type approvalHandler struct {
+	src ApprovalSource
+}
+
+// decisionRequest picks the commit to approve or reject. An empty SHA means
+// the newest for approve and all of them for reject.
+type decisionRequest struct {
+	SHA string `json:"sha"`
+}
+
+func (h *approvalHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.src.List())
+}
+
+func (h *approvalHandler) handleApprove(w http.ResponseWriter, r *http.Request) {
+
+	req, ok := h.decision(w, r)
+	if !ok {
+		return
+	}
+
+	sha, err := h.src.Approve(r.PathValue("name"), req.SHA)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"approved": sha})
+}
+
+func (h *approvalHandler) handleReject(w http.ResponseWriter, r *http.Request) {
+
+	req, ok := h.decision(w, r)
+	if !ok {
+		return
+	}
+
+	shas, err := h.src.Reject(r.PathValue("name"), req.SHA)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"rejected": shas})
+}
+
+// decision checks decisions are enabled and reads the optional body,
+// writing the error response when either fails.
+func (h *approvalHandler) decision(w http.ResponseWriter, r *http.Request) (decisionRequest, bool) {
+
+	var req decisionRequest
+
+	if !h.src.AllowDecide {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "approvals through the API are disabled, set API_APPROVE=true to enable them"})
+		return req, false
+	}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request: " + err.Error()})
+		return req, false
+	}
+
+	return req, true
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/builder"
+)
+
+type containerHandler struct {
+	src ContainerSource
+}
+
+// readable rejects logs and inspect unless they were enabled.
+func (h *containerHandler) readable(w http.ResponseWriter) bool {
+
+	if !h.src.AllowRead {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "container logs and inspect are disabled, set API_CONTAINERS=true to enable them"})
+		return false
+	}
+
+	return true
+}
+
+func (h *containerHandler) resolve(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+
+	containers, err := h.src.Resolve(r.PathValue("name"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+
+	return containers, true
+}
+
+// handleLogs streams container output as plain text. Query parameters are
+// follow (true/false), since (a duration or RFC 3339 time) and tail.
+func (h *containerHandler) handleLogs(w http.ResponseWriter, r *http.Request) {
+
+	if !h.readable(w) {
+		return
+	}
+
+	containers, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	opts := builder.LogOptions{Since: q.Get("since")}
+	opts.Follow, _ = strconv.ParseBool(q.Get("follow"))
+	if tail := q.Get("tail"); tail != "" {
+		n, err := strconv.Atoi(tail)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tail must be a positive number"})
+			return
+		}
+		opts.Tail = n
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if err := h.src.Builder.Logs(r.Context(), containers, opts, flushWriter{w}); err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+}
+
+func (h *containerHandler) handleInspect(w http.ResponseWriter, r *http.Request) {
+
+	if !h.readable(w) {
+		return
+	}
+
+	containers, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	infos := make([]builder.ContainerInfo, 0, len(containers))
+	for _, name := range containers {
+		info, err := h.src.Builder.Inspect(name)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		infos = append(infos, info)
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+type execRequest struct {
+	// Container picks one of the repo's containers, default the primary one.
+	Container string   `json:"container"`
+	Cmd       []string `json:"cmd"`
+}
+
+type execResponse struct {
+	Container string `json:"container"`
+	ExitCode  int    `json:"exitCode"`
+	Output    string `json:"output"`
+}
+
+func (h *containerHandler) handleExec(w http.ResponseWriter, r *http.Request) {
+
+	if !h.src.AllowExec {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "exec is disabled, set API_EXEC=true to enable it"})
+		return
+	}
+
+	containers, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	var req execRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request: " + err.Error()})
+		return
+	}
+
+	target := containers[0]
+	if req.Container != "" {
+		target = ""
+		for _, c := range containers {
+			if c == req.Container {
+				target = c
+			}
+		}
+		if target == "" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": req.Container + " does not belong to " + r.PathValue("name")})
+			return
+		}
+	}
+
+	var out strings.Builder
+	code, err := h.src.Builder.Exec(r.Context(), target, req.Cmd, &out)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, execResponse{Container: target, ExitCode: code, Output: out.String()})
+}
+
+// flushWriter flushes after every write so followed logs arrive promptly.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+
+	return n, err
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/builder"
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/ports"
+	"github.com/LSariol/LightHouse/internal/proxy"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Server struct {
+	Addr   string
+	Events *events.Bus
+	mux    *http.ServeMux
+}
+
+// ContainerSource gives the API access to the containers of watched repos
+// and managed services.
+type ContainerSource struct {
+	// Resolve maps a repo or service name to its containers, primary first.
+	Resolve func(name string) ([]string, error)
+	Builder *builder.Builder
+
+	// AllowRead enables GET /repos/{name}/logs and /inspect, and AllowExec
+	// POST /repos/{name}/exec. The API has no authentication, so both are
+	// off unless asked for.
+	AllowRead bool
+	AllowExec bool
+}
+
+func NewServer(addr string, bus *events.Bus) *Server {
+
+	s := &Server{
+		Addr:   addr,
+		Events: bus,
+		mux:    http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /healthz", s.handleHealth)
+	s.mux.HandleFunc("GET /builds", s.handleBuilds)
+	s.mux.HandleFunc("GET /builds/logs", s.handleLogs)
+	s.mux.HandleFunc("GET /builds/{id}/logs", s.handleLogs)
+	s.mux.Handle("GET /metrics", promhttp.Handler())
+
+	return s
+}
+
+// HandleContainers adds the container logs, inspect and exec routes.
+func (s *Server) HandleContainers(src ContainerSource) {
+
+	h := &containerHandler{src: src}
+	s.mux.HandleFunc("GET /repos/{name}/logs", h.handleLogs)
+	s.mux.HandleFunc("GET /repos/{name}/inspect", h.handleInspect)
+	s.mux.HandleFunc("POST /repos/{name}/exec", h.handleExec)
+}
+
+// HandlePorts adds GET /ports, listing which repo or service holds which
+// host port.
+func (s *Server) HandlePorts(reg *ports.Registry) {
+
+	s.mux.HandleFunc("GET /ports", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, reg.All())
+	})
+}
+
+// HandleRoutes adds GET /routes, listing the proxy's routing table in the
+// order requests are matched against it.
+func (s *Server) HandleRoutes(p *proxy.Proxy) {
+
+	s.mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, p.Routes())
+	})
+}
+
+// Run serves the API until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+
+	srv := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("api server: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func (s *Server) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Events.Builds())
+}
+
+// handleLogs streams build events as Server-Sent Events. With a build ID the
+// stream replays that build's history and ends once it finishes; without one
+// it follows every build until the client disconnects.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	buildID := r.PathValue("id")
+	ch, cancel := s.Events.Subscribe(buildID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, data)
+			flusher.Flush()
+
+			if buildID != "" && e.Finished() {
+				return
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
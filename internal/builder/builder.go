@@ -2,81 +2,222 @@ package builder
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/LSariol/LightHouse/internal/config"
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/metrics"
 	"github.com/LSariol/LightHouse/internal/models"
-	"github.com/lsariol/coveclient"
+	"github.com/LSariol/LightHouse/internal/ports"
+	"github.com/LSariol/LightHouse/internal/proxy"
+	"github.com/LSariol/LightHouse/internal/registry"
 	"github.com/docker/docker/client"
+	"github.com/lsariol/coveclient"
 )
 
 type Builder struct {
-	Docker    *client.Client
-	CC        *coveclient.Client
-	Ctx       context.Context
-	WatchList []models.WatchedRepo
-	BasePath  string
+	Settings *config.Store
+	Docker   *client.Client
+	CC       *coveclient.Client
+	Events   *events.Bus
+	Registry *registry.Client
+	Ports    *ports.Registry
+	// Proxy is the reverse proxy routes are served by, nil when disabled.
+	Proxy *proxy.Proxy
+	Ctx   context.Context
+
+	// BeforeSelfUpdate stores the commit of repo as deployed before the
+	// container swap is handed over, so the new daemon does not find it
+	// still pending and build it again.
+	BeforeSelfUpdate func(repo models.WatchedRepo) error
+
+	// watchList and services are the watcher's, as last handed over. They
+	// are replaced whole, so the lock is only needed to fetch them.
+	mu        sync.RWMutex
+	watchList []models.WatchedRepo
+	services  []models.ManagedService
 }
 
-func NewBuilder(dh *client.Client, cc *coveclient.Client, ctx context.Context) *Builder {
+// NewBuilder returns a builder running the config in settings.
+func NewBuilder(settings *config.Store, dh *client.Client, cc *coveclient.Client, bus *events.Bus, ctx context.Context) *Builder {
+
+	cfg := settings.Current()
+	start, end, _ := cfg.Ports.Bounds()
+
 	return &Builder{
-		Docker: dh,
-		CC:     cc,
-		Ctx:    ctx,
+		Settings: settings,
+		Docker:   dh,
+		CC:       cc,
+		Events:   bus,
+		Ctx:      ctx,
+		Registry: registry.NewClient(&http.Client{Timeout: cfg.Timeouts.Registry}, cfg.Registry.Insecure),
+		Ports:    ports.NewRegistry(cfg.Paths.Ports, start, end),
 	}
 }
 
-func (b *Builder) Build(repo models.WatchedRepo) error {
+// Config returns the running config. It can change on a reload.
+func (b *Builder) Config() *config.Config {
+	return b.Settings.Current()
+}
+
+// SetWatchList hands the builder a copy of the watchlist.
+func (b *Builder) SetWatchList(repos []models.WatchedRepo) {
+	b.mu.Lock()
+	b.watchList = slices.Clone(repos)
+	b.mu.Unlock()
+}
+
+// WatchList returns the watchlist last handed over. It must not be changed.
+func (b *Builder) WatchList() []models.WatchedRepo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.watchList
+}
+
+// SetServices hands the builder a copy of the managed services.
+func (b *Builder) SetServices(services []models.ManagedService) {
+	b.mu.Lock()
+	b.services = slices.Clone(services)
+	b.mu.Unlock()
+}
+
+// Services returns the managed services last handed over. They must not be
+// changed.
+func (b *Builder) Services() []models.ManagedService {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.services
+}
 
-	fmt.Println("----Building " + repo.ContainerName + " ----")
+// Build deploys the latest commit of repo and returns the ID its log
+// lines were published under.
+func (b *Builder) Build(repo models.WatchedRepo) (string, error) {
 
-	err := cleanUp()
+	sha := ""
+	if repo.Stats.Updates.LastSeenCommitSha != nil {
+		sha = *repo.Stats.Updates.LastSeenCommitSha
+	}
+
+	buildID := newBuildID(repo.ContainerName)
+	log := newBuildLog(b.Events, buildID, repo.DisplayName, sha)
+
+	log.logger.Info("build started", "container", repo.ContainerName)
+	log.publish(events.Event{Kind: events.KindBuildStarted})
+
+	err := b.build(repo, log)
+	log.endPhase()
+	if !b.isSelf(repo) {
+		b.syncRoutes(log)
+	}
+	status := "success"
+	if err != nil {
+		status = "failed"
+		log.Printf("build failed: %v", err)
+		log.logger.Error("build failed", "phase", log.phase, "err", err)
+	} else {
+		log.logger.Info("build succeeded")
+		if commitAt := repo.Stats.Updates.LastSeenCommitAt; commitAt != nil {
+			metrics.CommitToDeploy.WithLabelValues(repo.DisplayName).Observe(time.Since(*commitAt).Seconds())
+		}
+	}
+	metrics.Builds.WithLabelValues(repo.DisplayName, status).Inc()
+
+	finished := events.Event{Kind: events.KindBuildFinished, Status: status}
+	if err != nil {
+		finished.Message = err.Error()
+	}
+	log.publish(finished)
+
+	return buildID, err
+}
+
+func (b *Builder) build(repo models.WatchedRepo, log *buildLog) error {
+
+	log.Phase("cleanup")
+	err := b.cleanUp()
 	if err != nil {
-		wError := "Cleaning Failed for " + repo.ContainerName + " " + err.Error()
-		fmt.Println(wError)
 		return fmt.Errorf("cleanup: %w", err)
 	}
 
 	// Prepare Repo for build
-	err = downloadNewCommit(repo.DownloadURL, repo.ContainerName)
+	log.Phase("download")
+	err = b.downloadNewCommit(repo.DownloadURL, repo.ContainerName, log)
 	if err != nil {
-		wError := "Download Failed for " + repo.ContainerName + " " + err.Error()
-		fmt.Println(wError)
 		return fmt.Errorf("download: %w", err)
 	}
 
-	err = b.StopContainer(repo.ContainerName)
-	if err != nil {
-		if strings.Contains(err.Error(), "No such container") {
-			// ignore and continue
-		} else {
-			// propagate other errors
-			return fmt.Errorf("build failed to stop container: %w", err)
-		}
+	// Lighthouse keeps running while it builds its own replacement.
+	if !b.isSelf(repo) {
+		log.Phase("stop")
+		err = b.StopContainer(repo.ContainerName)
+		if err != nil {
+			if strings.Contains(err.Error(), "No such container") {
+				// ignore and continue
+			} else {
+				// propagate other errors
+				return fmt.Errorf("build failed to stop container: %w", err)
+			}
 
+		}
 	}
 
-	err = unpackNewProject(repo.ContainerName)
+	log.Phase("unpack")
+	err = b.unpackNewProject(repo.ContainerName, log)
 	if err != nil {
-		wError := "Unzip Failed for " + repo.ContainerName + " " + err.Error()
-		fmt.Println(wError)
 		return fmt.Errorf("unpack: %w", err)
 	}
+	proj := b.newProject(repo)
+	if repo.Dir != "" {
+		if _, err := os.Stat(proj.dir); err != nil {
+			return fmt.Errorf("unpack: %s is not a directory of the repo", repo.Dir)
+		}
+	}
 
-	err = b.createContainer(strings.ToLower(repo.ContainerName))
-	if err != nil {
-		return fmt.Errorf("create container: %w", err)
+	if b.isSelf(repo) {
+		log.Phase("self-update")
+		err = b.selfUpdate(repo, proj, log)
+		if err != nil {
+			return fmt.Errorf("self update: %w", err)
+		}
+	} else {
+		prev, err := b.currentImage(proj.name)
+		if err != nil {
+			return err
+		}
+
+		err = b.prepareVolumes(proj, prev != nil, log)
+		if err != nil {
+			return fmt.Errorf("volumes: %w", err)
+		}
+
+		log.Phase("compose")
+		err = b.createContainer(proj, log)
+		if err != nil {
+			return fmt.Errorf("create container: %w", err)
+		}
+
+		log.Phase("health")
+		err = b.gateProject(proj, prev, log)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = cleanUp()
+	log.Phase("cleanup")
+	err = b.cleanUp()
 	if err != nil {
-		wError := "Cleaning Failed for " + repo.ContainerName + " " + err.Error()
-		fmt.Println(wError)
 		return fmt.Errorf("cleanup end: %w", err)
 	}
 
-	fmt.Println("Clean Complete")
+	log.Printf("Clean Complete")
 
 	return nil
 }
@@ -88,25 +229,28 @@ func ErrorHandler() {
 // Run containers if they already exist.
 func (b *Builder) InitilizeContainers(watchList []models.WatchedRepo) error {
 
+	var errs []error
+
 	for _, model := range watchList {
 		// If container is running, good
 		containerName := strings.ToLower(model.ContainerName)
 		status, err := b.IsContainerRunning(containerName)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
 		if status {
-			fmt.Println(containerName + " is already running.")
-			return nil
+			slog.Info("container already running", "container", containerName)
+			continue
 		}
 
 		err = b.StartContainer(containerName)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("%s: %w", containerName, err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func InitilizeOriginalPath() string {
@@ -114,10 +258,3 @@ func InitilizeOriginalPath() string {
 
 	return originalPath
 }
-
-func (b *Builder) LoadPaths() error {
-
-	b.BasePath = os.Getenv("BASE_PATH")
-
-	return nil
-}
@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/metrics"
+)
+
+// buildLog publishes the output of a single build onto the event bus and
+// mirrors it to the daemon log at debug level.
+type buildLog struct {
+	bus     *events.Bus
+	logger  *slog.Logger
+	buildID string
+	repo    string
+	sha     string
+	phase   string
+	started time.Time
+}
+
+func newBuildLog(bus *events.Bus, buildID string, repo string, sha string) *buildLog {
+	return &buildLog{
+		bus:     bus,
+		logger:  slog.With("repo", repo, "sha", sha, "build_id", buildID),
+		buildID: buildID,
+		repo:    repo,
+		sha:     sha,
+	}
+}
+
+func newBuildID(containerName string) string {
+	return fmt.Sprintf("%s-%s", strings.ToLower(containerName), time.Now().Format("20060102-150405"))
+}
+
+func (l *buildLog) publish(e events.Event) {
+	if l.bus == nil {
+		return
+	}
+	e.BuildID = l.buildID
+	e.Repo = l.repo
+	e.SHA = l.sha
+	e.Line = logging.Redact(e.Line)
+	e.Message = logging.Redact(e.Message)
+	if e.Phase == "" {
+		e.Phase = l.phase
+	}
+	l.bus.Publish(e)
+}
+
+func (l *buildLog) Phase(phase string) {
+	l.endPhase()
+	l.phase = phase
+	l.started = time.Now()
+	l.logger.Info("build phase started", "phase", phase)
+	l.publish(events.Event{Kind: events.KindPhase})
+}
+
+// endPhase records how long the current phase took.
+func (l *buildLog) endPhase() {
+	if l.phase == "" {
+		return
+	}
+	metrics.BuildPhaseDuration.WithLabelValues(l.repo, l.phase).Observe(time.Since(l.started).Seconds())
+}
+
+func (l *buildLog) Printf(format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	l.logger.Debug(line, "phase", l.phase)
+	l.publish(events.Event{Kind: events.KindLog, Line: line})
+}
+
+// Writer returns an io.Writer that publishes each line written to it.
+func (l *buildLog) Writer() *lineWriter {
+	return &lineWriter{log: l}
+}
+
+type lineWriter struct {
+	mu  sync.Mutex
+	log *buildLog
+	buf bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line, keep it until the rest arrives.
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.log.Printf("%s", strings.TrimRight(line, "\r\n"))
+	}
+
+	return len(p), nil
+}
+
+// Flush publishes any trailing output that did not end in a newline.
+func (w *lineWriter) Flush() {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.log.Printf("%s", w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,57 @@
+package builder
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	containerRunningDesc = prometheus.NewDesc(
+		"lighthouse_container_running",
+		"Whether the container of a watched repo is running.",
+		[]string{"repo", "container"}, nil,
+	)
+	containerHealthyDesc = prometheus.NewDesc(
+		"lighthouse_container_healthy",
+		"Whether the container of a watched repo is healthy. Containers without a healthcheck count as healthy while running.",
+		[]string{"repo", "container"}, nil,
+	)
+)
+
+// ContainerCollector reports the state of every watched container at scrape time.
+type ContainerCollector struct {
+	builder *Builder
+}
+
+// Collector returns a prometheus collector for the builder's containers.
+func (b *Builder) Collector() *ContainerCollector {
+	return &ContainerCollector{builder: b}
+}
+
+func (c *ContainerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- containerRunningDesc
+	ch <- containerHealthyDesc
+}
+
+func (c *ContainerCollector) Collect(ch chan<- prometheus.Metric) {
+
+	for _, repo := range c.builder.WatchList() {
+		name := strings.ToLower(repo.ContainerName)
+
+		var running, healthy float64
+		info, err := c.builder.Docker.ContainerInspect(c.builder.Ctx, name)
+		if err == nil && info.State != nil {
+			if info.State.Running {
+				running = 1
+				healthy = 1
+			}
+			if info.State.Health != nil && info.State.Health.Status != "healthy" {
+				healthy = 0
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(containerRunningDesc, prometheus.GaugeValue, running, repo.DisplayName, name)
+		ch <- prometheus.MustNewConstMetric(containerHealthyDesc, prometheus.GaugeValue, healthy, repo.DisplayName, name)
+	}
+}
@@ -0,0 +1,167 @@
+package builder
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	dockerevents "github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	// How long to wait before reconnecting to a dropped event stream.
+	eventsRetry = 5 * time.Second
+
+	// A die this soon after a kill was asked for, not a crash.
+	killGrace = time.Minute
+)
+
+// WatchContainers follows the Docker event stream for containers labelled
+// managed-by=lighthouse and republishes their lifecycle on the event bus
+// until the builder's context is cancelled. The proxy's routes follow the
+// same events.
+func (b *Builder) WatchContainers() {
+
+	args := filters.NewArgs(
+		filters.Arg("type", string(dockerevents.ContainerEventType)),
+		filters.Arg("label", LabelManagedBy+"="+managedByValue),
+	)
+	for _, a := range []dockerevents.Action{
+		dockerevents.ActionStart,
+		dockerevents.ActionKill,
+		dockerevents.ActionDie,
+		dockerevents.ActionOOM,
+		dockerevents.ActionRestart,
+		dockerevents.ActionStop,
+		dockerevents.ActionDestroy,
+		dockerevents.ActionHealthStatus,
+	} {
+		args.Add("event", string(a))
+	}
+
+	w := &containerWatch{builder: b, killed: map[string]time.Time{}}
+
+	for b.Ctx.Err() == nil {
+		since := time.Now()
+		msgs, errs := b.Docker.Events(b.Ctx, dockerevents.ListOptions{Filters: args})
+
+	stream:
+		for {
+			select {
+			case <-b.Ctx.Done():
+				return
+			case err := <-errs:
+				slog.Warn("docker event stream closed", "err", err, "connected_for", time.Since(since).Round(time.Second))
+				break stream
+			case msg := <-msgs:
+				w.handle(msg)
+			}
+		}
+
+		select {
+		case <-b.Ctx.Done():
+		case <-time.After(eventsRetry):
+		}
+	}
+}
+
+type containerWatch struct {
+	builder *Builder
+
+	mu     sync.Mutex
+	killed map[string]time.Time
+}
+
+func (w *containerWatch) handle(msg dockerevents.Message) {
+
+	attrs := msg.Actor.Attributes
+	if _, routed := attrs[LabelRoutes]; routed && msg.Action != dockerevents.ActionKill {
+		// A routed container that came, went or changed health moves
+		// traffic, and may have come back with a new address.
+		if err := w.builder.SyncRoutes(); err != nil {
+			slog.Warn("failed to update routes", "container", attrs["name"], "err", err)
+		}
+	}
+	e := events.Event{
+		Container: attrs["name"],
+		Repo:      attrs[LabelRepo],
+		SHA:       attrs[LabelSHA],
+		Time:      time.Unix(0, msg.TimeNano),
+	}
+	if e.Repo == "" {
+		e.Repo = attrs[LabelService]
+	}
+	if e.Repo == "" {
+		e.Repo = e.Container
+	}
+
+	switch {
+	case msg.Action == dockerevents.ActionKill:
+		// Remembered so the die that follows a stop is not taken for a crash.
+		w.mu.Lock()
+		w.killed[msg.Actor.ID] = time.Now()
+		w.mu.Unlock()
+		return
+
+	case msg.Action == dockerevents.ActionDie:
+		code := attrs["exitCode"]
+		if w.wasKilled(msg.Actor.ID) {
+			return
+		}
+		e.Kind = events.KindContainerDied
+		e.Status = code
+		e.Message = fmt.Sprintf("%s exited with code %s", e.Container, code)
+
+	case msg.Action == dockerevents.ActionOOM:
+		e.Kind = events.KindContainerOOM
+		e.Message = e.Container + " was killed for running out of memory"
+
+	case msg.Action == dockerevents.ActionRestart:
+		e.Kind = events.KindContainerRestarted
+		e.Message = e.Container + " restarted"
+
+	case msg.Action == dockerevents.ActionStop || msg.Action == dockerevents.ActionDestroy:
+		e.Kind = events.KindContainerStopped
+		e.Status = string(msg.Action)
+		e.Message = fmt.Sprintf("%s: %s", e.Container, msg.Action)
+
+	case strings.HasPrefix(string(msg.Action), string(dockerevents.ActionHealthStatus)):
+		status := strings.TrimSpace(strings.TrimPrefix(string(msg.Action), string(dockerevents.ActionHealthStatus)+":"))
+		if status != HealthUnhealthy {
+			return
+		}
+		e.Kind = events.KindContainerUnhealthy
+		e.Status = status
+		e.Message = e.Container + " became unhealthy"
+
+	default:
+		return
+	}
+
+	slog.Info("container event", "kind", e.Kind, "container", e.Container, "repo", e.Repo, "status", e.Status)
+	if w.builder.Events != nil {
+		w.builder.Events.Publish(e)
+	}
+}
+
+// wasKilled reports whether a kill was seen for id shortly before, and
+// forgets it along with any stale entries.
+func (w *containerWatch) wasKilled(id string) bool {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	at, ok := w.killed[id]
+	delete(w.killed, id)
+	for k, t := range w.killed {
+		if time.Since(t) > killGrace {
+			delete(w.killed, k)
+		}
+	}
+
+	return ok && time.Since(at) <= killGrace
+}
@@ -0,0 +1,314 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Commands Exec allows when api.exec_allowed is not set. They only read state.
+// cat and ps are left out since they could print secrets Lighthouse cannot
+// redact, and curl and wget since they reach anything the container can.
+var defaultExecAllowed = []string{"ls", "df", "du", "whoami", "id", "uname", "date", "uptime", "ping", "nslookup"}
+
+// LogOptions selects the container output Logs returns.
+type LogOptions struct {
+	Follow bool
+	// Since is a duration such as "10m" or an RFC 3339 timestamp.
+	Since string
+	// Tail limits the output to this many lines per container, 0 for all.
+	Tail int
+}
+
+// ContainerInfo is the summary of a container shown by inspect. Environment
+// values are never included, only their names.
+type ContainerInfo struct {
+	Name         string            `json:"name"`
+	ID           string            `json:"id"`
+	Image        string            `json:"image"`
+	ImageID      string            `json:"imageId"`
+	SHA          string            `json:"sha,omitempty"`
+	State        string            `json:"state"`
+	Health       string            `json:"health"`
+	StartedAt    string            `json:"startedAt"`
+	RestartCount int               `json:"restartCount"`
+	Ports        []string          `json:"ports"`
+	Mounts       []string          `json:"mounts"`
+	Env          []string          `json:"env"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// ContainersFor lists the containers labelled key=value, falling back to
+// the container called name for those deployed before labels were added.
+// name, when it exists, comes first.
+func (b *Builder) ContainersFor(key string, value string, name string) ([]string, error) {
+
+	list, err := b.Docker.ContainerList(b.Ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", key+"="+value)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list containers of %s: %w", value, err)
+	}
+
+	var names []string
+	for _, c := range list {
+		if len(c.Names) > 0 {
+			names = append(names, strings.TrimPrefix(c.Names[0], "/"))
+		}
+	}
+	sort.Strings(names)
+
+	if name != "" {
+		if i := slices.Index(names, name); i >= 0 {
+			names = slices.Delete(names, i, i+1)
+		}
+		if _, err := b.Docker.ContainerInspect(b.Ctx, name); err == nil {
+			names = append([]string{name}, names...)
+		} else if !errdefs.IsNotFound(err) {
+			return nil, fmt.Errorf("inspect %s: %w", name, err)
+		}
+	}
+
+	return names, nil
+}
+
+// RepoContainers lists the containers deployed for repo.
+func (b *Builder) RepoContainers(repo models.WatchedRepo) ([]string, error) {
+	return b.ContainersFor(LabelRepo, repo.DisplayName, strings.ToLower(repo.ContainerName))
+}
+
+// ServiceContainers lists the containers of a managed service.
+func (b *Builder) ServiceContainers(svc models.ManagedService) ([]string, error) {
+
+	if svc.Kind() != models.ServiceKindCompose {
+		return b.ContainersFor(LabelService, svc.Name, svc.ContainerName)
+	}
+
+	var out bytes.Buffer
+	if err := runCompose(svc.ComposePath, &out, "ps", "-a", "--format", "{{.Name}}"); err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(out.String()), nil
+}
+
+// Logs writes the output of containers to w with secrets redacted. With
+// more than one container each line is prefixed with its container name.
+func (b *Builder) Logs(ctx context.Context, containers []string, opts LogOptions, w io.Writer) error {
+
+	out := &syncWriter{w: w}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(containers))
+
+	for i, name := range containers {
+		prefix := ""
+		if len(containers) > 1 {
+			prefix = name + " | "
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = b.containerLogs(ctx, name, opts, logging.NewWriter(out, prefix))
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) containerLogs(ctx context.Context, name string, opts LogOptions, w *logging.Writer) error {
+
+	defer w.Flush()
+
+	info, err := b.Docker.ContainerInspect(ctx, name)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", name, err)
+	}
+
+	logOpts := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Since:      opts.Since,
+		Timestamps: true,
+	}
+	if opts.Tail > 0 {
+		logOpts.Tail = fmt.Sprint(opts.Tail)
+	}
+
+	rc, err := b.Docker.ContainerLogs(ctx, name, logOpts)
+	if err != nil {
+		return fmt.Errorf("logs of %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	// Without a TTY Docker multiplexes stdout and stderr into one stream.
+	if info.Config != nil && info.Config.Tty {
+		_, err = io.Copy(w, rc)
+	} else {
+		_, err = stdcopy.StdCopy(w, w, rc)
+	}
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("logs of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Inspect summarises container name without exposing environment values.
+func (b *Builder) Inspect(name string) (ContainerInfo, error) {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if err != nil {
+		return ContainerInfo{}, fmt.Errorf("inspect %s: %w", name, err)
+	}
+
+	ci := ContainerInfo{
+		Name:         strings.TrimPrefix(info.Name, "/"),
+		ID:           info.ID[:12],
+		ImageID:      shortID(info.Image),
+		RestartCount: info.RestartCount,
+		Health:       HealthRunning,
+	}
+
+	if info.State != nil {
+		ci.State = info.State.Status
+		ci.StartedAt = info.State.StartedAt
+		if !info.State.Running {
+			ci.Health = HealthStopped
+		} else if info.State.Health != nil {
+			ci.Health = info.State.Health.Status
+		}
+	}
+
+	if info.Config != nil {
+		ci.Image = info.Config.Image
+		ci.SHA = info.Config.Labels[LabelSHA]
+		ci.Labels = info.Config.Labels
+		for _, kv := range info.Config.Env {
+			key, _, _ := strings.Cut(kv, "=")
+			ci.Env = append(ci.Env, key+"=[REDACTED]")
+		}
+	}
+
+	if info.NetworkSettings != nil {
+		for port, bindings := range info.NetworkSettings.Ports {
+			if len(bindings) == 0 {
+				ci.Ports = append(ci.Ports, string(port))
+			}
+			for _, pb := range bindings {
+				ci.Ports = append(ci.Ports, fmt.Sprintf("%s:%s->%s", pb.HostIP, pb.HostPort, port))
+			}
+		}
+		sort.Strings(ci.Ports)
+	}
+
+	for _, m := range info.Mounts {
+		src := m.Name
+		if src == "" {
+			src = m.Source
+		}
+		mode := "rw"
+		if !m.RW {
+			mode = "ro"
+		}
+		ci.Mounts = append(ci.Mounts, fmt.Sprintf("%s %s:%s (%s)", m.Type, src, m.Destination, mode))
+	}
+
+	return ci, nil
+}
+
+// Exec runs cmd in container name and writes its output to w with secrets
+// redacted. Only commands on the exec allow list may be run, without a
+// TTY or stdin, for at most the exec timeout.
+func (b *Builder) Exec(ctx context.Context, name string, cmd []string, w io.Writer) (int, error) {
+
+	if len(cmd) == 0 {
+		return 0, fmt.Errorf("no command given")
+	}
+	if !slices.Contains(b.execAllowed(), cmd[0]) {
+		return 0, fmt.Errorf("%s is not allowed, allowed commands are %s", cmd[0], strings.Join(b.execAllowed(), ", "))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.Config().Timeouts.Exec)
+	defer cancel()
+
+	created, err := b.Docker.ContainerExecCreate(ctx, name, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("exec in %s: %w", name, err)
+	}
+
+	resp, err := b.Docker.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("exec in %s: %w", name, err)
+	}
+	defer resp.Close()
+
+	out := logging.NewWriter(w, "")
+	_, err = stdcopy.StdCopy(out, out, resp.Reader)
+	out.Flush()
+	if err != nil {
+		return 0, fmt.Errorf("exec in %s: %w", name, err)
+	}
+
+	result, err := b.Docker.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return 0, fmt.Errorf("exec in %s: %w", name, err)
+	}
+
+	return result.ExitCode, nil
+}
+
+// execAllowed returns the commands Exec may run.
+func (b *Builder) execAllowed() []string {
+
+	if len(b.Config().API.ExecAllowed) == 0 {
+		return defaultExecAllowed
+	}
+
+	return b.Config().API.ExecAllowed
+}
+
+// syncWriter serialises writes from several log streams.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.w.Write(p)
+	if f, ok := s.w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+
+	return n, err
+}
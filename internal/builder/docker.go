@@ -2,7 +2,6 @@ package builder
 
 import (
 	"fmt"
-	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -21,6 +20,17 @@ func (b *Builder) RestartContainer(name string) error {
 	return b.Docker.ContainerRestart(b.Ctx, name, container.StopOptions{})
 }
 
+// RemoveContainer stops and deletes a container. Its volumes are kept.
+func (b *Builder) RemoveContainer(name string) error {
+
+	err := b.Docker.ContainerRemove(b.Ctx, name, container.RemoveOptions{Force: true})
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
 func (b *Builder) GetAllContainers() ([]types.Container, error) {
 
 	containers, err := b.Docker.ContainerList(b.Ctx, container.ListOptions{
@@ -61,31 +71,3 @@ func (b *Builder) IsContainerRunning(nameOrId string) (bool, error) {
 
 	return info.State.Running, nil
 }
-
-func (b *Builder) StartAllContainers() error {
-
-	for _, repo := range b.WatchList {
-		name := strings.ToLower(repo.ContainerName)
-
-		err := b.StartContainer(name)
-		if err != nil {
-			return fmt.Errorf("starting all containers: %s: %w", name, err)
-		}
-	}
-
-	return nil
-}
-
-func (b *Builder) StopAllContainers() error {
-
-	for _, repo := range b.WatchList {
-		name := strings.ToLower(repo.ContainerName)
-
-		err := b.StopContainer(name)
-		if err != nil {
-			return fmt.Errorf("starting all containers: %s: %w", name, err)
-		}
-	}
-
-	return nil
-}
@@ -11,11 +11,15 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/metrics"
 )
 
-func downloadNewCommit(URL string, projectName string) error {
+func (b *Builder) downloadNewCommit(URL string, projectName string, log *buildLog) error {
 
-	fmt.Println("Downloading " + projectName)
+	log.Printf("Downloading %s from %s", projectName, URL)
 
 	resp, err := http.Get(URL)
 	if err != nil {
@@ -23,38 +27,43 @@ func downloadNewCommit(URL string, projectName string) error {
 	}
 	defer resp.Body.Close()
 
-	err = os.MkdirAll(filepath.Join(os.Getenv("DOWNLOAD_PATH")), 0755)
+	err = os.MkdirAll(filepath.Join(b.Config().Paths.Download), 0755)
 	if err != nil {
 		return err
 	}
 
-	out, err := os.Create(filepath.Join(os.Getenv("DOWNLOAD_PATH"), projectName+".zip"))
+	out, err := os.Create(filepath.Join(b.Config().Paths.Download, projectName+".zip"))
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	n, err := io.Copy(out, resp.Body)
 	if err != nil {
 		return err
 	}
 
+	log.Printf("Downloaded %d bytes", n)
 	return nil
 }
 
-func unpackNewProject(projectName string) error {
+func (b *Builder) unpackNewProject(projectName string, log *buildLog) error {
 
-	r, err := zip.OpenReader(filepath.Join(os.Getenv("DOWNLOAD_PATH"), projectName+".zip"))
+	r, err := zip.OpenReader(filepath.Join(b.Config().Paths.Download, projectName+".zip"))
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
 	for _, file := range r.File {
-		filePath := filepath.Join(os.Getenv("STAGING_PATH"), file.Name)
+		// GitHub puts everything under one directory named after the ref,
+		// "<repo>-main" for the branch or "<repo>-<sha>" for a commit, so it
+		// is renamed to the archive directory.
+		_, rest, _ := strings.Cut(file.Name, "/")
+		filePath := filepath.Join(b.archiveDir(projectName), rest)
 
 		// Check for zip slip (Check for malicious files)
-		if !strings.HasPrefix(filePath, filepath.Clean(os.Getenv("STAGING_PATH"))+string(os.PathSeparator)) {
+		if !strings.HasPrefix(filePath, filepath.Clean(b.Config().Paths.Staging)+string(os.PathSeparator)) {
 			return os.ErrPermission
 		}
 
@@ -90,41 +99,117 @@ func unpackNewProject(projectName string) error {
 		}
 
 	}
+
+	log.Printf("Unpacked %d entries", len(r.File))
 	return nil
 }
 
-func (b *Builder) createContainer(projectName string) error {
-	projectDir := filepath.Join(os.Getenv("STAGING_PATH"), projectName+"-main")
+// archiveDir is where the repo of projectName is unpacked.
+func (b *Builder) archiveDir(projectName string) string {
+	return filepath.Join(b.Config().Paths.Staging, strings.ToLower(projectName)+"-main")
+}
+
+func (b *Builder) createContainer(p project, log *buildLog) error {
+
+	env, err := b.composeEnv(p, log)
+	if err != nil {
+		return err
+	}
 
-	required, err := findComposeVars(projectDir)
+	m, err := b.projectManifest(p.dir)
+	if err != nil {
+		return err
+	}
+	limits, findings, err := b.projectLimits(m)
 	if err != nil {
-		return fmt.Errorf("discover compose vars: %w", err)
+		return err
+	}
+	for _, f := range findings {
+		log.Printf("Limits: %s", f)
+	}
+	log.Printf("Applying %s", limits)
+
+	// Ports come from the repo's own compose files, which are all there is
+	// until the override is written, plus the manifest's public ports that
+	// compose does not publish already.
+	reqs, err := composePorts(composeCommand(p, env, "config", "--format", "json"))
+	if err != nil {
+		return err
+	}
+	reqs = append(reqs, unpublishedPorts(m, reqs)...)
+	assigned, err := b.claimPorts(log.repo, reqs, []string{p.name}, log)
+	if err != nil {
+		return err
+	}
+
+	if err := b.writeComposeOverride(p, env, log.repo, log.sha, limits, m, hostPorts(assigned)); err != nil {
+		return err
+	}
+
+	if m != nil && !m.Image.Build.Empty() {
+		if err := b.buildImage(p, env, m, log); err != nil {
+			return err
+		}
+	}
+
+	out := log.Writer()
+	defer out.Flush()
+
+	if err := b.removeLegacyContainers(p, log.repo, log); err != nil {
+		return err
+	}
+
+	cmd := composeCommand(p, env, "up", "-d", "--build", "--remove-orphans")
+	cmd.Stdout, cmd.Stderr = out, out
+
+	return cmd.Run()
+}
+
+// composeEnv returns the environment for running compose for project p,
+// with every variable the compose file references fetched from Cove.
+func (b *Builder) composeEnv(p project, log *buildLog) ([]string, error) {
+
+	required, err := findComposeVars(p)
+	if err != nil {
+		return nil, fmt.Errorf("discover compose vars: %w", err)
 	}
 
 	env := os.Environ()
 	for v := range required {
+		start := time.Now()
 		val, err := b.CC.GetSecret(v)
+		metrics.ObserveCoveLookup(start, err)
 		if err != nil {
-			return fmt.Errorf("missing value for %q: %w", v, err)
+			return nil, fmt.Errorf("missing value for %q: %w", v, err)
 		}
+		logging.AddSecret(val)
 
 		env = append(env, fmt.Sprintf("%s=%s", v, val))
 	}
+	log.Printf("Injected %d secrets from Cove", len(required))
 
-	cmd := exec.Command("docker", "compose", "up", "-d", "--build", "--remove-orphans")
-	cmd.Dir = projectDir
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	cmd.Env = env
+	return env, nil
+}
 
-	return cmd.Run()
+func (b *Builder) buildSecret(key string) (string, error) {
+
+	start := time.Now()
+	val, err := b.CC.GetSecret(key)
+	metrics.ObserveCoveLookup(start, err)
+	if err != nil {
+		return "", fmt.Errorf("missing value for build secret %q: %w", key, err)
+	}
+	logging.AddSecret(val)
+
+	return val, nil
 }
 
-func findComposeVars(dir string) (map[string]struct{}, error) {
+func findComposeVars(p project) (map[string]struct{}, error) {
 
 	composeVarRx := regexp.MustCompile(`\$\{([^}:]+)(?::[^}]*)?\}`)
 
-	cmd := exec.Command("docker", "compose", "config", "--no-interpolate")
-	cmd.Dir = dir
+	cmd := exec.Command("docker", "compose", "-p", p.name, "config", "--no-interpolate")
+	cmd.Dir = p.dir
 
 	var out bytes.Buffer
 	cmd.Stdout = &out
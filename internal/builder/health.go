@@ -0,0 +1,318 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	// How long a container without any health check must stay up.
+	healthSettle = 10 * time.Second
+
+	healthPollInterval = 2 * time.Second
+)
+
+var errNoContainer = errors.New("container not found")
+
+// healthGate is what a freshly started container has to pass before a
+// deploy counts as successful.
+type healthGate struct {
+	// Path is polled on Port of the container until it answers 2xx. Empty
+	// relies on the container's own HEALTHCHECK, or on it staying up for
+	// healthSettle.
+	Path    string
+	Port    int
+	Timeout time.Duration
+}
+
+// gateFor builds the health gate for a container from its manifest. A nil
+// manifest gives the default gate.
+func (b *Builder) gateFor(m *manifest.Manifest) healthGate {
+
+	gate := healthGate{Timeout: b.Config().Timeouts.Health}
+	if m == nil {
+		return gate
+	}
+
+	hc := m.Run.Healthcheck
+	if hc.Retries > 0 && hc.Interval > 0 {
+		if t := time.Duration(hc.Retries)*(hc.Interval+hc.Timeout) + healthSettle; t > gate.Timeout {
+			gate.Timeout = t
+		}
+	}
+
+	if hc.Path == "" || len(m.Run.Ports) == 0 {
+		return gate
+	}
+
+	gate.Port = m.Run.Ports[0].ContainerPort
+	if p, ok := m.HTTPPort(); ok {
+		gate.Port = p.ContainerPort
+	}
+	gate.Path = "/" + strings.TrimPrefix(hc.Path, "/")
+
+	return gate
+}
+
+// projectGate returns the health gate for a source build, using the
+// repo's manifest when it ships one.
+func (b *Builder) projectGate(p project) (healthGate, error) {
+
+	m, err := b.projectManifest(p.dir)
+	if err != nil {
+		return healthGate{}, err
+	}
+
+	return b.gateFor(m), nil
+}
+
+// projectManifest loads the manifest in projectDir, the directory of an
+// unpacked repo. It returns nil when the repo does not ship one.
+func (b *Builder) projectManifest(projectDir string) (*manifest.Manifest, error) {
+
+	path := filepath.Join(projectDir, manifest.FileName)
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+
+	return manifest.Load(path)
+}
+
+// waitHealthy blocks until container name passes gate or the gate times out.
+func (b *Builder) waitHealthy(name string, gate healthGate, log *buildLog) error {
+
+	deadline := time.Now().Add(gate.Timeout)
+	client := &http.Client{Timeout: 5 * time.Second}
+	lastErr := fmt.Errorf("not healthy within %s", gate.Timeout)
+
+	var shared map[string]bool
+	if gate.Path != "" {
+		shared = b.selfNetworks()
+		log.Printf("Waiting up to %s for %s to answer %s on port %d", gate.Timeout, name, gate.Path, gate.Port)
+	} else {
+		log.Printf("Waiting up to %s for %s to become healthy", gate.Timeout, name)
+	}
+
+	for time.Now().Before(deadline) {
+
+		info, err := b.Docker.ContainerInspect(b.Ctx, name)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return errNoContainer
+			}
+			return fmt.Errorf("inspect %s: %w", name, err)
+		}
+
+		state := info.State
+		switch {
+		case state == nil:
+			return fmt.Errorf("no state for %s", name)
+		case state.Restarting || (!state.Running && state.ExitCode != 0):
+			return fmt.Errorf("%s exited with code %d", name, state.ExitCode)
+		case !state.Running:
+			return fmt.Errorf("%s is not running", name)
+		case state.Health != nil && state.Health.Status == HealthUnhealthy:
+			return fmt.Errorf("%s reports unhealthy", name)
+		}
+
+		healthy := false
+		switch {
+		case gate.Path != "":
+			healthy, lastErr = probe(client, probeURL(info, gate, shared))
+		case state.Health != nil:
+			healthy = state.Health.Status == HealthHealthy
+		default:
+			started, _ := time.Parse(time.RFC3339Nano, state.StartedAt)
+			healthy = time.Since(started) >= healthSettle
+		}
+
+		if healthy {
+			log.Printf("%s is healthy", name)
+			return nil
+		}
+
+		select {
+		case <-b.Ctx.Done():
+			return b.Ctx.Err()
+		case <-time.After(healthPollInterval):
+		}
+	}
+
+	return fmt.Errorf("%s: %w", name, lastErr)
+}
+
+// probeURL returns the address gate is polled at in the container inspected
+// as info. Container names only resolve on user-defined networks, so it is
+// reached by IP, on a network shared with Lighthouse when there is one.
+func probeURL(info types.ContainerJSON, gate healthGate, shared map[string]bool) string {
+
+	host := strings.TrimPrefix(info.Name, "/")
+	if info.NetworkSettings != nil {
+		networks := info.NetworkSettings.Networks
+		var ip string
+		for _, n := range slices.Sorted(maps.Keys(networks)) {
+			ep := networks[n]
+			if ep == nil || ep.IPAddress == "" {
+				continue
+			}
+			if shared[n] {
+				ip = ep.IPAddress
+				break
+			}
+			if ip == "" {
+				ip = ep.IPAddress
+			}
+		}
+		if ip != "" {
+			host = ip
+		}
+	}
+
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, strconv.Itoa(gate.Port)), gate.Path)
+}
+
+// selfNetworks returns the networks Lighthouse's own container is on, or
+// nil when it does not run in one.
+func (b *Builder) selfNetworks() map[string]bool {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, b.Config().Self.ContainerName)
+	if err != nil || info.NetworkSettings == nil {
+		return nil
+	}
+
+	networks := map[string]bool{}
+	for name := range info.NetworkSettings.Networks {
+		networks[name] = true
+	}
+
+	return networks
+}
+
+func probe(client *http.Client, url string) (bool, error) {
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+
+	return true, nil
+}
+
+// previousImage is what a container ran before a deploy, kept so a failed
+// deploy can put it back.
+type previousImage struct {
+	ID  string
+	Ref string
+	SHA string
+}
+
+// currentImage returns the image container name runs, or nil if there is
+// no such container.
+func (b *Builder) currentImage(name string) (*previousImage, error) {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("inspect %s: %w", name, err)
+	}
+	if info.Config == nil {
+		return nil, nil
+	}
+
+	return &previousImage{ID: info.Image, Ref: info.Config.Image, SHA: info.Config.Labels[LabelSHA]}, nil
+}
+
+// gateProject health checks a freshly composed source build and, if it
+// fails, retags the previous image and composes it back up.
+func (b *Builder) gateProject(p project, prev *previousImage, log *buildLog) error {
+
+	gate, err := b.projectGate(p)
+	if err != nil {
+		return err
+	}
+
+	err = b.waitHealthy(p.name, gate, log)
+	if errors.Is(err, errNoContainer) {
+		log.Printf("No container named %s, skipping health check", p.name)
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+
+	log.publish(events.Event{Kind: events.KindHealthCheckFailed, Message: err.Error()})
+	if prev == nil {
+		return fmt.Errorf("health check: %w", err)
+	}
+
+	log.Phase("rollback")
+	if rbErr := b.rollbackProject(p, prev, log); rbErr != nil {
+		return fmt.Errorf("health check: %w, rollback failed: %v", err, rbErr)
+	}
+	log.publish(events.Event{Kind: events.KindRollback, Message: "restored " + prev.Ref + " after failed health check: " + err.Error()})
+
+	return fmt.Errorf("health check: %w, rolled back to previous image", err)
+}
+
+func (b *Builder) rollbackProject(p project, prev *previousImage, log *buildLog) error {
+
+	log.Printf("Restoring %s as %s", shortID(prev.ID), prev.Ref)
+	if err := b.Docker.ImageTag(b.Ctx, prev.ID, prev.Ref); err != nil {
+		return fmt.Errorf("retag %s: %w", prev.Ref, err)
+	}
+
+	env, err := b.composeEnv(p, log)
+	if err != nil {
+		return err
+	}
+
+	m, err := b.projectManifest(p.dir)
+	if err != nil {
+		return err
+	}
+	limits, _, err := b.projectLimits(m)
+	if err != nil {
+		return err
+	}
+
+	out := log.Writer()
+	defer out.Flush()
+
+	if err := b.writeComposeOverride(p, env, log.repo, prev.SHA, limits, m, hostPorts(b.Ports.Owned(log.repo))); err != nil {
+		return err
+	}
+
+	cmd := composeCommand(p, env, "up", "-d", "--no-build", "--remove-orphans")
+	cmd.Stdout, cmd.Stderr = out, out
+
+	return cmd.Run()
+}
+
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,331 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/moby/patternmatcher/ignorefile"
+	"github.com/opencontainers/go-digest"
+)
+
+// composeService is what Lighthouse reads of a service from compose config.
+type composeService struct {
+	Image    string        `json:"image"`
+	Platform string        `json:"platform"`
+	Build    *composeBuild `json:"build"`
+}
+
+type composeBuild struct {
+	Context    string             `json:"context"`
+	Dockerfile string             `json:"dockerfile"`
+	Args       map[string]*string `json:"args"`
+	Target     string             `json:"target"`
+}
+
+// ownServices returns the services of p as the repo's own compose files
+// define them, before the override takes their build out of compose's
+// hands.
+func ownServices(p project, env []string) (map[string]composeService, error) {
+
+	var out bytes.Buffer
+	cmd := ownComposeCommand(p, env, "config", "--format", "json")
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("compose config: %w", err)
+	}
+
+	var cfg struct {
+		Services map[string]composeService `json:"services"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		return nil, fmt.Errorf("parse compose config: %w", err)
+	}
+
+	return cfg.Services, nil
+}
+
+// manifestService returns the compose service manifest m describes, the
+// one it names or else the only one there is.
+func manifestService(m *manifest.Manifest, names []string) string {
+
+	if !slices.Contains(names, m.Service) && len(names) == 1 {
+		return names[0]
+	}
+
+	return m.Service
+}
+
+// serviceImage is the image compose runs service name of p from.
+func serviceImage(p project, name string, svc composeService) string {
+
+	if svc.Image != "" {
+		return svc.Image
+	}
+	// Compose names the images it builds after the project and service.
+	return p.name + "-" + name
+}
+
+// imageBuildOptions lays the manifest's build section over the build of
+// service name in the compose file. It returns the directory to send as the
+// build context and the options to build it with.
+func imageBuildOptions(p project, name string, svc composeService, build manifest.Build) (string, types.ImageBuildOptions) {
+
+	own := composeBuild{}
+	if svc.Build != nil {
+		own = *svc.Build
+	}
+
+	contextDir := p.dir
+	switch {
+	case build.Context != "":
+		contextDir = filepath.Join(p.dir, build.Context)
+	case own.Context != "":
+		contextDir = own.Context
+	}
+
+	dockerfile := "Dockerfile"
+	switch {
+	case build.Dockerfile != "":
+		dockerfile = build.Dockerfile
+	case own.Dockerfile != "":
+		dockerfile = own.Dockerfile
+	}
+	if filepath.IsAbs(dockerfile) {
+		if rel, err := filepath.Rel(contextDir, dockerfile); err == nil {
+			dockerfile = rel
+		}
+	}
+
+	args := maps.Clone(own.Args)
+	if args == nil {
+		args = map[string]*string{}
+	}
+	for _, arg := range build.Args {
+		k, v, _ := strings.Cut(arg, "=")
+		args[k] = &v
+	}
+
+	opts := types.ImageBuildOptions{
+		Version:    types.BuilderBuildKit,
+		Tags:       []string{serviceImage(p, name, svc)},
+		Dockerfile: filepath.ToSlash(dockerfile),
+		BuildArgs:  args,
+		Target:     own.Target,
+		Platform:   svc.Platform,
+		Remove:     true,
+	}
+	if build.Target != "" {
+		opts.Target = build.Target
+	}
+	if build.Platform != "" {
+		opts.Platform = build.Platform
+	}
+
+	return contextDir, opts
+}
+
+// buildImage builds the image of manifest m's service through the Docker
+// build API. Its args_from_cove are mounted as BuildKit secrets and its
+// ssh_key_from_cove is served by an agent, both over a session that only
+// lasts for the build. The override then has compose run the image rather
+// than build one of its own.
+func (b *Builder) buildImage(p project, env []string, m *manifest.Manifest, log *buildLog) error {
+
+	services, err := ownServices(p, env)
+	if err != nil {
+		return err
+	}
+	name := manifestService(m, slices.Sorted(maps.Keys(services)))
+	svc, ok := services[name]
+	if !ok {
+		return fmt.Errorf("manifest service %q is not in the compose file", m.Service)
+	}
+	contextDir, opts := imageBuildOptions(p, name, svc, m.Image.Build)
+
+	ctx, cancel := context.WithCancel(b.Ctx)
+	defer cancel()
+
+	sess, err := session.NewSession(ctx, "lighthouse", "")
+	if err != nil {
+		return fmt.Errorf("build session: %w", err)
+	}
+
+	secrets := map[string][]byte{}
+	for id, key := range m.Image.Build.CoveSecrets() {
+		val, err := b.buildSecret(key)
+		if err != nil {
+			return err
+		}
+		secrets[id] = []byte(val)
+	}
+	sess.Allow(secretsprovider.FromMap(secrets))
+	if len(secrets) > 0 {
+		log.Printf("Mounting %d build secrets from Cove", len(secrets))
+	}
+
+	if key := m.Image.Build.SSHKeyFromCove; key != "" {
+		agent, err := b.buildAgent(key)
+		if err != nil {
+			return err
+		}
+		defer agent.Close()
+
+		forward, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{{Paths: []string{agent.Socket()}}})
+		if err != nil {
+			return fmt.Errorf("ssh_key_from_cove %q: %w", key, err)
+		}
+		sess.Allow(forward)
+		log.Printf("Forwarding SSH agent for %s", agent.Fingerprint())
+	}
+
+	go sess.Run(ctx, func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+		return b.Docker.DialHijack(ctx, "/session", proto, meta)
+	})
+	defer sess.Close()
+	opts.SessionID = sess.ID()
+
+	buildContext, err := tarContext(contextDir, opts.Dockerfile)
+	if err != nil {
+		return fmt.Errorf("build context %s: %w", contextDir, err)
+	}
+	defer buildContext.Close()
+
+	log.Printf("Building %s as %s", name, opts.Tags[0])
+	resp, err := b.Docker.ImageBuild(ctx, buildContext, opts)
+	if err != nil {
+		return fmt.Errorf("build %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	out := log.Writer()
+	defer out.Flush()
+
+	if err := streamBuild(resp.Body, out); err != nil {
+		return fmt.Errorf("build %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// buildAgent starts an SSH agent serving the private key held in Cove
+// under key.
+func (b *Builder) buildAgent(key string) (*sshAgent, error) {
+
+	pem, err := b.buildSecret(key)
+	if err != nil {
+		return nil, err
+	}
+	// Build output is redacted line by line, so the lines of the key have to
+	// be known on their own too.
+	for _, line := range strings.Split(pem, "\n") {
+		if !strings.HasPrefix(line, "-----") {
+			logging.AddSecret(strings.TrimSpace(line))
+		}
+	}
+
+	agent, err := startSSHAgent([]byte(pem))
+	if err != nil {
+		return nil, fmt.Errorf("ssh_key_from_cove %q: %w", key, err)
+	}
+
+	return agent, nil
+}
+
+// tarContext packs dir as a build context, leaving out what its
+// .dockerignore lists as the docker CLI does.
+func tarContext(dir string, dockerfile string) (io.ReadCloser, error) {
+
+	var excludes []string
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	switch {
+	case err == nil:
+		excludes, err = ignorefile.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read .dockerignore: %w", err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	// The builder still needs the Dockerfile when it is ignored.
+	if len(excludes) > 0 {
+		excludes = append(excludes, "!"+dockerfile, "!.dockerignore")
+	}
+
+	return archive.TarWithOptions(dir, &archive.TarOptions{ExcludePatterns: excludes})
+}
+
+// buildkitTrace is the id of the messages carrying BuildKit's progress.
+const buildkitTrace = "moby.buildkit.trace"
+
+// streamBuild writes the steps and output of a build to out as they come
+// in, and returns the error the build ended with.
+func streamBuild(body io.Reader, out io.Writer) error {
+
+	started := map[digest.Digest]bool{}
+	dec := json.NewDecoder(body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.Stream != "" {
+			io.WriteString(out, msg.Stream)
+		}
+		if msg.ID != buildkitTrace || msg.Aux == nil {
+			continue
+		}
+
+		var data []byte
+		if err := json.Unmarshal(*msg.Aux, &data); err != nil {
+			continue
+		}
+		var status controlapi.StatusResponse
+		if err := status.Unmarshal(data); err != nil {
+			continue
+		}
+		for _, v := range status.Vertexes {
+			if v.Started != nil && !started[v.Digest] {
+				started[v.Digest] = true
+				if v.Cached {
+					fmt.Fprintf(out, "%s (cached)\n", v.Name)
+				} else {
+					fmt.Fprintln(out, v.Name)
+				}
+			}
+			if v.Error != "" {
+				fmt.Fprintf(out, "%s: %s\n", v.Name, v.Error)
+			}
+		}
+		for _, l := range status.Logs {
+			out.Write(l.Msg)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package builder
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/docker/docker/api/types"
+)
+
+func TestImageBuildOptions(t *testing.T) {
+
+	p := project{name: "app", dir: "/work/app"}
+	str := func(s string) *string { return &s }
+
+	own := composeService{
+		Platform: "linux/amd64",
+		Build: &composeBuild{
+			Context:    "/work/app/web",
+			Dockerfile: "Dockerfile.prod",
+			Args:       map[string]*string{"NODE_ENV": str("production"), "GOFLAGS": str("-mod=vendor")},
+			Target:     "runtime",
+		},
+	}
+
+	tests := []struct {
+		name       string
+		svc        composeService
+		build      manifest.Build
+		contextDir string
+		want       types.ImageBuildOptions
+	}{
+		{
+			name:       "compose settings kept",
+			svc:        own,
+			contextDir: "/work/app/web",
+			want: types.ImageBuildOptions{
+				Tags:       []string{"app-web"},
+				Dockerfile: "Dockerfile.prod",
+				BuildArgs:  map[string]*string{"NODE_ENV": str("production"), "GOFLAGS": str("-mod=vendor")},
+				Target:     "runtime",
+				Platform:   "linux/amd64",
+			},
+		},
+		{
+			name: "manifest over compose",
+			svc:  own,
+			build: manifest.Build{
+				Context:    "services/web",
+				Dockerfile: "deploy/Dockerfile",
+				Args:       []string{"GOFLAGS=-trimpath", "DEBUG"},
+				Target:     "release",
+				Platform:   "linux/arm64",
+			},
+			contextDir: "/work/app/services/web",
+			want: types.ImageBuildOptions{
+				Tags:       []string{"app-web"},
+				Dockerfile: "deploy/Dockerfile",
+				BuildArgs:  map[string]*string{"NODE_ENV": str("production"), "GOFLAGS": str("-trimpath"), "DEBUG": str("")},
+				Target:     "release",
+				Platform:   "linux/arm64",
+			},
+		},
+		{
+			name:       "image only service",
+			svc:        composeService{Image: "ghcr.io/acme/web:latest"},
+			build:      manifest.Build{Target: "release"},
+			contextDir: "/work/app",
+			want: types.ImageBuildOptions{
+				Tags:       []string{"ghcr.io/acme/web:latest"},
+				Dockerfile: "Dockerfile",
+				BuildArgs:  map[string]*string{},
+				Target:     "release",
+			},
+		},
+		{
+			name:       "absolute dockerfile",
+			svc:        composeService{Build: &composeBuild{Context: "/work/app", Dockerfile: "/work/app/docker/Dockerfile"}},
+			contextDir: "/work/app",
+			want: types.ImageBuildOptions{
+				Tags:       []string{"app-web"},
+				Dockerfile: "docker/Dockerfile",
+				BuildArgs:  map[string]*string{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		contextDir, got := imageBuildOptions(p, "web", tt.svc, tt.build)
+		if contextDir != tt.contextDir {
+			t.Errorf("%s: context %q, want %q", tt.name, contextDir, tt.contextDir)
+		}
+		if got.Version != types.BuilderBuildKit {
+			t.Errorf("%s: builder version %q", tt.name, got.Version)
+		}
+		if len(got.Tags) != 1 || got.Tags[0] != tt.want.Tags[0] {
+			t.Errorf("%s: tags %v, want %v", tt.name, got.Tags, tt.want.Tags)
+		}
+		if got.Dockerfile != tt.want.Dockerfile || got.Target != tt.want.Target || got.Platform != tt.want.Platform {
+			t.Errorf("%s: dockerfile, target, platform = %q, %q, %q, want %q, %q, %q", tt.name, got.Dockerfile, got.Target, got.Platform, tt.want.Dockerfile, tt.want.Target, tt.want.Platform)
+		}
+		if !maps.EqualFunc(got.BuildArgs, tt.want.BuildArgs, func(a, b *string) bool { return *a == *b }) {
+			t.Errorf("%s: args %v, want %v", tt.name, got.BuildArgs, tt.want.BuildArgs)
+		}
+	}
+
+	// The compose file's args are not changed by the manifest's.
+	if *own.Build.Args["GOFLAGS"] != "-mod=vendor" {
+		t.Errorf("compose args changed to %q", *own.Build.Args["GOFLAGS"])
+	}
+}
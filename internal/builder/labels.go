@@ -0,0 +1,288 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/docker/docker/errdefs"
+	"gopkg.in/yaml.v3"
+)
+
+// Labels put on every container Lighthouse deploys.
+const (
+	LabelManagedBy = "managed-by"
+	LabelRepo      = "lighthouse.repo"
+	LabelSHA       = "lighthouse.sha"
+	LabelService   = "lighthouse.service"
+	LabelImage     = "lighthouse.image"
+
+	managedByValue = "lighthouse"
+)
+
+// overrideFile is written next to a repo's compose file so Lighthouse can
+// add to what compose deploys without touching the repo's own files.
+const overrideFile = ".lighthouse.override.yml"
+
+// ContainerStatus is what the reconciler needs to know about a container.
+type ContainerStatus struct {
+	Exists  bool
+	Running bool
+	Labels  map[string]string
+}
+
+func (b *Builder) ContainerStatus(name string) (ContainerStatus, error) {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return ContainerStatus{}, nil
+		}
+		return ContainerStatus{}, fmt.Errorf("inspect %q: %w", name, err)
+	}
+
+	status := ContainerStatus{Exists: true}
+	if info.State != nil {
+		status.Running = info.State.Running
+	}
+	if info.Config != nil {
+		status.Labels = info.Config.Labels
+	}
+
+	return status, nil
+}
+
+// writeComposeOverride labels every service of compose project p with the
+// repo and commit being deployed, and applies limits to each of them. The
+// volumes of manifest m, if there is one, are mounted into its service, its
+// public ports listed in published are bound to the host ports given there,
+// and its routes are labelled for the proxy.
+func (b *Builder) writeComposeOverride(p project, env []string, repo string, sha string, limits Limits, m *manifest.Manifest, published map[string]int) error {
+
+	var out bytes.Buffer
+	cmd := ownComposeCommand(p, env, "config", "--services")
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("compose config --services: %w", err)
+	}
+
+	names := strings.Fields(out.String())
+	services := map[string]any{}
+	for _, name := range names {
+		svc := limits.composeKeys()
+		svc["labels"] = map[string]string{
+			LabelManagedBy: managedByValue,
+			LabelRepo:      repo,
+			LabelSHA:       sha,
+		}
+		services[name] = svc
+	}
+
+	override := map[string]any{"services": services}
+
+	// Named volumes are prefixed with the project name, so those created
+	// before projects were named after their container keep their name.
+	pinned, err := b.legacyVolumes(p, env)
+	if err != nil {
+		return err
+	}
+	volumes := map[string]any{}
+	for key, name := range pinned {
+		volumes[key] = map[string]any{"name": name}
+	}
+	if len(volumes) > 0 {
+		override["volumes"] = volumes
+	}
+	if m != nil && (len(m.Run.Volumes) > 0 || len(published) > 0 || len(m.Deploy.Routes) > 0 || !m.Image.Build.Empty()) {
+		target := manifestService(m, names)
+		svc, ok := services[target].(map[string]any)
+		if !ok {
+			return fmt.Errorf("manifest service %q is not in the compose file", m.Service)
+		}
+
+		labels := svc["labels"].(map[string]string)
+		for k, v := range routeLabels(m) {
+			labels[k] = v
+		}
+
+		var bindings []string
+		for _, p := range m.Run.Ports {
+			if hostPort, ok := published[p.Name]; ok && p.Public {
+				proto := p.Protocol
+				if proto == "" {
+					proto = "tcp"
+				}
+				bindings = append(bindings, fmt.Sprintf("%d:%d/%s", hostPort, p.ContainerPort, proto))
+			}
+		}
+		if len(bindings) > 0 {
+			svc["ports"] = bindings
+		}
+
+		var mounts, tmpfs []string
+		for _, v := range m.Run.Volumes {
+			switch {
+			case v.Type == "tmpfs":
+				tmpfs = append(tmpfs, v.MountPath)
+			case v.Persistent():
+				// The volumes are created by Lighthouse, so compose must
+				// use them as they are rather than prefixing the project.
+				name := volumeName(p.name, v.Name)
+				volumes[name] = map[string]any{"external": true, "name": name}
+				mounts = append(mounts, name+":"+v.MountPath)
+			}
+		}
+		if len(mounts) > 0 {
+			svc["volumes"] = mounts
+			override["volumes"] = volumes
+		}
+		if len(tmpfs) > 0 {
+			svc["tmpfs"] = tmpfs
+		}
+
+		// The image is built by buildImage, so compose runs it rather than
+		// building the service itself.
+		if !m.Image.Build.Empty() {
+			own, err := ownServices(p, env)
+			if err != nil {
+				return err
+			}
+			svc["image"] = serviceImage(p, target, own[target])
+			svc["build"] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!reset", Value: "null"}
+		}
+		if m.Image.Build.Platform != "" {
+			svc["platform"] = m.Image.Build.Platform
+		}
+
+		// The proxy reaches routed services by their address on its
+		// network, as it does managed services.
+		if b.Proxy != nil && len(m.Deploy.Routes) > 0 {
+			networks, err := proxyNetworks(p, env, target, b.Config().Proxy.Network)
+			if err != nil {
+				return err
+			}
+			if len(networks) > 0 {
+				svc["networks"] = networks
+				override["networks"] = map[string]any{
+					proxyNetworkKey: map[string]any{"name": b.Config().Proxy.Network, "external": true},
+				}
+			}
+		}
+	}
+
+	data, err := yaml.Marshal(override)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(p.dir, overrideFile), data, 0644)
+}
+
+// proxyNetworkKey is the name the proxy network goes by in the override.
+const proxyNetworkKey = "lighthouse-proxy"
+
+// proxyNetworks returns the networks service of p has to be given in the
+// override to join proxyNet, or none when the repo already puts it there.
+// Naming networks drops the implicit default one, so that is kept when the
+// repo relies on it.
+func proxyNetworks(p project, env []string, service string, proxyNet string) ([]string, error) {
+
+	var out bytes.Buffer
+	cmd := ownComposeCommand(p, env, "config", "--format", "json")
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("compose config: %w", err)
+	}
+
+	var cfg struct {
+		Services map[string]struct {
+			NetworkMode string         `json:"network_mode"`
+			Networks    map[string]any `json:"networks"`
+		} `json:"services"`
+		Networks map[string]struct {
+			Name string `json:"name"`
+		} `json:"networks"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		return nil, fmt.Errorf("parse compose config: %w", err)
+	}
+
+	svc := cfg.Services[service]
+	if svc.NetworkMode != "" {
+		return nil, fmt.Errorf("service %q sets network_mode, so it cannot join the proxy network %s", service, proxyNet)
+	}
+
+	networks := slices.Sorted(maps.Keys(svc.Networks))
+	for _, key := range networks {
+		if cfg.Networks[key].Name == proxyNet {
+			return nil, nil
+		}
+	}
+	if len(networks) == 0 {
+		networks = []string{"default"}
+	}
+
+	return append(networks, proxyNetworkKey), nil
+}
+
+// composeFiles returns the -f arguments selecting the project's own compose
+// files followed by Lighthouse's override, mirroring compose's own lookup.
+func composeFiles(projectDir string) []string {
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(projectDir, name))
+		return err == nil
+	}
+
+	var args []string
+	for _, candidates := range [][]string{
+		{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"},
+		{"compose.override.yaml", "compose.override.yml", "docker-compose.override.yaml", "docker-compose.override.yml"},
+	} {
+		for _, name := range candidates {
+			if exists(name) {
+				args = append(args, "-f", name)
+				break
+			}
+		}
+	}
+
+	if exists(overrideFile) {
+		args = append(args, "-f", overrideFile)
+	}
+
+	return args
+}
+
+// composeCommand runs docker compose for project p with Lighthouse's
+// override applied.
+func composeCommand(p project, env []string, args ...string) *exec.Cmd {
+
+	cmd := exec.Command("docker", append(append([]string{"compose", "-p", p.name}, composeFiles(p.dir)...), args...)...)
+	cmd.Dir = p.dir
+	cmd.Env = env
+
+	return cmd
+}
+
+// ownComposeCommand runs docker compose for project p on the repo's own
+// compose files alone. Compose does not look for the override by itself, so
+// without the -f arguments of composeFiles it is left out. The override is
+// worked out from this, since the one left by the last deploy is about to be
+// rewritten and must not feed into the new one.
+func ownComposeCommand(p project, env []string, args ...string) *exec.Cmd {
+
+	cmd := exec.Command("docker", append([]string{"compose", "-p", p.name}, args...)...)
+	cmd.Dir = p.dir
+	cmd.Env = env
+
+	return cmd
+}
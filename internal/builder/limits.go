@@ -0,0 +1,211 @@
+package builder
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/docker/docker/api/types/container"
+)
+
+// Limits are the resources and restart policy a container runs with. Zero
+// values and an empty restart policy mean no limit and Docker's default.
+type Limits struct {
+	NanoCPUs int64  `json:"nanoCpus"`
+	Memory   int64  `json:"memory"`
+	PIDs     int64  `json:"pids"`
+	Restart  string `json:"restart"`
+}
+
+func (l Limits) String() string {
+
+	s := "cpu " + orNone(l.NanoCPUs, manifest.FormatCPU) +
+		", memory " + orNone(l.Memory, manifest.FormatMemory) +
+		", pids " + orNone(l.PIDs, func(n int64) string { return strconv.FormatInt(n, 10) })
+	if l.Restart != "" {
+		s += ", restart " + l.Restart
+	}
+
+	return s
+}
+
+func orNone(v int64, format func(int64) string) string {
+	if v <= 0 {
+		return "none"
+	}
+	return format(v)
+}
+
+// resources converts the limits for a container's HostConfig.
+func (l Limits) resources() container.Resources {
+
+	r := container.Resources{NanoCPUs: l.NanoCPUs, Memory: l.Memory}
+	if l.PIDs > 0 {
+		pids := l.PIDs
+		r.PidsLimit = &pids
+	}
+
+	return r
+}
+
+// composeKeys returns the limits as compose service keys for the override.
+func (l Limits) composeKeys() map[string]any {
+
+	keys := map[string]any{}
+	if l.NanoCPUs > 0 {
+		keys["cpus"] = float64(l.NanoCPUs) / 1e9
+	}
+	if l.Memory > 0 {
+		keys["mem_limit"] = l.Memory
+	}
+	if l.PIDs > 0 {
+		keys["pids_limit"] = l.PIDs
+	}
+	if l.Restart != "" {
+		keys["restart"] = l.Restart
+	}
+
+	return keys
+}
+
+// limitPolicy holds the defaults given to containers whose manifest leaves a
+// limit out, and the caps no container on this host may go over.
+type limitPolicy struct {
+	Defaults Limits
+	Caps     Limits
+}
+
+// limitPolicy reads the defaults and caps from the config.
+func (b *Builder) limitPolicy() (limitPolicy, error) {
+
+	cfg := b.Config().Limits
+	p := limitPolicy{
+		Defaults: Limits{PIDs: cfg.PIDs, Restart: cfg.Restart},
+		Caps:     Limits{PIDs: cfg.MaxPIDs},
+	}
+
+	var err error
+	if p.Defaults.NanoCPUs, err = manifest.ParseCPU(cfg.CPU); err != nil {
+		return limitPolicy{}, fmt.Errorf("limits.cpu: %w", err)
+	}
+	if p.Defaults.Memory, err = manifest.ParseMemory(cfg.Memory); err != nil {
+		return limitPolicy{}, fmt.Errorf("limits.memory: %w", err)
+	}
+	if p.Caps.NanoCPUs, err = manifest.ParseCPU(cfg.MaxCPU); err != nil {
+		return limitPolicy{}, fmt.Errorf("limits.max_cpu: %w", err)
+	}
+	if p.Caps.Memory, err = manifest.ParseMemory(cfg.MaxMemory); err != nil {
+		return limitPolicy{}, fmt.Errorf("limits.max_memory: %w", err)
+	}
+
+	return p, nil
+}
+
+// resolve works out the limits for a container from its manifest's
+// resources and restart policy. Missing limits take the defaults and
+// anything over a cap is lowered to it. The findings explain both.
+func (p limitPolicy) resolve(res manifest.Resources, restart string) (Limits, []string, error) {
+
+	var l Limits
+	var findings []string
+	var err error
+
+	if l.NanoCPUs, err = manifest.ParseCPU(res.CPU); err != nil {
+		return Limits{}, nil, err
+	}
+	if l.Memory, err = manifest.ParseMemory(res.Memory); err != nil {
+		return Limits{}, nil, err
+	}
+	l.PIDs = res.PIDs
+	l.Restart = restart
+
+	apply := func(what string, v *int64, def int64, limit int64, format func(int64) string) {
+		if *v == 0 && def > 0 {
+			*v = def
+			findings = append(findings, fmt.Sprintf("no %s limit in manifest, using default %s", what, format(def)))
+		}
+		if limit > 0 && (*v == 0 || *v > limit) {
+			if *v == 0 {
+				findings = append(findings, fmt.Sprintf("no %s limit, using host cap %s", what, format(limit)))
+			} else {
+				findings = append(findings, fmt.Sprintf("%s %s exceeds host cap %s, capped", what, format(*v), format(limit)))
+			}
+			*v = limit
+		}
+		if *v == 0 {
+			findings = append(findings, "no "+what+" limit")
+		}
+	}
+	apply("cpu", &l.NanoCPUs, p.Defaults.NanoCPUs, p.Caps.NanoCPUs, manifest.FormatCPU)
+	apply("memory", &l.Memory, p.Defaults.Memory, p.Caps.Memory, manifest.FormatMemory)
+	apply("pids", &l.PIDs, p.Defaults.PIDs, p.Caps.PIDs, func(n int64) string { return strconv.FormatInt(n, 10) })
+
+	if l.Restart == "" {
+		l.Restart = p.Defaults.Restart
+	}
+
+	return l, findings, nil
+}
+
+// check reports how limits Lighthouse did not set itself measure up to the
+// policy.
+func (p limitPolicy) check(l Limits) []string {
+
+	var findings []string
+
+	check := func(what string, v int64, limit int64, format func(int64) string) {
+		switch {
+		case v == 0 && limit > 0:
+			findings = append(findings, fmt.Sprintf("no %s limit, host cap is %s", what, format(limit)))
+		case v == 0:
+			findings = append(findings, "no "+what+" limit")
+		case limit > 0 && v > limit:
+			findings = append(findings, fmt.Sprintf("%s %s exceeds host cap %s", what, format(v), format(limit)))
+		}
+	}
+	check("cpu", l.NanoCPUs, p.Caps.NanoCPUs, manifest.FormatCPU)
+	check("memory", l.Memory, p.Caps.Memory, manifest.FormatMemory)
+	check("pids", l.PIDs, p.Caps.PIDs, func(n int64) string { return strconv.FormatInt(n, 10) })
+
+	return findings
+}
+
+// projectLimits resolves the limits for a source build from the repo's
+// manifest, or from the defaults when it has none.
+func (b *Builder) projectLimits(m *manifest.Manifest) (Limits, []string, error) {
+
+	policy, err := b.limitPolicy()
+	if err != nil {
+		return Limits{}, nil, err
+	}
+
+	if m == nil {
+		return policy.resolve(manifest.Resources{}, "")
+	}
+
+	return policy.resolve(m.Run.Resources, m.Deploy.Restart)
+}
+
+// containerLimits reads the limits container name is running with.
+func (b *Builder) containerLimits(name string) (Limits, error) {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if err != nil {
+		return Limits{}, fmt.Errorf("inspect %s: %w", name, err)
+	}
+
+	var l Limits
+	if hc := info.HostConfig; hc != nil {
+		l.NanoCPUs = hc.NanoCPUs
+		if l.NanoCPUs == 0 && hc.CPUQuota > 0 && hc.CPUPeriod > 0 {
+			l.NanoCPUs = hc.CPUQuota * 1e9 / hc.CPUPeriod
+		}
+		l.Memory = hc.Memory
+		if hc.PidsLimit != nil && *hc.PidsLimit > 0 {
+			l.PIDs = *hc.PidsLimit
+		}
+		l.Restart = string(hc.RestartPolicy.Name)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,188 @@
+package builder
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/ports"
+)
+
+// Where the limits of a plan entry come from.
+const (
+	// PlanFromManifest limits are resolved from a manifest and applied on
+	// the next deploy.
+	PlanFromManifest = "manifest"
+	// PlanFromDefaults limits are the host defaults, for image services.
+	PlanFromDefaults = "defaults"
+	// PlanFromContainer limits are read from a running container, for repos
+	// and compose services whose limits are only known once deployed.
+	PlanFromContainer = "container"
+)
+
+// Plan is what Lighthouse would run on this host and what is wrong with it.
+type Plan struct {
+	Entries []PlanEntry `json:"entries"`
+	// Host lists problems that involve more than one container.
+	Host []string `json:"host"`
+}
+
+type PlanEntry struct {
+	Name      string             `json:"name"`
+	Container string             `json:"container"`
+	Source    string             `json:"source"`
+	Limits    Limits             `json:"limits"`
+	Ports     []ports.Assignment `json:"ports,omitempty"`
+	Findings  []string           `json:"findings"`
+}
+
+// Plan checks every watched repo and managed service against the limit
+// policy and the port registry without changing anything.
+func (b *Builder) Plan() (Plan, error) {
+
+	policy, err := b.limitPolicy()
+	if err != nil {
+		return Plan{}, err
+	}
+
+	var plan Plan
+
+	for _, repo := range b.WatchList() {
+		if b.isSelf(repo) {
+			continue
+		}
+		containers, err := b.RepoContainers(repo)
+		if err != nil {
+			return Plan{}, err
+		}
+		entries := b.runningEntries(policy, repo.DisplayName, containers)
+
+		// A repo's compose files are only read when it builds, so check
+		// the ports it was given then.
+		var reqs []ports.Request
+		for _, a := range b.Ports.Owned(repo.DisplayName) {
+			reqs = append(reqs, ports.Request{Port: a.Port, ContainerPort: a.ContainerPort, Protocol: a.Protocol, HostPort: a.HostPort})
+		}
+		if err := b.planEntryPorts(&entries[0], reqs, containers); err != nil {
+			return Plan{}, err
+		}
+		plan.Entries = append(plan.Entries, entries...)
+	}
+
+	for _, svc := range b.Services() {
+		switch svc.Kind() {
+		case models.ServiceKindImage:
+			limits, findings, _ := policy.resolve(manifest.Resources{}, "")
+			plan.Entries = append(plan.Entries, PlanEntry{Name: svc.Name, Container: svc.ContainerName, Source: PlanFromDefaults, Limits: limits, Findings: findings})
+
+		case models.ServiceKindManifest:
+			entry := PlanEntry{Name: svc.Name, Container: svc.ContainerName, Source: PlanFromManifest}
+			m, err := manifest.Load(svc.ManifestPath)
+			if err != nil {
+				entry.Findings = []string{err.Error()}
+			} else {
+				entry.Limits, entry.Findings, _ = policy.resolve(m.Run.Resources, m.Deploy.Restart)
+				if err := b.planEntryPorts(&entry, manifestPorts(m), []string{svc.ContainerName}); err != nil {
+					return Plan{}, err
+				}
+			}
+			plan.Entries = append(plan.Entries, entry)
+
+		case models.ServiceKindCompose:
+			containers, err := b.ServiceContainers(svc)
+			if err != nil {
+				return Plan{}, err
+			}
+			entries := b.runningEntries(policy, svc.Name, containers)
+			reqs, err := composePorts(serviceCompose(svc.ComposePath, "config", "--format", "json"))
+			if err != nil {
+				entries[0].Findings = append(entries[0].Findings, err.Error())
+			} else if err := b.planEntryPorts(&entries[0], reqs, containers); err != nil {
+				return Plan{}, err
+			}
+			plan.Entries = append(plan.Entries, entries...)
+		}
+	}
+
+	// Owners are planned one at a time against what is already claimed, so
+	// two that want the same unclaimed port only show up side by side.
+	// Assigned ports move out of the way on deploy, so it only matters
+	// when one of them asked for the port by number.
+	wanted := map[string][]string{}
+	fixed := map[string]bool{}
+	var keys []string
+	for _, e := range plan.Entries {
+		for _, a := range e.Ports {
+			key := fmt.Sprintf("%d/%s", a.HostPort, a.Protocol)
+			if len(wanted[key]) == 0 {
+				keys = append(keys, key)
+			}
+			if !slices.Contains(wanted[key], e.Name) {
+				wanted[key] = append(wanted[key], e.Name)
+			}
+			fixed[key] = fixed[key] || a.Fixed
+		}
+	}
+	for _, key := range keys {
+		if owners := wanted[key]; len(owners) > 1 && fixed[key] {
+			plan.Host = append(plan.Host, fmt.Sprintf("host port %s is wanted by %s", key, strings.Join(owners, " and ")))
+		}
+	}
+
+	host, err := b.Docker.Info(b.Ctx)
+	if err != nil {
+		return Plan{}, fmt.Errorf("docker info: %w", err)
+	}
+
+	var memory int64
+	for i, e := range plan.Entries {
+		memory += e.Limits.Memory
+		if cpus := int64(host.NCPU) * 1e9; e.Limits.NanoCPUs > cpus {
+			plan.Entries[i].Findings = append(plan.Entries[i].Findings, fmt.Sprintf("cpu %s is more than the host's %d cores", manifest.FormatCPU(e.Limits.NanoCPUs), host.NCPU))
+		}
+	}
+	if host.MemTotal > 0 && memory > host.MemTotal {
+		plan.Host = append(plan.Host, fmt.Sprintf("memory limits add up to %s, more than the host's %s", manifest.FormatMemory(memory), manifest.FormatMemory(host.MemTotal)))
+	}
+
+	return plan, nil
+}
+
+// planEntryPorts adds the host ports the entry's owner would get, and any
+// conflicts, to entry.
+func (b *Builder) planEntryPorts(entry *PlanEntry, reqs []ports.Request, own []string) error {
+
+	assigned, findings, err := b.planPorts(entry.Name, reqs, own)
+	if err != nil {
+		return err
+	}
+	entry.Ports = assigned
+	entry.Findings = append(entry.Findings, findings...)
+
+	return nil
+}
+
+// runningEntries reads the limits of containers that compose created.
+func (b *Builder) runningEntries(policy limitPolicy, name string, containers []string) []PlanEntry {
+
+	if len(containers) == 0 {
+		return []PlanEntry{{Name: name, Source: PlanFromContainer, Findings: []string{"not deployed, limits are applied on the next deploy"}}}
+	}
+
+	var entries []PlanEntry
+	for _, c := range containers {
+		entry := PlanEntry{Name: name, Container: c, Source: PlanFromContainer}
+		limits, err := b.containerLimits(c)
+		if err != nil {
+			entry.Findings = []string{err.Error()}
+		} else {
+			entry.Limits = limits
+			entry.Findings = policy.check(limits)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
@@ -0,0 +1,191 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/LSariol/LightHouse/internal/ports"
+	"github.com/docker/docker/api/types/container"
+)
+
+// manifestPorts returns the public ports of m as port requests.
+func manifestPorts(m *manifest.Manifest) []ports.Request {
+
+	var reqs []ports.Request
+	for _, p := range m.Run.Ports {
+		if !p.Public {
+			continue
+		}
+		reqs = append(reqs, ports.Request{
+			Port:          p.Name,
+			ContainerPort: p.ContainerPort,
+			Protocol:      p.Protocol,
+			HostPort:      p.HostPort,
+		})
+	}
+
+	return reqs
+}
+
+// unpublishedPorts returns the public ports of m, if any, that none of the
+// compose requests already publish.
+func unpublishedPorts(m *manifest.Manifest, compose []ports.Request) []ports.Request {
+
+	if m == nil {
+		return nil
+	}
+
+	var reqs []ports.Request
+	for _, req := range manifestPorts(m) {
+		published := slices.ContainsFunc(compose, func(c ports.Request) bool {
+			return c.ContainerPort == req.ContainerPort && (c.Protocol == req.Protocol || req.Protocol == "" && c.Protocol == "tcp")
+		})
+		if !published {
+			reqs = append(reqs, req)
+		}
+	}
+
+	return reqs
+}
+
+// hostPorts maps manifest port names to the host ports they were given.
+func hostPorts(assigned []ports.Assignment) map[string]int {
+
+	byName := map[string]int{}
+	for _, a := range assigned {
+		byName[a.Port] = a.HostPort
+	}
+
+	return byName
+}
+
+// composePorts returns the host ports published by the compose project
+// that cmd describes. cmd runs "compose config --format json".
+func composePorts(cmd *exec.Cmd) ([]ports.Request, error) {
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("compose config: %w", err)
+	}
+
+	var cfg struct {
+		Services map[string]struct {
+			Ports []struct {
+				Target    int    `json:"target"`
+				Published any    `json:"published"`
+				Protocol  string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		return nil, fmt.Errorf("compose config: %w", err)
+	}
+
+	var reqs []ports.Request
+	for name, svc := range cfg.Services {
+		for _, p := range svc.Ports {
+			// Unpublished ports get an ephemeral host port from Docker, and
+			// ranges are left to compose.
+			published, err := strconv.Atoi(fmt.Sprint(p.Published))
+			if p.Published == nil || err != nil || published == 0 {
+				continue
+			}
+			reqs = append(reqs, ports.Request{
+				Port:          fmt.Sprintf("%s:%d", name, p.Target),
+				ContainerPort: p.Target,
+				Protocol:      p.Protocol,
+				HostPort:      published,
+			})
+		}
+	}
+	slices.SortFunc(reqs, func(a, b ports.Request) int { return strings.Compare(a.Port, b.Port) })
+
+	return reqs, nil
+}
+
+// externalPorts lists the host ports published by running containers that
+// do not belong to owner, keyed "port/protocol". own names the owner's
+// containers, which are also recognised by their Lighthouse labels.
+func (b *Builder) externalPorts(owner string, own []string) (map[string]string, error) {
+
+	list, err := b.Docker.ContainerList(b.Ctx, container.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+
+	held := map[string]string{}
+	for _, c := range list {
+		name := ""
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if c.Labels[LabelRepo] == owner || c.Labels[LabelService] == owner ||
+			slices.Contains(own, name) || slices.Contains(own, strings.TrimSuffix(name, "-previous")) {
+			continue
+		}
+
+		for _, p := range c.Ports {
+			if p.PublicPort == 0 {
+				continue
+			}
+			held[fmt.Sprintf("%d/%s", p.PublicPort, p.Type)] = "container " + name
+		}
+	}
+
+	return held, nil
+}
+
+// claimPorts assigns the host ports owner asks for, refusing the deploy
+// when any of them is taken.
+func (b *Builder) claimPorts(owner string, reqs []ports.Request, own []string, log *buildLog) ([]ports.Assignment, error) {
+
+	if len(reqs) == 0 {
+		b.Ports.Release(owner)
+		return nil, nil
+	}
+
+	external, err := b.externalPorts(owner, own)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned, err := b.Ports.Claim(owner, reqs, external)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assigned {
+		log.Printf("Port %s: host %d -> container %d/%s", a.Port, a.HostPort, a.ContainerPort, a.Protocol)
+	}
+
+	return assigned, nil
+}
+
+// planPorts reports the host ports owner would get and any conflicts,
+// without claiming them.
+func (b *Builder) planPorts(owner string, reqs []ports.Request, own []string) ([]ports.Assignment, []string, error) {
+
+	if len(reqs) == 0 {
+		return nil, nil, nil
+	}
+
+	external, err := b.externalPorts(owner, own)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	assigned, conflicts := b.Ports.Plan(owner, reqs, external)
+
+	var findings []string
+	for _, c := range conflicts {
+		findings = append(findings, c.String())
+	}
+
+	return assigned, findings, nil
+}
@@ -0,0 +1,121 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// labelComposeProject is set by compose on every container it creates.
+const labelComposeProject = "com.docker.compose.project"
+
+// project is an unpacked repo deployed with compose.
+type project struct {
+	// name is the compose project, named after the repo's container so
+	// that monorepo services in directories of the same name stay apart.
+	name string
+	// dir holds the compose file and manifest: the top of the archive, or
+	// the directory of a monorepo service.
+	dir string
+}
+
+// newProject returns the project repo is deployed as.
+func (b *Builder) newProject(repo models.WatchedRepo) project {
+
+	name := strings.ToLower(repo.ContainerName)
+
+	return project{
+		name: name,
+		dir:  filepath.Join(b.archiveDir(name), filepath.FromSlash(repo.Dir)),
+	}
+}
+
+var legacyNameRx = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// legacyName is the name compose gave p before Lighthouse named its
+// projects: its directory name, normalised the way compose does.
+func (p project) legacyName() string {
+
+	name := legacyNameRx.ReplaceAllString(strings.ToLower(filepath.Base(p.dir)), "")
+	return strings.TrimLeft(name, "_-")
+}
+
+// removeLegacyContainers removes the containers repo still has in the
+// project compose named after p's directory, which would otherwise keep
+// running beside the new ones or hold their container names. Containers of
+// other repos that shared the directory name are left alone.
+func (b *Builder) removeLegacyContainers(p project, repo string, log *buildLog) error {
+
+	legacy := p.legacyName()
+	if legacy == p.name {
+		return nil
+	}
+
+	list, err := b.Docker.ContainerList(b.Ctx, container.ListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", labelComposeProject+"="+legacy),
+			filters.Arg("label", LabelRepo+"="+repo),
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("list containers of compose project %s: %w", legacy, err)
+	}
+
+	for _, c := range list {
+		log.Printf("Removing %s from compose project %s, it now runs in %s", strings.TrimPrefix(c.Names[0], "/"), legacy, p.name)
+		if err := b.Docker.ContainerRemove(b.Ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("remove %s: %w", c.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// legacyVolumes maps the named volumes of p's compose file that already
+// exist under its legacy project name to those names, so the data in them
+// stays in use. Volumes given a name of their own are left out.
+func (b *Builder) legacyVolumes(p project, env []string) (map[string]string, error) {
+
+	legacy := p.legacyName()
+	if legacy == p.name {
+		return nil, nil
+	}
+
+	var out bytes.Buffer
+	cmd := ownComposeCommand(p, env, "config", "--format", "json")
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("compose config: %w", err)
+	}
+
+	var cfg struct {
+		Volumes map[string]struct {
+			Name     string `json:"name"`
+			External bool   `json:"external"`
+		} `json:"volumes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		return nil, fmt.Errorf("parse compose config: %w", err)
+	}
+
+	pinned := map[string]string{}
+	for key, v := range cfg.Volumes {
+		old := legacy + "_" + key
+		if v.External || (v.Name != p.name+"_"+key && v.Name != old) {
+			continue
+		}
+		if _, err := b.Docker.VolumeInspect(b.Ctx, old); err == nil {
+			pinned[key] = old
+		}
+	}
+
+	return pinned, nil
+}
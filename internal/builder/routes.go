@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/LSariol/LightHouse/internal/proxy"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Labels the proxy routes a container by. They travel with the container,
+// so a rolled back container brings its own routes back with it.
+const (
+	LabelRoutes    = "lighthouse.routes"
+	LabelRoutePort = "lighthouse.routes.port"
+)
+
+// routeLabels returns the labels that route the manifest's routes to its
+// http port, or nil when it has none.
+func routeLabels(m *manifest.Manifest) map[string]string {
+
+	if m == nil || len(m.Deploy.Routes) == 0 {
+		return nil
+	}
+	port, ok := m.HTTPPort()
+	if !ok {
+		return nil
+	}
+
+	routes := make([]string, len(m.Deploy.Routes))
+	for i, r := range m.Deploy.Routes {
+		routes[i] = strings.ToLower(r.Host) + r.Path
+	}
+
+	return map[string]string{
+		LabelRoutes:    strings.Join(routes, ","),
+		LabelRoutePort: strconv.Itoa(port.ContainerPort),
+	}
+}
+
+// SyncRoutes rebuilds the proxy's routing table from the running containers
+// and swaps it in at once. Containers still starting or unhealthy by their
+// own healthcheck get no traffic. It does nothing without a proxy.
+func (b *Builder) SyncRoutes() error {
+
+	if b.Proxy == nil {
+		return nil
+	}
+
+	list, err := b.Docker.ContainerList(b.Ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelRoutes), filters.Arg("status", "running")),
+	})
+	if err != nil {
+		return fmt.Errorf("list routed containers: %w", err)
+	}
+
+	network := b.Config().Proxy.Network
+	var routes []proxy.Route
+	for _, c := range list {
+		name := ""
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if strings.Contains(c.Status, "health: starting") || strings.Contains(c.Status, "(unhealthy)") {
+			continue
+		}
+
+		owner := c.Labels[LabelRepo]
+		if owner == "" {
+			owner = c.Labels[LabelService]
+		}
+
+		var ip string
+		if c.NetworkSettings != nil {
+			if ep, ok := c.NetworkSettings.Networks[network]; ok {
+				ip = ep.IPAddress
+			}
+		}
+		if ip == "" {
+			slog.Warn("routed container is not on the proxy network", "container", name, "network", network)
+			continue
+		}
+
+		for _, s := range strings.Split(c.Labels[LabelRoutes], ",") {
+			r, err := proxy.ParseRoute(s)
+			if err != nil {
+				slog.Warn("ignoring route", "container", name, "err", err)
+				continue
+			}
+			r.Owner = owner
+			r.Container = name
+			r.Target = net.JoinHostPort(ip, c.Labels[LabelRoutePort])
+			routes = append(routes, r)
+		}
+	}
+
+	// Owners go in name order so the same one keeps a contested route
+	// whichever order Docker lists containers in.
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Owner < routes[j].Owner })
+	for _, conflict := range b.Proxy.Replace(routes) {
+		slog.Warn("route conflict", "err", conflict)
+	}
+
+	return nil
+}
+
+// syncRoutes points the proxy at whatever a deploy left running.
+func (b *Builder) syncRoutes(log *buildLog) {
+
+	if err := b.SyncRoutes(); err != nil {
+		log.Printf("Failed to update routes: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/selfupdate"
+)
+
+// How long a freshly deployed daemon has to answer its health check.
+const selfUpdateDeadline = 2 * time.Minute
+
+// SelfName is the container name Lighthouse itself runs under.
+func (b *Builder) SelfName() string {
+	return b.Config().Self.ContainerName
+}
+
+func (b *Builder) isSelf(repo models.WatchedRepo) bool {
+	return strings.EqualFold(repo.ContainerName, b.SelfName())
+}
+
+// selfUpdate builds the new Lighthouse image and hands the container swap
+// to a helper, since stopping this container would stop the build with it.
+// The commit of repo is recorded as deployed first, as this daemon does
+// not outlive the swap.
+func (b *Builder) selfUpdate(repo models.WatchedRepo, p project, log *buildLog) error {
+	env, err := b.composeEnv(p, log)
+	if err != nil {
+		return err
+	}
+
+	out := log.Writer()
+	cmd := composeCommand(p, env, "build")
+	cmd.Stdout, cmd.Stderr = out, out
+	err = cmd.Run()
+	out.Flush()
+	if err != nil {
+		return fmt.Errorf("compose build: %w", err)
+	}
+
+	image, err := b.composeImage(p, env)
+	if err != nil {
+		return err
+	}
+
+	if b.BeforeSelfUpdate != nil {
+		if err := b.BeforeSelfUpdate(repo); err != nil {
+			return fmt.Errorf("record deploy: %w", err)
+		}
+	}
+
+	opts := selfupdate.Options{
+		Container: b.SelfName(),
+		Image:     image,
+		HealthURL: b.selfHealthURL(),
+		Deadline:  selfUpdateDeadline,
+	}
+
+	log.Printf("Handing over to %s to swap %s onto %s", selfupdate.UpdaterName, opts.Container, image)
+	if err := selfupdate.Launch(b.Ctx, b.Docker, opts); err != nil {
+		return fmt.Errorf("launch updater: %w", err)
+	}
+
+	return nil
+}
+
+// composeImage returns the image p builds for Lighthouse itself, the
+// service whose container is named SelfName.
+func (b *Builder) composeImage(p project, env []string) (string, error) {
+
+	var out bytes.Buffer
+	cmd := composeCommand(p, env, "config", "--format", "json")
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("compose config: %w", err)
+	}
+
+	var cfg struct {
+		Services map[string]struct {
+			ContainerName string `json:"container_name"`
+			Image         string `json:"image"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		return "", fmt.Errorf("compose config: %w", err)
+	}
+
+	for name, svc := range cfg.Services {
+		if !strings.EqualFold(svc.ContainerName, b.SelfName()) {
+			continue
+		}
+		if svc.Image != "" {
+			return svc.Image, nil
+		}
+		// Compose names the images it builds after the project and service.
+		return p.name + "-" + name, nil
+	}
+
+	return "", fmt.Errorf("compose file has no service with container_name %s", b.SelfName())
+}
+
+func (b *Builder) selfHealthURL() string {
+
+	if url := b.Config().Self.HealthURL; url != "" {
+		return url
+	}
+
+	port := "2000"
+	if _, p, err := net.SplitHostPort(b.Config().API.ListenAddress); err == nil && p != "" {
+		port = p
+	}
+
+	return fmt.Sprintf("http://%s:%s/healthz", b.SelfName(), port)
+}
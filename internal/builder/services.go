@@ -0,0 +1,708 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/LSariol/LightHouse/internal/metrics"
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/registry"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	dockerregistry "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+)
+
+// Container health as reported by ContainerHealth.
+const (
+	HealthMissing   = "missing"
+	HealthStopped   = "stopped"
+	HealthRunning   = "running"
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// DeployService pulls the image of svc and (re)creates its container.
+// It returns the ID its log lines were published under.
+func (b *Builder) DeployService(svc models.ManagedService) (string, error) {
+
+	deployID := newBuildID(svc.ContainerName)
+	log := newBuildLog(b.Events, deployID, svc.Name, "")
+
+	log.logger.Info("deploy started", "container", svc.ContainerName, "kind", svc.Kind())
+	log.publish(events.Event{Kind: events.KindBuildStarted})
+
+	var err error
+	switch svc.Kind() {
+	case models.ServiceKindCompose:
+		err = b.deployCompose(svc, log)
+	case models.ServiceKindManifest:
+		err = b.deployManifest(svc, log)
+	default:
+		err = b.deployImage(svc, log)
+	}
+	log.endPhase()
+	b.syncRoutes(log)
+
+	status := "success"
+	finished := events.Event{Kind: events.KindBuildFinished, Status: status}
+	if err != nil {
+		status = "failed"
+		finished.Status = status
+		finished.Message = err.Error()
+		log.Printf("deploy failed: %v", err)
+		log.logger.Error("deploy failed", "phase", log.phase, "err", err)
+	} else {
+		log.logger.Info("deploy succeeded")
+	}
+	metrics.Builds.WithLabelValues(svc.Name, status).Inc()
+	log.publish(finished)
+
+	return deployID, err
+}
+
+// ImageCheck is the outcome of looking for a newer image of a service.
+type ImageCheck struct {
+	// Tag is the tag the service should run, after applying its tag policy.
+	Tag string
+
+	// Digest is what the registry serves for Tag. Compose services, which
+	// are checked by pulling, report their image IDs instead.
+	Digest string
+
+	Changed bool
+}
+
+// CheckServiceImage asks the registry which digest the image of svc
+// resolves to and whether its container already runs it.
+func (b *Builder) CheckServiceImage(svc models.ManagedService) (ImageCheck, error) {
+
+	if svc.Kind() == models.ServiceKindCompose {
+		ids, changed, err := b.checkComposeImages(svc)
+		return ImageCheck{Digest: ids, Changed: changed}, err
+	}
+
+	ref, err := b.serviceRef(svc)
+	if err != nil {
+		return ImageCheck{}, err
+	}
+
+	policy, err := registry.ParsePolicy(svc.TagPolicy)
+	if err != nil {
+		return ImageCheck{}, err
+	}
+
+	creds, err := b.registryCreds(svc)
+	if err != nil {
+		return ImageCheck{}, err
+	}
+
+	if !policy.Follows() {
+		tags, err := b.Registry.Tags(b.Ctx, ref, creds)
+		if err != nil {
+			return ImageCheck{}, err
+		}
+		tag, ok := policy.Select(tags)
+		if !ok {
+			return ImageCheck{}, fmt.Errorf("%s: no tag matches policy %s", ref.Repository, policy)
+		}
+		ref = ref.WithTag(tag)
+	}
+
+	digest, err := b.Registry.Digest(b.Ctx, ref, creds)
+	if err != nil {
+		return ImageCheck{}, err
+	}
+
+	check := ImageCheck{Tag: ref.Tag, Digest: digest}
+	if failed := svc.Stats.Updates.FailedDigest; failed != nil && *failed == digest {
+		return check, nil
+	}
+
+	running, err := b.runsDigest(svc.ContainerName, digest)
+	if err != nil {
+		return ImageCheck{}, err
+	}
+	check.Changed = !running
+
+	return check, nil
+}
+
+// StartService starts the container of svc, deploying it first if it
+// does not exist.
+func (b *Builder) StartService(svc models.ManagedService) error {
+
+	if svc.Kind() == models.ServiceKindCompose {
+		return runCompose(svc.ComposePath, nil, "up", "-d")
+	}
+
+	err := b.StartContainer(svc.ContainerName)
+	if errdefs.IsNotFound(err) {
+		_, err = b.DeployService(svc)
+	}
+
+	return err
+}
+
+func (b *Builder) StopService(svc models.ManagedService) error {
+
+	if svc.Kind() == models.ServiceKindCompose {
+		return runCompose(svc.ComposePath, nil, "stop")
+	}
+
+	return b.StopContainer(svc.ContainerName)
+}
+
+func (b *Builder) RestartService(svc models.ManagedService) error {
+
+	if svc.Kind() == models.ServiceKindCompose {
+		return runCompose(svc.ComposePath, nil, "restart")
+	}
+
+	return b.RestartContainer(svc.ContainerName)
+}
+
+// ServiceStatus reports the container state of svc. A compose service
+// counts as running while any of its containers run.
+func (b *Builder) ServiceStatus(svc models.ManagedService) (ContainerStatus, error) {
+
+	if svc.Kind() != models.ServiceKindCompose {
+		return b.ContainerStatus(svc.ContainerName)
+	}
+
+	var out bytes.Buffer
+	if err := runCompose(svc.ComposePath, &out, "ps", "-q", "--status", "running"); err != nil {
+		return ContainerStatus{}, err
+	}
+	running := strings.TrimSpace(out.String()) != ""
+
+	return ContainerStatus{Exists: true, Running: running}, nil
+}
+
+// ExpectedImage is the image reference svc should be running.
+func (b *Builder) ExpectedImage(svc models.ManagedService) (string, error) {
+
+	ref, err := b.serviceRef(svc)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.String(), nil
+}
+
+// ContainerHealth summarises the state of a container in one word.
+func (b *Builder) ContainerHealth(name string) (string, error) {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return HealthMissing, nil
+		}
+		return "", fmt.Errorf("inspect %q: %w", name, err)
+	}
+
+	if info.State == nil || !info.State.Running {
+		return HealthStopped, nil
+	}
+	if info.State.Health == nil {
+		return HealthRunning, nil
+	}
+
+	return info.State.Health.Status, nil
+}
+
+func (b *Builder) deployImage(svc models.ManagedService, log *buildLog) error {
+
+	ref, err := b.pullService(svc, log)
+	if err != nil {
+		return err
+	}
+
+	log.Phase("create")
+	limits, err := b.serviceLimits(manifest.Resources{}, "", log)
+	if err != nil {
+		return err
+	}
+
+	cfg := &container.Config{
+		Image: ref,
+		Labels: map[string]string{
+			LabelManagedBy: managedByValue,
+			LabelService:   svc.Name,
+			LabelImage:     ref,
+		},
+	}
+	hostCfg := &container.HostConfig{
+		Resources:     limits.resources(),
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyMode(limits.Restart)},
+	}
+
+	return b.replaceContainer(svc.ContainerName, cfg, hostCfg, nil, b.gateFor(nil), log)
+}
+
+func (b *Builder) deployManifest(svc models.ManagedService, log *buildLog) error {
+
+	m, err := manifest.Load(svc.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	ref, err := b.pullService(svc, log)
+	if err != nil {
+		return err
+	}
+	m.Image.Name = ref
+
+	log.Phase("create")
+	limits, err := b.serviceLimits(m.Run.Resources, m.Deploy.Restart, log)
+	if err != nil {
+		return err
+	}
+
+	assigned, err := b.claimPorts(svc.Name, manifestPorts(m), []string{svc.ContainerName}, log)
+	if err != nil {
+		return err
+	}
+
+	cfg, hostCfg, netCfg, err := b.manifestContainer(svc.ContainerName, m, limits, hostPorts(assigned))
+	if err != nil {
+		return err
+	}
+
+	if err := b.prepareServiceVolumes(svc.ContainerName, m, ref, log); err != nil {
+		return fmt.Errorf("volumes: %w", err)
+	}
+	cfg.Labels[LabelService] = svc.Name
+	cfg.Labels[LabelImage] = ref
+
+	return b.replaceContainer(svc.ContainerName, cfg, hostCfg, netCfg, b.gateFor(m), log)
+}
+
+// pullService pulls the image svc should run and returns its reference.
+func (b *Builder) pullService(svc models.ManagedService, log *buildLog) (string, error) {
+
+	ref, err := b.serviceRef(svc)
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := b.registryCreds(svc)
+	if err != nil {
+		return "", err
+	}
+
+	auth := ""
+	if creds.Username != "" {
+		auth, err = dockerregistry.EncodeAuthConfig(dockerregistry.AuthConfig{
+			Username:      creds.Username,
+			Password:      creds.Password,
+			ServerAddress: ref.Registry,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	log.Phase("pull")
+	if err := b.pullImage(ref.String(), auth, log); err != nil {
+		return "", err
+	}
+
+	return ref.String(), nil
+}
+
+func (b *Builder) deployCompose(svc models.ManagedService, log *buildLog) error {
+
+	out := log.Writer()
+	defer out.Flush()
+
+	log.Phase("pull")
+	if err := runCompose(svc.ComposePath, out, "pull"); err != nil {
+		return err
+	}
+
+	reqs, err := composePorts(serviceCompose(svc.ComposePath, "config", "--format", "json"))
+	if err != nil {
+		return err
+	}
+	own, err := b.ServiceContainers(svc)
+	if err != nil {
+		return err
+	}
+	if _, err := b.claimPorts(svc.Name, reqs, own, log); err != nil {
+		return err
+	}
+
+	log.Phase("compose")
+	return runCompose(svc.ComposePath, out, "up", "-d", "--remove-orphans")
+}
+
+// serviceLimits resolves the limits for a managed service and logs how they
+// were arrived at. Services restart unless stopped by default.
+func (b *Builder) serviceLimits(res manifest.Resources, restart string, log *buildLog) (Limits, error) {
+
+	policy, err := b.limitPolicy()
+	if err != nil {
+		return Limits{}, err
+	}
+
+	limits, findings, err := policy.resolve(res, restart)
+	if err != nil {
+		return Limits{}, err
+	}
+	if limits.Restart == "" {
+		limits.Restart = string(container.RestartPolicyUnlessStopped)
+	}
+
+	for _, f := range findings {
+		log.Printf("Limits: %s", f)
+	}
+	log.Printf("Applying %s", limits)
+
+	return limits, nil
+}
+
+// manifestContainer translates a manifest into a container definition
+// running with limits, publishing its public ports on the host ports given
+// by name in published.
+func (b *Builder) manifestContainer(name string, m *manifest.Manifest, limits Limits, published map[string]int) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+
+	env := append([]string(nil), m.Run.Env...)
+	for _, key := range m.Run.EnvFromCove {
+		start := time.Now()
+		val, err := b.CC.GetSecret(key)
+		metrics.ObserveCoveLookup(start, err)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("missing value for %q: %w", key, err)
+		}
+		logging.AddSecret(val)
+		env = append(env, key+"="+val)
+	}
+
+	labels := map[string]string{}
+	for k, v := range m.Deploy.Labels {
+		labels[k] = v
+	}
+	for k, v := range routeLabels(m) {
+		labels[k] = v
+	}
+	labels[LabelManagedBy] = managedByValue
+
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, p := range m.Run.Ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		port := nat.Port(strconv.Itoa(p.ContainerPort) + "/" + proto)
+		exposed[port] = struct{}{}
+		if hostPort, ok := published[p.Name]; ok && p.Public {
+			bindings[port] = []nat.PortBinding{{HostPort: strconv.Itoa(hostPort)}}
+		}
+	}
+
+	var mounts []mount.Mount
+	for _, v := range m.Run.Volumes {
+		switch v.Type {
+		case "tmpfs":
+			mounts = append(mounts, mount.Mount{Type: mount.TypeTmpfs, Target: v.MountPath})
+		case "bind":
+			return nil, nil, nil, fmt.Errorf("volume %q: bind volumes are not supported for managed services", v.Name)
+		default:
+			mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: volumeName(name, v.Name), Target: v.MountPath})
+		}
+	}
+
+	cfg := &container.Config{
+		Image:        m.Image.Name,
+		Env:          env,
+		Labels:       labels,
+		ExposedPorts: exposed,
+	}
+	if len(m.Run.Command) > 0 {
+		cfg.Cmd = m.Run.Command
+	}
+
+	hostCfg := &container.HostConfig{
+		PortBindings:  bindings,
+		Mounts:        mounts,
+		Resources:     limits.resources(),
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyMode(limits.Restart)},
+	}
+
+	endpoints := map[string]*network.EndpointSettings{}
+	for _, n := range m.Deploy.Networks {
+		endpoints[n] = &network.EndpointSettings{}
+	}
+	if b.Proxy != nil && len(m.Deploy.Routes) > 0 {
+		endpoints[b.Config().Proxy.Network] = &network.EndpointSettings{}
+	}
+
+	return cfg, hostCfg, &network.NetworkingConfig{EndpointsConfig: endpoints}, nil
+}
+
+// replaceContainer starts a new container called name in place of the
+// current one. The old container is kept aside until the new one passes
+// gate, and is put back if it does not.
+func (b *Builder) replaceContainer(name string, cfg *container.Config, hostCfg *container.HostConfig, netCfg *network.NetworkingConfig, gate healthGate, log *buildLog) error {
+
+	previous := name + "-previous"
+
+	err := b.Docker.ContainerRemove(b.Ctx, previous, container.RemoveOptions{Force: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("remove %s: %w", previous, err)
+	}
+
+	kept := true
+	err = b.Docker.ContainerRename(b.Ctx, name, previous)
+	if errdefs.IsNotFound(err) {
+		kept = false
+	} else if err != nil {
+		return fmt.Errorf("rename %s: %w", name, err)
+	}
+	if kept {
+		if err := b.Docker.ContainerStop(b.Ctx, previous, container.StopOptions{}); err != nil {
+			return b.restoreContainer(name, previous, fmt.Errorf("stop %s: %w", previous, err), log)
+		}
+	}
+
+	created, err := b.Docker.ContainerCreate(b.Ctx, cfg, hostCfg, netCfg, nil, name)
+	if err != nil {
+		return b.restoreContainer(name, previous, fmt.Errorf("create %s: %w", name, err), log)
+	}
+	log.Printf("Created %s (%s)", name, created.ID[:12])
+
+	log.Phase("start")
+	if err := b.Docker.ContainerStart(b.Ctx, created.ID, container.StartOptions{}); err != nil {
+		return b.restoreContainer(name, previous, fmt.Errorf("start %s: %w", name, err), log)
+	}
+
+	log.Phase("health")
+	if err := b.waitHealthy(name, gate, log); err != nil {
+		log.publish(events.Event{Kind: events.KindHealthCheckFailed, Message: err.Error()})
+		if !kept {
+			return fmt.Errorf("health check: %w", err)
+		}
+		return b.restoreContainer(name, previous, fmt.Errorf("health check: %w", err), log)
+	}
+
+	if kept {
+		err = b.Docker.ContainerRemove(b.Ctx, previous, container.RemoveOptions{})
+		if err != nil {
+			log.Printf("Failed to remove %s: %v", previous, err)
+		}
+	}
+
+	return nil
+}
+
+// restoreContainer swaps previous back in as name after cause broke a
+// deploy. It returns cause, annotated with how the rollback went.
+func (b *Builder) restoreContainer(name string, previous string, cause error, log *buildLog) error {
+
+	if _, err := b.Docker.ContainerInspect(b.Ctx, previous); errdefs.IsNotFound(err) {
+		return cause
+	}
+
+	log.Phase("rollback")
+	log.Printf("Restoring previous container of %s: %v", name, cause)
+
+	err := b.Docker.ContainerRemove(b.Ctx, name, container.RemoveOptions{Force: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("%w, rollback failed: remove %s: %v", cause, name, err)
+	}
+	if err := b.Docker.ContainerRename(b.Ctx, previous, name); err != nil {
+		return fmt.Errorf("%w, rollback failed: rename %s: %v", cause, previous, err)
+	}
+	if err := b.Docker.ContainerStart(b.Ctx, name, container.StartOptions{}); err != nil {
+		return fmt.Errorf("%w, rollback failed: start %s: %v", cause, name, err)
+	}
+
+	log.publish(events.Event{Kind: events.KindRollback, Message: "restored previous container: " + cause.Error()})
+	return fmt.Errorf("%w, rolled back to previous container", cause)
+}
+
+// pullImage pulls ref, publishing the notable progress lines to log.
+func (b *Builder) pullImage(ref string, auth string, log *buildLog) error {
+
+	rc, err := b.Docker.ImagePull(b.Ctx, ref, image.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", ref, err)
+	}
+	defer rc.Close()
+
+	dec := json.NewDecoder(rc)
+	for {
+		var msg struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("pull %s: %w", ref, err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("pull %s: %s", ref, msg.Error)
+		}
+		if log != nil && !strings.HasPrefix(msg.Status, "Downloading") && !strings.HasPrefix(msg.Status, "Extracting") && msg.Status != "Waiting" {
+			log.Printf("%s %s", msg.ID, msg.Status)
+		}
+	}
+}
+
+// checkComposeImages pulls a compose service's images and reports whether
+// any of its running containers use an older image.
+func (b *Builder) checkComposeImages(svc models.ManagedService) (string, bool, error) {
+
+	if err := runCompose(svc.ComposePath, nil, "pull", "--quiet"); err != nil {
+		return "", false, err
+	}
+
+	var out bytes.Buffer
+	if err := runCompose(svc.ComposePath, &out, "images", "--format", "json"); err != nil {
+		return "", false, err
+	}
+
+	var images []struct {
+		ContainerName string
+		Repository    string
+		Tag           string
+		ID            string
+	}
+	if err := json.Unmarshal(out.Bytes(), &images); err != nil {
+		return "", false, fmt.Errorf("parse compose images: %w", err)
+	}
+
+	var ids []string
+	changed := false
+	for _, img := range images {
+		latest, _, err := b.Docker.ImageInspectWithRaw(b.Ctx, img.Repository+":"+img.Tag)
+		if err != nil {
+			return "", false, fmt.Errorf("inspect %s:%s: %w", img.Repository, img.Tag, err)
+		}
+		ids = append(ids, latest.ID)
+		if !strings.Contains(latest.ID, img.ID) {
+			changed = true
+		}
+	}
+
+	return strings.Join(ids, ","), changed, nil
+}
+
+// serviceRef returns the image reference svc runs, with the tag its tag
+// policy last settled on.
+func (b *Builder) serviceRef(svc models.ManagedService) (registry.Reference, error) {
+
+	name := svc.Image
+	if svc.Kind() == models.ServiceKindManifest {
+		m, err := manifest.Load(svc.ManifestPath)
+		if err != nil {
+			return registry.Reference{}, err
+		}
+		name = m.Image.Name
+	}
+
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return registry.Reference{}, err
+	}
+	if tag := svc.Stats.Updates.CurrentTag; tag != "" {
+		ref = ref.WithTag(tag)
+	}
+
+	return ref, nil
+}
+
+// registryCreds fetches the registry login of svc from Cove, if it has one.
+func (b *Builder) registryCreds(svc models.ManagedService) (registry.Credentials, error) {
+
+	if svc.RegistryAuthFromCove == "" {
+		return registry.Credentials{}, nil
+	}
+
+	start := time.Now()
+	val, err := b.CC.GetSecret(svc.RegistryAuthFromCove)
+	metrics.ObserveCoveLookup(start, err)
+	if err != nil {
+		return registry.Credentials{}, fmt.Errorf("fetch %s from Cove: %w", svc.RegistryAuthFromCove, err)
+	}
+
+	user, pass, ok := strings.Cut(val, ":")
+	if !ok {
+		return registry.Credentials{}, fmt.Errorf("%s must hold username:password", svc.RegistryAuthFromCove)
+	}
+	logging.AddSecret(pass)
+
+	return registry.Credentials{Username: user, Password: pass}, nil
+}
+
+// runsDigest reports whether container name runs an image pulled at digest.
+func (b *Builder) runsDigest(name string, digest string) (bool, error) {
+
+	info, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("inspect %s: %w", name, err)
+	}
+
+	img, _, err := b.Docker.ImageInspectWithRaw(b.Ctx, info.Image)
+	if err != nil {
+		return false, fmt.Errorf("inspect image of %s: %w", name, err)
+	}
+
+	for _, rd := range img.RepoDigests {
+		if strings.HasSuffix(rd, "@"+digest) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// serviceCompose builds a docker compose command for the compose file of a
+// managed service.
+func serviceCompose(composePath string, args ...string) *exec.Cmd {
+
+	cmd := exec.Command("docker", append([]string{"compose", "-f", filepath.Base(composePath)}, args...)...)
+	cmd.Dir = filepath.Dir(composePath)
+
+	return cmd
+}
+
+func runCompose(composePath string, out io.Writer, args ...string) error {
+
+	cmd := serviceCompose(composePath, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if out != nil {
+		cmd.Stderr = out
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker compose %s: %w %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
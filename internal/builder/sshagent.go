@@ -0,0 +1,90 @@
+package builder
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgent serves one private key over a unix socket for the length of a
+// build, so BuildKit can forward it to RUN --mount=type=ssh steps. The key
+// is only held in memory and the socket sits in a directory only Lighthouse
+// can enter.
+type sshAgent struct {
+	dir         string
+	listener    net.Listener
+	keyring     agent.Agent
+	fingerprint string
+}
+
+func startSSHAgent(pemKey []byte) (*sshAgent, error) {
+
+	key, err := ssh.ParseRawPrivateKey(pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "lighthouse build"}); err != nil {
+		return nil, fmt.Errorf("load private key: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "lighthouse-ssh-")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("listen for ssh agent: %w", err)
+	}
+
+	a := &sshAgent{
+		dir:         dir,
+		listener:    listener,
+		keyring:     keyring,
+		fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+	go a.serve()
+
+	return a, nil
+}
+
+func (a *sshAgent) serve() {
+
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a.keyring, conn)
+		}()
+	}
+}
+
+// Socket is the path to hand to clients as SSH_AUTH_SOCK.
+func (a *sshAgent) Socket() string {
+	return a.listener.Addr().String()
+}
+
+// Fingerprint identifies the key being served without revealing it.
+func (a *sshAgent) Fingerprint() string {
+	return a.fingerprint
+}
+
+// Close stops serving and forgets the key.
+func (a *sshAgent) Close() {
+	a.listener.Close()
+	a.keyring.RemoveAll()
+	os.RemoveAll(a.dir)
+}
@@ -0,0 +1,314 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+)
+
+// unit is one node of the startup graph: Cove, a watched repo or a managed
+// service.
+type unit struct {
+	name      string
+	container string
+	deps      []string
+	gate      healthGate
+
+	start func(ctx context.Context) error
+	stop  func(ctx context.Context) error
+}
+
+// CoveName is the container name Cove runs under on this host.
+func (b *Builder) CoveName() string {
+	return b.Config().Cove.ContainerName
+}
+
+// StartCove starts the Cove container if it is stopped and waits for it to
+// become healthy. A host without a Cove container, which uses a remote
+// Cove, is left alone.
+func (b *Builder) StartCove() error {
+
+	u, ok, err := b.coveUnit()
+	if err != nil || !ok {
+		return err
+	}
+
+	return b.startUnit(u)
+}
+
+// StartAllContainers starts Cove, then every watched repo and managed
+// service meant to be running once the units they depend on are healthy. A
+// unit whose dependency failed is skipped, and every failure is returned
+// together.
+func (b *Builder) StartAllContainers() error {
+
+	units, err := b.units()
+	if err != nil {
+		return err
+	}
+
+	ordered, errs := order(units)
+	failed := map[string]error{}
+
+	for _, u := range ordered {
+		if dep := slices.IndexFunc(u.deps, func(d string) bool { return failed[d] != nil }); dep >= 0 {
+			err := fmt.Errorf("%s: skipped, dependency %s failed", u.name, u.deps[dep])
+			failed[u.name] = err
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := b.startUnit(u); err != nil {
+			err = fmt.Errorf("%s: %w", u.name, err)
+			failed[u.name] = err
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("started", "unit", u.name, "container", u.container)
+	}
+
+	return errors.Join(errs...)
+}
+
+// StopAllContainers stops every watched repo and managed service in the
+// reverse of their start order. Lighthouse itself and Cove keep running.
+func (b *Builder) StopAllContainers() error {
+
+	units, err := b.units()
+	if err != nil {
+		return err
+	}
+
+	ordered, errs := order(units)
+	slices.Reverse(ordered)
+
+	for _, u := range ordered {
+		if u.stop == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(b.Ctx, b.Config().Timeouts.Step)
+		err := u.stop(ctx)
+		cancel()
+		if err != nil && !errdefs.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", u.name, err))
+			continue
+		}
+		slog.Info("stopped", "unit", u.name, "container", u.container)
+	}
+
+	return errors.Join(errs...)
+}
+
+// startUnit starts u and waits for its health gate.
+func (b *Builder) startUnit(u unit) error {
+
+	ctx, cancel := context.WithTimeout(b.Ctx, b.Config().Timeouts.Step)
+	err := u.start(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	if u.container == "" {
+		return nil
+	}
+
+	log := newBuildLog(nil, "", u.name, "")
+	return b.waitHealthy(u.container, u.gate, log)
+}
+
+// units builds the startup graph from the watch list and managed services.
+// Every unit depends on Cove when Cove runs on this host.
+func (b *Builder) units() ([]unit, error) {
+
+	var units []unit
+
+	cove, hasCove, err := b.coveUnit()
+	if err != nil {
+		return nil, err
+	}
+	if hasCove {
+		units = append(units, cove)
+	}
+
+	withCove := func(deps []string) []string {
+		if !hasCove || slices.Contains(deps, cove.name) {
+			return deps
+		}
+		return append([]string{cove.name}, deps...)
+	}
+
+	for _, repo := range b.WatchList() {
+		name := strings.ToLower(repo.ContainerName)
+		u := unit{
+			name:      repo.DisplayName,
+			container: name,
+			deps:      withCove(repo.DependsOn),
+			gate:      b.gateFor(nil),
+			start: func(ctx context.Context) error {
+				return b.Docker.ContainerStart(ctx, name, container.StartOptions{})
+			},
+		}
+		// Lighthouse is already running and cannot stop itself, and repos
+		// meant to be stopped are left alone at boot.
+		if b.isSelf(repo) || !repo.WantsRunning() {
+			u.start = func(context.Context) error { return nil }
+			u.container = ""
+		}
+		if !b.isSelf(repo) {
+			u.stop = func(ctx context.Context) error {
+				return b.Docker.ContainerStop(ctx, name, container.StopOptions{})
+			}
+		}
+		units = append(units, u)
+	}
+
+	for _, svc := range b.Services() {
+		u := unit{
+			name:      svc.Name,
+			container: svc.ContainerName,
+			deps:      withCove(svc.DependsOn),
+			gate:      b.gateFor(nil),
+			start: func(context.Context) error {
+				return b.StartService(svc)
+			},
+			stop: func(context.Context) error {
+				return b.StopService(svc)
+			},
+		}
+
+		switch {
+		case !svc.WantsRunning():
+			u.start = func(context.Context) error { return nil }
+			u.container = ""
+		case svc.Kind() == models.ServiceKindCompose:
+			// Compose names its own containers, so there is nothing to gate on.
+			u.container = ""
+		case svc.Kind() == models.ServiceKindManifest:
+			m, err := manifest.Load(svc.ManifestPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", svc.Name, err)
+			}
+			u.gate = b.gateFor(m)
+			for _, d := range m.DependsOn {
+				if !slices.Contains(u.deps, d) {
+					u.deps = append(u.deps, d)
+				}
+			}
+		}
+
+		units = append(units, u)
+	}
+
+	// When Cove is itself a watched repo or service, that unit stands in
+	// for it and the dependencies on Cove resolve to it by container name.
+	if hasCove && slices.ContainsFunc(units[1:], func(u unit) bool { return strings.EqualFold(u.container, cove.container) }) {
+		units = units[1:]
+	}
+
+	return units, nil
+}
+
+// coveUnit returns the unit for the local Cove container, if there is one.
+func (b *Builder) coveUnit() (unit, bool, error) {
+
+	name := b.CoveName()
+
+	_, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if errdefs.IsNotFound(err) {
+		return unit{}, false, nil
+	}
+	if err != nil {
+		return unit{}, false, fmt.Errorf("inspect %s: %w", name, err)
+	}
+
+	return unit{
+		name:      name,
+		container: name,
+		gate:      b.gateFor(nil),
+		start: func(ctx context.Context) error {
+			return b.Docker.ContainerStart(ctx, name, container.StartOptions{})
+		},
+	}, true, nil
+}
+
+// order sorts units so each comes after everything it depends on, keeping
+// the original order where it is free to. Units with unknown dependencies
+// or in a cycle are left out and reported.
+func order(units []unit) ([]unit, []error) {
+
+	var errs []error
+
+	byName := map[string]int{}
+	for i, u := range units {
+		byName[strings.ToLower(u.name)] = i
+		if u.container != "" {
+			byName[strings.ToLower(u.container)] = i
+		}
+	}
+
+	// Resolve dependencies to canonical unit names.
+	valid := make([]bool, len(units))
+	for i := range units {
+		valid[i] = true
+		deps := make([]string, 0, len(units[i].deps))
+		for _, d := range units[i].deps {
+			j, ok := byName[strings.ToLower(d)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown dependency %s", units[i].name, d))
+				valid[i] = false
+				continue
+			}
+			if j == i {
+				continue
+			}
+			deps = append(deps, units[j].name)
+		}
+		units[i].deps = deps
+	}
+
+	done := map[string]bool{}
+	var ordered []unit
+
+	for progress := true; progress; {
+		progress = false
+		for i, u := range units {
+			if !valid[i] || done[u.name] {
+				continue
+			}
+			ready := true
+			for _, d := range u.deps {
+				if !done[d] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				done[u.name] = true
+				ordered = append(ordered, u)
+				progress = true
+			}
+		}
+	}
+
+	var stuck []string
+	for i, u := range units {
+		if valid[i] && !done[u.name] {
+			stuck = append(stuck, u.name)
+		}
+	}
+	if len(stuck) > 0 {
+		errs = append(errs, fmt.Errorf("dependency cycle or missing dependency between %s", strings.Join(stuck, ", ")))
+	}
+
+	return ordered, errs
+}
@@ -0,0 +1,405 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+)
+
+// LabelOwner marks the volumes Lighthouse creates with the container they
+// belong to.
+const LabelOwner = "lighthouse.owner"
+
+const (
+	// Where volumes are mounted inside the helper container.
+	snapshotMount = "/volumes"
+
+	snapshotIDFormat = "20060102-150405"
+)
+
+// Snapshot is a tar copy of the backed up volumes of a container, taken
+// before a deploy.
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Volumes []string  `json:"volumes"`
+	Size    int64     `json:"size"`
+}
+
+// volumeName is the Docker volume holding volume vol of container owner.
+func volumeName(owner string, vol string) string {
+	return owner + "_" + vol
+}
+
+// ensureVolumes creates the persistent volumes of owner that do not exist
+// yet. Existing volumes are reused as they are.
+func (b *Builder) ensureVolumes(owner string, vols []manifest.Volume, log *buildLog) error {
+
+	for _, v := range vols {
+		if !v.Persistent() {
+			continue
+		}
+
+		name := volumeName(owner, v.Name)
+		_, err := b.Docker.VolumeInspect(b.Ctx, name)
+		if err == nil {
+			continue
+		}
+		if !errdefs.IsNotFound(err) {
+			return fmt.Errorf("inspect volume %s: %w", name, err)
+		}
+
+		_, err = b.Docker.VolumeCreate(b.Ctx, volume.CreateOptions{
+			Name: name,
+			Labels: map[string]string{
+				LabelManagedBy: managedByValue,
+				LabelOwner:     owner,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("create volume %s: %w", name, err)
+		}
+		log.Printf("Created volume %s", name)
+	}
+
+	return nil
+}
+
+// backedUp returns the volumes of vols that are snapshotted before deploys.
+func backedUp(vols []manifest.Volume) []string {
+
+	var names []string
+	for _, v := range vols {
+		if v.Persistent() && v.Backup {
+			names = append(names, v.Name)
+		}
+	}
+
+	return names
+}
+
+// snapshotVolumes copies the backed up volumes of owner into a new
+// snapshot and prunes the oldest beyond the retention. Containers using the
+// volumes should be stopped first so the copy is consistent.
+func (b *Builder) snapshotVolumes(owner string, vols []manifest.Volume, log *buildLog) error {
+
+	names := backedUp(vols)
+	if len(names) == 0 {
+		return nil
+	}
+
+	id := time.Now().UTC().Format(snapshotIDFormat)
+	dir := filepath.Join(b.Config().Paths.Snapshots, owner, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create snapshot dir: %w", err)
+	}
+
+	helper, err := b.volumeHelper(owner, names, true, nil, log)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	defer b.Docker.ContainerRemove(b.Ctx, helper, container.RemoveOptions{Force: true})
+
+	for _, name := range names {
+		if err := b.copyVolume(helper, name, filepath.Join(dir, name+".tar")); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	log.Printf("Snapshot %s of %s taken", id, strings.Join(names, ", "))
+
+	return b.pruneSnapshots(owner, b.Config().Retention.Snapshots, log)
+}
+
+func (b *Builder) copyVolume(helper string, name string, path string) error {
+
+	rc, _, err := b.Docker.CopyFromContainer(b.Ctx, helper, snapshotMount+"/"+name)
+	if err != nil {
+		return fmt.Errorf("read volume %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return fmt.Errorf("write snapshot of %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// RestoreSnapshot puts the volumes of owner back the way snapshot id found
+// them. containers are stopped while it runs and the ones that were
+// running are started again.
+func (b *Builder) RestoreSnapshot(owner string, containers []string, id string) error {
+
+	snap, err := b.findSnapshot(owner, id)
+	if err != nil {
+		return err
+	}
+
+	log := newBuildLog(nil, "", owner, "")
+
+	var running []string
+	for _, c := range containers {
+		ok, err := b.IsContainerRunning(c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := b.StopContainer(c); err != nil {
+			return fmt.Errorf("stop %s: %w", c, err)
+		}
+		running = append(running, c)
+	}
+
+	err = b.restoreVolumes(owner, snap, log)
+
+	for _, c := range running {
+		if startErr := b.StartContainer(c); startErr != nil && err == nil {
+			err = fmt.Errorf("start %s: %w", c, startErr)
+		}
+	}
+
+	return err
+}
+
+func (b *Builder) restoreVolumes(owner string, snap Snapshot, log *buildLog) error {
+
+	// The helper empties the volumes before the snapshot is copied in so
+	// files created since are not left behind.
+	wipe := []string{"sh", "-c", "find " + snapshotMount + " -mindepth 2 -delete"}
+	helper, err := b.volumeHelper(owner, snap.Volumes, false, wipe, log)
+	if err != nil {
+		return err
+	}
+	defer b.Docker.ContainerRemove(b.Ctx, helper, container.RemoveOptions{Force: true})
+
+	if err := b.Docker.ContainerStart(b.Ctx, helper, container.StartOptions{}); err != nil {
+		return fmt.Errorf("start volume helper: %w", err)
+	}
+	waitCh, errCh := b.Docker.ContainerWait(b.Ctx, helper, container.WaitConditionNotRunning)
+	select {
+	case res := <-waitCh:
+		if res.StatusCode != 0 {
+			return fmt.Errorf("clear volumes: exit code %d", res.StatusCode)
+		}
+	case err := <-errCh:
+		return fmt.Errorf("clear volumes: %w", err)
+	}
+
+	dir := filepath.Join(b.Config().Paths.Snapshots, owner, snap.ID)
+	for _, name := range snap.Volumes {
+		f, err := os.Open(filepath.Join(dir, name+".tar"))
+		if err != nil {
+			return err
+		}
+		err = b.Docker.CopyToContainer(b.Ctx, helper, snapshotMount, f, container.CopyToContainerOptions{})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("restore volume %s: %w", name, err)
+		}
+		log.Printf("Restored volume %s from snapshot %s", volumeName(owner, name), snap.ID)
+	}
+
+	return nil
+}
+
+// volumeHelper creates a stopped container with the named volumes of owner
+// mounted under snapshotMount, for copying files in and out. cmd is what it
+// runs if started.
+func (b *Builder) volumeHelper(owner string, names []string, readOnly bool, cmd []string, log *buildLog) (string, error) {
+
+	img := b.Config().SnapshotImage
+	if _, _, err := b.Docker.ImageInspectWithRaw(b.Ctx, img); errdefs.IsNotFound(err) {
+		if err := b.pullImage(img, "", log); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("inspect %s: %w", img, err)
+	}
+
+	var mounts []mount.Mount
+	for _, name := range names {
+		vol := volumeName(owner, name)
+		if _, err := b.Docker.VolumeInspect(b.Ctx, vol); err != nil {
+			return "", fmt.Errorf("inspect volume %s: %w", vol, err)
+		}
+		mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: vol, Target: snapshotMount + "/" + name, ReadOnly: readOnly})
+	}
+
+	created, err := b.Docker.ContainerCreate(b.Ctx,
+		&container.Config{Image: img, Cmd: cmd, Labels: map[string]string{LabelOwner: owner}},
+		&container.HostConfig{Mounts: mounts, NetworkMode: "none"},
+		nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("create volume helper: %w", err)
+	}
+
+	return created.ID, nil
+}
+
+// Snapshots lists the snapshots of owner, newest first.
+func (b *Builder) Snapshots(owner string) ([]Snapshot, error) {
+
+	entries, err := os.ReadDir(filepath.Join(b.Config().Paths.Snapshots, owner))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []Snapshot
+	for _, e := range entries {
+		t, err := time.Parse(snapshotIDFormat, e.Name())
+		if !e.IsDir() || err != nil {
+			continue
+		}
+
+		snap := Snapshot{ID: e.Name(), Time: t}
+		files, err := os.ReadDir(filepath.Join(b.Config().Paths.Snapshots, owner, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name, ok := strings.CutSuffix(f.Name(), ".tar")
+			if !ok {
+				continue
+			}
+			snap.Volumes = append(snap.Volumes, name)
+			if info, err := f.Info(); err == nil {
+				snap.Size += info.Size()
+			}
+		}
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.After(snaps[j].Time) })
+
+	return snaps, nil
+}
+
+func (b *Builder) findSnapshot(owner string, id string) (Snapshot, error) {
+
+	snaps, err := b.Snapshots(owner)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	i := slices.IndexFunc(snaps, func(s Snapshot) bool { return s.ID == id })
+	if i < 0 {
+		return Snapshot{}, fmt.Errorf("%s has no snapshot %s", owner, id)
+	}
+	if len(snaps[i].Volumes) == 0 {
+		return Snapshot{}, fmt.Errorf("snapshot %s is empty", id)
+	}
+
+	return snaps[i], nil
+}
+
+// pruneSnapshots removes the snapshots of owner beyond the newest keep.
+func (b *Builder) pruneSnapshots(owner string, keep int, log *buildLog) error {
+
+	snaps, err := b.Snapshots(owner)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range snaps[min(keep, len(snaps)):] {
+		if err := os.RemoveAll(filepath.Join(b.Config().Paths.Snapshots, owner, s.ID)); err != nil {
+			return fmt.Errorf("remove snapshot %s: %w", s.ID, err)
+		}
+		log.Printf("Removed old snapshot %s", s.ID)
+	}
+
+	return nil
+}
+
+// prepareVolumes creates the volumes a repo's manifest asks for and, when
+// the repo was deployed before, snapshots the backed up ones. The repo's
+// container has already been stopped.
+func (b *Builder) prepareVolumes(p project, deployed bool, log *buildLog) error {
+
+	m, err := b.projectManifest(p.dir)
+	if err != nil || m == nil || len(m.Run.Volumes) == 0 {
+		return err
+	}
+
+	log.Phase("volumes")
+	if err := b.ensureVolumes(p.name, m.Run.Volumes, log); err != nil {
+		return err
+	}
+	if !deployed {
+		return nil
+	}
+
+	return b.snapshotVolumes(p.name, m.Run.Volumes, log)
+}
+
+// prepareServiceVolumes creates the volumes of a manifest service and, when
+// its container is about to move to a different image, stops the container
+// and snapshots the backed up ones.
+func (b *Builder) prepareServiceVolumes(name string, m *manifest.Manifest, ref string, log *buildLog) error {
+
+	if len(m.Run.Volumes) == 0 {
+		return nil
+	}
+
+	log.Phase("volumes")
+	if err := b.ensureVolumes(name, m.Run.Volumes, log); err != nil {
+		return err
+	}
+	if len(backedUp(m.Run.Volumes)) == 0 {
+		return nil
+	}
+
+	current, err := b.Docker.ContainerInspect(b.Ctx, name)
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", name, err)
+	}
+	img, _, err := b.Docker.ImageInspectWithRaw(b.Ctx, ref)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", ref, err)
+	}
+	if img.ID == current.Image {
+		log.Printf("Image unchanged, no snapshot taken")
+		return nil
+	}
+
+	if err := b.StopContainer(name); err != nil {
+		return fmt.Errorf("stop %s: %w", name, err)
+	}
+
+	if err := b.snapshotVolumes(name, m.Run.Volumes, log); err != nil {
+		if startErr := b.StartContainer(name); startErr != nil {
+			log.Printf("Failed to restart %s: %v", name, startErr)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -6,36 +6,34 @@ import (
 	"path/filepath"
 )
 
-func cleanUp() error {
+func (b *Builder) cleanUp() error {
 
 	// Clean Staging Folder
-	err := cleanupAll("STAGING_PATH")
+	staging := b.Config().Paths.Staging
+	err := cleanupAll(staging)
 	if err != nil {
-		return fmt.Errorf("failed to clean staging area at %s: %w", os.Getenv("STAGING_PATH"), err)
+		return fmt.Errorf("failed to clean staging area at %s: %w", staging, err)
 	}
-	err = os.MkdirAll(os.Getenv("STAGING_PATH")+"/Working", 0755)
+	err = os.MkdirAll(staging+"/Working", 0755)
 	if err != nil {
-		return fmt.Errorf("failed to recreate staging area at %s: %w", os.Getenv("STAGING_PATH"), err)
+		return fmt.Errorf("failed to recreate staging area at %s: %w", staging, err)
 	}
 
 	//Clean Download Folder
-	err = cleanupAll("DOWNLOAD_PATH")
+	download := b.Config().Paths.Download
+	err = cleanupAll(download)
 	if err != nil {
-		return fmt.Errorf("failed to clean download area at %s: %w", os.Getenv("DOWNLOAD_PATH"), err)
+		return fmt.Errorf("failed to clean download area at %s: %w", download, err)
 	}
-	err = os.MkdirAll(os.Getenv("DOWNLOAD_PATH"), 0755)
+	err = os.MkdirAll(download, 0755)
 	if err != nil {
-		return fmt.Errorf("failed to recreate download area at %s: %w", os.Getenv("DOWNLOAD_PATH"), err)
+		return fmt.Errorf("failed to recreate download area at %s: %w", download, err)
 	}
 
 	return nil
 }
 
 func cleanupAll(base string) error {
-	base = os.Getenv(base)
-	if base == "" {
-		return fmt.Errorf("STAGING_PATH not set")
-	}
 
 	// Read all entries inside the staging path
 	entries, err := os.ReadDir(base)
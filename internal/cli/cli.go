@@ -2,35 +2,50 @@ package cli
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"log"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/LSariol/LightHouse/internal/builder"
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/models"
 	"github.com/LSariol/LightHouse/internal/watcher"
 )
 
 type CLI struct {
 	Watcher *watcher.Watcher
+
+	// lines carries stdin so a following command can stop on Enter.
+	lines chan string
 }
 
 func NewCLI(w *watcher.Watcher) *CLI {
 
 	return &CLI{
 		Watcher: w,
+		lines:   make(chan string),
 	}
 }
 
 func (c *CLI) Run() {
 
-	ioScanner := bufio.NewScanner(os.Stdin)
+	go func() {
+		ioScanner := bufio.NewScanner(os.Stdin)
+		for ioScanner.Scan() {
+			c.lines <- ioScanner.Text()
+		}
+		close(c.lines)
+	}()
 
 	for {
 		fmt.Print("LightHouse CLI> ")
-		if !ioScanner.Scan() {
+		input, ok := <-c.lines
+		if !ok {
 			break
 		}
-		input := ioScanner.Text()
 		c.parseCLI(strings.Fields(input))
 	}
 }
@@ -55,17 +70,26 @@ func (c *CLI) parseCLI(args []string) {
 		}
 	case "add", "a":
 
-		if len(args) != 3 {
-			fmt.Println("add requires 3 total arguments.")
-			fmt.Println("add <DisplayName> <repoURL>")
+		if len(args) < 3 || len(args) > 4 {
+			fmt.Println("add requires 3 or 4 total arguments.")
+			fmt.Println("add <DisplayName> <repoURL> [monorepoDir]")
 			return
 		}
 
-		err := c.Watcher.AddNewRepo(args[1], args[2])
+		dir := ""
+		if len(args) == 4 {
+			dir = args[3]
+		}
+		err := c.Watcher.AddNewRepo(args[1], args[2], dir)
 		if err != nil {
-			fmt.Printf("Failed adding new repo: %w\n", err)
+			fmt.Printf("Failed adding new repo: %v\n", err)
+			return
 		}
-		log.Printf("%s is now being watched.\n", args[1])
+		if dir != "" {
+			fmt.Printf("%s is now being watched, built from %s.\n", args[1], dir)
+			return
+		}
+		fmt.Printf("%s is now being watched.\n", args[1])
 
 	case "remove", "r":
 
@@ -77,8 +101,10 @@ func (c *CLI) parseCLI(args []string) {
 
 		err := c.Watcher.RemoveRepo(args[1])
 		if err != nil {
-			fmt.Printf("Failed removing repo: %w\n", err)
+			fmt.Printf("Failed removing repo: %v\n", err)
+			return
 		}
+		fmt.Printf("%s has been removed from the watchlist.\n", args[1])
 
 	case "change", "c":
 
@@ -98,7 +124,7 @@ func (c *CLI) parseCLI(args []string) {
 		if strings.ToLower(args[1]) == "name" {
 			err := c.Watcher.ChangeRepoName(args[2], args[3])
 			if err != nil {
-				fmt.Printf("Failed changing repo name for %s: %w\n", args[2], err)
+				fmt.Printf("Failed changing repo name for %s: %v\n", args[2], err)
 			}
 
 			fmt.Println("Name has been changed.")
@@ -112,21 +138,27 @@ func (c *CLI) parseCLI(args []string) {
 			return
 		}
 		if args[1] == "ALL" || args[1] == "all" {
+			c.Watcher.SetAllDesiredState(models.DesiredRunning)
 			err := c.Watcher.Builder.StartAllContainers()
 			if err != nil {
-				fmt.Printf("Error starting all containers: %w\n", err)
+				fmt.Printf("Error starting all containers: %v\n", err)
 				return
 			}
 			fmt.Println("All Containers Started")
 			return
 		}
 
-		err := c.Watcher.Builder.StartContainer(args[1])
+		var err error
+		if c.Watcher.Manages(args[1]) {
+			err = c.Watcher.SetDesiredState(args[1], models.DesiredRunning)
+		} else {
+			err = c.Watcher.Builder.StartContainer(args[1])
+		}
 		if err != nil {
-			fmt.Printf("Error starting '%s': %w\n", args[1], err)
+			fmt.Printf("Error starting '%s': %v\n", args[1], err)
 			return
 		}
-		fmt.Println("%w has been started.")
+		fmt.Printf("%s has been started.\n", args[1])
 		return
 
 	case "stop", "STOP":
@@ -136,23 +168,351 @@ func (c *CLI) parseCLI(args []string) {
 			return
 		}
 		if args[1] == "ALL" || args[1] == "all" {
+			c.Watcher.SetAllDesiredState(models.DesiredStopped)
 			err := c.Watcher.Builder.StopAllContainers()
 			if err != nil {
-				fmt.Printf("Error starting all containers: %w\n", err)
+				fmt.Printf("Error stopping all containers: %v\n", err)
 				return
 			}
 			fmt.Println("All Containers stopped")
 			return
 		}
 
-		err := c.Watcher.Builder.StopContainer(args[1])
+		var err error
+		if c.Watcher.Manages(args[1]) {
+			err = c.Watcher.SetDesiredState(args[1], models.DesiredStopped)
+		} else {
+			err = c.Watcher.Builder.StopContainer(args[1])
+		}
+		if err != nil {
+			fmt.Printf("Error stopping '%s': %v\n", args[1], err)
+			return
+		}
+		fmt.Printf("%s has been stopped.\n", args[1])
+		return
+
+	case "restart", "RESTART":
+		if len(args) != 2 {
+			fmt.Println("restart requires 2 total arguments.")
+			fmt.Println("restart <projectName>")
+			return
+		}
+
+		var err error
+		if svc, ok := c.Watcher.GetService(args[1]); ok {
+			err = c.Watcher.Builder.RestartService(svc)
+		} else {
+			err = c.Watcher.Builder.RestartContainer(args[1])
+		}
 		if err != nil {
-			fmt.Printf("Error stopping '%s': %w\n", args[1], err)
+			fmt.Printf("Error restarting '%s': %v\n", args[1], err)
 			return
 		}
-		fmt.Println("%w has been stopped.")
+		fmt.Printf("%s has been restarted.\n", args[1])
 		return
 
+	case "depends", "DEPENDS":
+		if len(args) < 2 {
+			fmt.Println("depends requires at least 2 total arguments.")
+			fmt.Println("depends <name> [dependency...]")
+			return
+		}
+
+		if err := c.Watcher.SetDependencies(args[1], args[2:]); err != nil {
+			fmt.Printf("Failed setting dependencies: %v\n", err)
+			return
+		}
+		if len(args) == 2 {
+			fmt.Printf("%s no longer depends on anything.\n", args[1])
+			return
+		}
+		fmt.Printf("%s now starts after %s.\n", args[1], strings.Join(args[2:], ", "))
+
+	case "pause", "PAUSE":
+		if len(args) != 2 {
+			fmt.Println("pause requires 2 total arguments.")
+			fmt.Println("pause <repoName>")
+			return
+		}
+		if err := c.Watcher.Pause(args[1]); err != nil {
+			fmt.Printf("Failed pausing %s: %v\n", args[1], err)
+			return
+		}
+		fmt.Printf("%s is paused. New commits are held until 'resume %s'.\n", args[1], args[1])
+
+	case "resume", "RESUME":
+		if len(args) != 2 {
+			fmt.Println("resume requires 2 total arguments.")
+			fmt.Println("resume <repoName>")
+			return
+		}
+		if err := c.Watcher.Resume(args[1]); err != nil {
+			fmt.Printf("Failed resuming %s: %v\n", args[1], err)
+			return
+		}
+		fmt.Printf("%s is resumed. A held commit deploys on its next poll.\n", args[1])
+
+	case "interval", "INTERVAL":
+		if len(args) != 3 {
+			fmt.Println("interval requires 3 total arguments.")
+			fmt.Println("interval <repoName> <duration/default>")
+			return
+		}
+		interval := args[2]
+		if interval == "default" {
+			interval = ""
+		}
+		if err := c.Watcher.SetPollInterval(args[1], interval); err != nil {
+			fmt.Printf("Failed setting poll interval: %v\n", err)
+			return
+		}
+		if interval == "" {
+			fmt.Printf("%s is polled at the default interval.\n", args[1])
+			return
+		}
+		fmt.Printf("%s is polled every %s.\n", args[1], interval)
+
+	case "windows", "WINDOWS":
+		if len(args) < 2 {
+			fmt.Println("windows requires at least 2 total arguments.")
+			fmt.Println("windows <repoName> [window; window...]")
+			return
+		}
+
+		// Windows contain spaces, so they are separated by semicolons.
+		var windows []string
+		for _, w := range strings.Split(strings.Join(args[2:], " "), ";") {
+			if w = strings.TrimSpace(w); w != "" {
+				windows = append(windows, w)
+			}
+		}
+		if err := c.Watcher.SetWindows(args[1], windows); err != nil {
+			fmt.Printf("Failed setting maintenance windows: %v\n", err)
+			return
+		}
+		if len(windows) == 0 {
+			fmt.Printf("%s deploys at any time.\n", args[1])
+			return
+		}
+		fmt.Printf("%s deploys only within %s.\n", args[1], strings.Join(windows, "; "))
+
+	case "paths", "PATHS", "ignore", "IGNORE":
+		if len(args) < 2 {
+			fmt.Printf("%s requires at least 2 total arguments.\n", strings.ToLower(args[0]))
+			fmt.Printf("%s <repoName> [pattern...]\n", strings.ToLower(args[0]))
+			return
+		}
+
+		ignore := strings.EqualFold(args[0], "ignore")
+		var err error
+		if ignore {
+			err = c.Watcher.SetIgnorePaths(args[1], args[2:])
+		} else {
+			err = c.Watcher.SetPaths(args[1], args[2:])
+		}
+		if err != nil {
+			fmt.Printf("Failed setting path filter: %v\n", err)
+			return
+		}
+
+		switch {
+		case ignore && len(args) == 2:
+			fmt.Printf("%s no longer ignores any changes.\n", args[1])
+		case ignore:
+			fmt.Printf("%s ignores changes to %s.\n", args[1], strings.Join(args[2:], " "))
+		case len(args) == 2:
+			fmt.Printf("%s deploys on changes anywhere.\n", args[1])
+		default:
+			fmt.Printf("%s deploys only on changes to %s.\n", args[1], strings.Join(args[2:], " "))
+		}
+
+	case "approval", "APPROVAL":
+		if len(args) != 3 || (args[2] != models.ApprovalRequired && args[2] != "none") {
+			fmt.Println("approval requires 3 total arguments.")
+			fmt.Println("approval <repoName> <required/none>")
+			return
+		}
+		approval := args[2]
+		if approval == "none" {
+			approval = ""
+		}
+		if err := c.Watcher.SetApproval(args[1], approval); err != nil {
+			fmt.Printf("Failed setting approval: %v\n", err)
+			return
+		}
+		if approval == "" {
+			fmt.Printf("%s deploys new commits without approval.\n", args[1])
+			return
+		}
+		fmt.Printf("New commits of %s wait for 'approve %s'.\n", args[1], args[1])
+
+	case "approvals", "APPROVALS":
+		c.approvals()
+
+	case "approve", "APPROVE":
+		if len(args) < 2 || len(args) > 3 {
+			fmt.Println("approve requires 2 or 3 total arguments.")
+			fmt.Println("approve <repoName> [sha]")
+			return
+		}
+		sha := ""
+		if len(args) == 3 {
+			sha = args[2]
+		}
+		approved, err := c.Watcher.Approve(args[1], sha)
+		if err != nil {
+			fmt.Printf("Failed approving: %v\n", err)
+			return
+		}
+		fmt.Printf("%s of %s is approved and deploys on its next poll.\n", approved[:min(7, len(approved))], args[1])
+
+	case "reject", "REJECT":
+		if len(args) < 2 || len(args) > 3 {
+			fmt.Println("reject requires 2 or 3 total arguments.")
+			fmt.Println("reject <repoName> [sha]")
+			return
+		}
+		sha := ""
+		if len(args) == 3 {
+			sha = args[2]
+		}
+		rejected, err := c.Watcher.Reject(args[1], sha)
+		if err != nil {
+			fmt.Printf("Failed rejecting: %v\n", err)
+			return
+		}
+		fmt.Printf("Rejected %d commit(s) of %s.\n", len(rejected), args[1])
+
+	case "service", "SERVICE", "svc":
+		c.parseService(args[1:])
+
+	case "buildlog", "BUILDLOG":
+		if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[1] != "-f") {
+			fmt.Println("buildlog requires 2 or 3 total arguments.")
+			fmt.Println("buildlog [-f] <buildID/repoName/serviceName>")
+			return
+		}
+		c.showLogs(args[len(args)-1], len(args) == 3)
+
+	case "logs", "LOGS":
+		c.containerLogs(args[1:])
+
+	case "inspect", "INSPECT":
+		if len(args) != 2 {
+			fmt.Println("inspect requires 2 total arguments.")
+			fmt.Println("inspect <repoName/serviceName>")
+			return
+		}
+		c.inspect(args[1])
+
+	case "exec", "EXEC":
+		if len(args) < 4 || args[2] != "--" {
+			fmt.Println("exec requires at least 4 total arguments.")
+			fmt.Println("exec <repoName/serviceName> -- <command> [args...]")
+			return
+		}
+		c.exec(args[1], args[3:])
+
+	case "history", "HISTORY":
+		if len(args) != 2 {
+			fmt.Println("history requires 2 total arguments.")
+			fmt.Println("history <repoName/serviceName>")
+			return
+		}
+
+		history, ok := c.Watcher.History(args[1])
+		if !ok {
+			fmt.Printf("%s is not a watched repo or managed service.\n", args[1])
+			return
+		}
+		if len(history) == 0 {
+			fmt.Printf("No history recorded for %s.\n", args[1])
+			return
+		}
+		for _, h := range history {
+			sha := h.SHA
+			if len(sha) > 7 {
+				sha = sha[:7]
+			}
+			fmt.Printf("%s  %-20s  %-7s  %s\n", h.Time.Format("2006-01-02 15:04:05"), h.Event, sha, h.Message)
+		}
+
+	case "loglevel", "LOGLEVEL":
+		if len(args) != 2 {
+			fmt.Println("loglevel requires 2 total arguments.")
+			fmt.Println("loglevel <debug/info/warn/error>")
+			return
+		}
+		if err := logging.SetLevel(args[1]); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Log level set to %s.\n", logging.Level.Level())
+
+	case "snapshots", "SNAPSHOTS":
+		if len(args) != 2 {
+			fmt.Println("snapshots requires 2 total arguments.")
+			fmt.Println("snapshots <repoName/serviceName>")
+			return
+		}
+
+		snaps, err := c.Watcher.Snapshots(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(snaps) == 0 {
+			fmt.Printf("No snapshots of %s.\n", args[1])
+			return
+		}
+		for _, s := range snaps {
+			fmt.Printf("%s  %s  %8d KiB  %s\n", s.ID, s.Time.Local().Format("2006-01-02 15:04:05"), s.Size/1024, strings.Join(s.Volumes, ", "))
+		}
+
+	case "restore", "RESTORE":
+		if len(args) != 3 {
+			fmt.Println("restore requires 3 total arguments.")
+			fmt.Println("restore <repoName/serviceName> <snapshot>")
+			return
+		}
+
+		if err := c.Watcher.Restore(args[1], args[2]); err != nil {
+			fmt.Printf("Failed restoring %s: %v\n", args[1], err)
+			return
+		}
+		fmt.Printf("%s has been restored from snapshot %s.\n", args[1], args[2])
+
+	case "plan", "PLAN":
+		c.plan()
+
+	case "ports", "PORTS":
+		assigned := c.Watcher.Builder.Ports.All()
+		if len(assigned) == 0 {
+			fmt.Println("No host ports assigned.")
+			return
+		}
+		for _, a := range assigned {
+			how := "assigned"
+			if a.Fixed {
+				how = "fixed"
+			}
+			fmt.Printf("%5d/%-3s  %-20s  %-20s  -> %d  (%s)\n", a.HostPort, a.Protocol, a.Owner, a.Port, a.ContainerPort, how)
+		}
+
+	case "routes", "ROUTES":
+		if c.Watcher.Builder.Proxy == nil {
+			fmt.Println("The proxy is disabled, set PROXY=true to enable it.")
+			return
+		}
+		routes := c.Watcher.Builder.Proxy.Routes()
+		if len(routes) == 0 {
+			fmt.Println("No routes.")
+			return
+		}
+		for _, r := range routes {
+			fmt.Printf("%-40s  %-20s  -> %s (%s)\n", r, r.Owner, r.Container, r.Target)
+		}
+
 	case "scan", "SCAN":
 		c.Watcher.Scan()
 	case "list", "LIST", "l", "L":
@@ -271,3 +631,348 @@ func (c *CLI) parseCLI(args []string) {
 	// 	fmt.Println("\033[31mCove CLI> " + s + "\033[0m")
 	// }
 }
+
+// showLogs prints the recorded output of a build. A repo name resolves to
+// that repo's most recent build. With follow set it keeps printing until
+// the build finishes.
+func (c *CLI) showLogs(target string, follow bool) {
+
+	buildID := target
+	if repo, ok := c.Watcher.GetRepo(target); ok {
+		if repo.Stats.Builds.LastBuildID == "" {
+			fmt.Printf("%s has not been built yet.\n", target)
+			return
+		}
+		buildID = repo.Stats.Builds.LastBuildID
+	}
+	if svc, ok := c.Watcher.GetService(target); ok {
+		if svc.Stats.Deploys.LastDeployID == "" {
+			fmt.Printf("%s has not been deployed yet.\n", target)
+			return
+		}
+		buildID = svc.Stats.Deploys.LastDeployID
+	}
+
+	// A running build has logged that it started, so a build with no
+	// history is unknown or too old to follow and would never finish.
+	history := c.Watcher.Builder.Events.History(buildID)
+	if len(history) == 0 {
+		fmt.Printf("No logs found for %s.\n", buildID)
+		return
+	}
+
+	if !follow {
+		for _, e := range history {
+			printEvent(e)
+		}
+		return
+	}
+
+	ch, cancel := c.Watcher.Builder.Events.Subscribe(buildID)
+	defer cancel()
+
+	for e := range ch {
+		printEvent(e)
+		if e.Finished() {
+			return
+		}
+	}
+}
+
+// containerLogs prints the output of a repo's or service's containers.
+// When following, Enter stops it.
+func (c *CLI) containerLogs(args []string) {
+
+	usage := func() {
+		fmt.Println("logs <repoName/serviceName> [-f] [--since <10m|timestamp>] [--tail <n>]")
+	}
+
+	var name string
+	var opts builder.LogOptions
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-f", "--follow":
+			opts.Follow = true
+		case "--since", "--tail":
+			if i+1 == len(args) {
+				usage()
+				return
+			}
+			if args[i] == "--since" {
+				opts.Since = args[i+1]
+			} else {
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n < 0 {
+					fmt.Println("--tail must be a positive number.")
+					return
+				}
+				opts.Tail = n
+			}
+			i++
+		default:
+			if name != "" {
+				usage()
+				return
+			}
+			name = args[i]
+		}
+	}
+	if name == "" {
+		usage()
+		return
+	}
+
+	containers, err := c.Watcher.ResolveContainers(name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Watcher.Ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watcher.Builder.Logs(ctx, containers, opts, os.Stdout)
+	}()
+
+	if opts.Follow {
+		fmt.Println("Following logs, press Enter to stop.")
+		select {
+		case <-c.lines:
+			cancel()
+		case err := <-done:
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+	}
+
+	if err := <-done; err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (c *CLI) inspect(name string) {
+
+	containers, err := c.Watcher.ResolveContainers(name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, container := range containers {
+		info, err := c.Watcher.Builder.Inspect(container)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		fmt.Printf("%s (%s)\n", info.Name, info.ID)
+		fmt.Printf("  Image:    %s (%s)\n", info.Image, info.ImageID)
+		if info.SHA != "" {
+			fmt.Printf("  Commit:   %s\n", info.SHA)
+		}
+		fmt.Printf("  State:    %s", info.State)
+		if info.Health != "" {
+			fmt.Printf(", %s", info.Health)
+		}
+		fmt.Printf(" since %s, %d restarts\n", info.StartedAt, info.RestartCount)
+		printList("Ports", info.Ports)
+		printList("Mounts", info.Mounts)
+		printList("Env", info.Env)
+	}
+}
+
+// plan prints the limits and host ports every repo and service has, or will
+// get on its next deploy, and anything that breaks the host's limit policy
+// or collides with another port.
+func (c *CLI) plan() {
+
+	plan, err := c.Watcher.Builder.Plan()
+	if err != nil {
+		fmt.Printf("Failed building plan: %v\n", err)
+		return
+	}
+
+	problems := len(plan.Host)
+	for _, e := range plan.Entries {
+		container := e.Container
+		if container == "" {
+			container = "-"
+		}
+		fmt.Printf("%-20s %-24s %-9s %s\n", e.Name, container, e.Source, e.Limits)
+		for _, a := range e.Ports {
+			fmt.Printf("    port %s: host %d -> %d/%s\n", a.Port, a.HostPort, a.ContainerPort, a.Protocol)
+		}
+		for _, f := range e.Findings {
+			fmt.Printf("    ! %s\n", f)
+		}
+		problems += len(e.Findings)
+	}
+	for _, f := range plan.Host {
+		fmt.Printf("host: %s\n", f)
+	}
+
+	if problems == 0 {
+		fmt.Println("No problems found.")
+	}
+}
+
+// approvals prints the commits waiting for approval.
+func (c *CLI) approvals() {
+
+	approvals := c.Watcher.Approvals()
+	if len(approvals) == 0 {
+		fmt.Println("No commits are awaiting approval.")
+		return
+	}
+
+	fmt.Printf("%-20s | %-7s | %-20s | %-16s | %-16s | %s\n", "Repo", "SHA", "Author", "Detected", "Expires", "Message")
+	for _, a := range approvals {
+		expires := "never"
+		if a.ExpiresAt != nil {
+			expires = a.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-20s | %-7s | %-20s | %-16s | %-16s | %s\n",
+			a.Repo, a.SHA[:min(7, len(a.SHA))], a.Author, a.DetectedAt.Format("2006-01-02 15:04"), expires, a.Message)
+	}
+}
+
+func printList(title string, items []string) {
+
+	if len(items) == 0 {
+		return
+	}
+
+	fmt.Printf("  %s:\n", title)
+	for _, item := range items {
+		fmt.Printf("    %s\n", item)
+	}
+}
+
+// exec runs cmd in the primary container of name.
+func (c *CLI) exec(name string, cmd []string) {
+
+	containers, err := c.Watcher.ResolveContainers(name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	code, err := c.Watcher.Builder.Exec(c.Watcher.Ctx, containers[0], cmd, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if code != 0 {
+		fmt.Printf("Exited with code %d.\n", code)
+	}
+}
+
+func printEvent(e events.Event) {
+
+	ts := e.Time.Format("15:04:05")
+
+	switch e.Kind {
+	case events.KindLog:
+		fmt.Printf("%s [%s] %s\n", ts, e.Phase, e.Line)
+	case events.KindPhase:
+		fmt.Printf("%s == %s ==\n", ts, e.Phase)
+	case events.KindBuildStarted:
+		fmt.Printf("%s build %s started for %s\n", ts, e.BuildID, e.Repo)
+	case events.KindBuildFinished:
+		fmt.Printf("%s build %s finished: %s\n", ts, e.BuildID, e.Status)
+	}
+}
+
+func (c *CLI) parseService(args []string) {
+
+	if len(args) == 0 {
+		fmt.Println("service <add/remove/deploy/policy/auth/list>")
+		return
+	}
+
+	switch args[0] {
+	case "add", "a":
+		if len(args) < 4 || len(args) > 5 || (len(args) == 5 && args[4] != "watch") {
+			fmt.Println("service add requires 4 or 5 total arguments.")
+			fmt.Println("service add <name> <image/compose/manifest> <imageRef/path> [watch]")
+			return
+		}
+
+		err := c.Watcher.AddService(args[1], args[2], args[3], len(args) == 5)
+		if err != nil {
+			fmt.Printf("Failed adding service: %v\n", err)
+			return
+		}
+		fmt.Printf("%s is now managed. Run 'start %s' to deploy it.\n", args[1], args[1])
+
+	case "remove", "r":
+		if len(args) != 2 {
+			fmt.Println("service remove requires 2 total arguments.")
+			fmt.Println("service remove <name>")
+			return
+		}
+
+		if err := c.Watcher.RemoveService(args[1]); err != nil {
+			fmt.Printf("Failed removing service: %v\n", err)
+			return
+		}
+		fmt.Printf("%s is no longer managed.\n", args[1])
+
+	case "deploy", "d":
+		if len(args) != 2 {
+			fmt.Println("service deploy requires 2 total arguments.")
+			fmt.Println("service deploy <name>")
+			return
+		}
+
+		if err := c.Watcher.DeployService(args[1]); err != nil {
+			fmt.Printf("Failed deploying %s: %v\n", args[1], err)
+			return
+		}
+		fmt.Printf("%s has been deployed.\n", args[1])
+
+	case "policy", "p":
+		if len(args) != 3 {
+			fmt.Println("service policy requires 3 total arguments.")
+			fmt.Println("service policy <name> <semver/2.x/2.4.x/none>")
+			return
+		}
+
+		policy := args[2]
+		if policy == "none" {
+			policy = ""
+		}
+		if err := c.Watcher.SetServiceTagPolicy(args[1], policy); err != nil {
+			fmt.Printf("Failed setting tag policy: %v\n", err)
+			return
+		}
+		fmt.Printf("%s now follows tag policy %q.\n", args[1], policy)
+
+	case "auth":
+		if len(args) != 3 {
+			fmt.Println("service auth requires 3 total arguments.")
+			fmt.Println("service auth <name> <coveKey/none>")
+			return
+		}
+
+		key := args[2]
+		if key == "none" {
+			key = ""
+		}
+		if err := c.Watcher.SetServiceRegistryAuth(args[1], key); err != nil {
+			fmt.Printf("Failed setting registry auth: %v\n", err)
+			return
+		}
+		fmt.Printf("Registry credentials for %s updated.\n", args[1])
+
+	case "list", "l":
+		c.Watcher.DisplayServices()
+
+	default:
+		fmt.Println("service <add/remove/deploy/policy/auth/list>")
+	}
+}
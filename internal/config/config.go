@@ -0,0 +1,638 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the config file looked for when -config and LIGHTHOUSE_CONFIG
+// are not given, first in the working directory and then in the vault.
+const FileName = "lighthouse.config.yaml"
+
+// Config is every setting of the daemon. It is built from the defaults, then
+// the config file, then environment variables, then command line flags, each
+// overriding the one before. See lighthouse.config.example.yaml.
+type Config struct {
+	// PollInterval is the pause between two scans of the watchlist.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// ReconcileInterval is how often containers are checked against their
+	// desired state without a trigger.
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	// Workers is how many repos are polled at once. Builds still run one at
+	// a time since they share the staging area.
+	Workers int `yaml:"workers"`
+
+	Paths     Paths     `yaml:"paths"`
+	Cove      Cove      `yaml:"cove"`
+	API       API       `yaml:"api"`
+	Log       Log       `yaml:"log"`
+	Retention Retention `yaml:"retention"`
+	Timeouts  Timeouts  `yaml:"timeouts"`
+	Limits    Limits    `yaml:"limits"`
+	Ports     Ports     `yaml:"ports"`
+	Proxy     Proxy     `yaml:"proxy"`
+	GitHub    GitHub    `yaml:"github"`
+	Registry  Registry  `yaml:"registry"`
+	Self      Self      `yaml:"self"`
+	GitOps    GitOps    `yaml:"gitops"`
+	Approval  Approval  `yaml:"approval"`
+
+	// SnapshotImage is the helper image volumes are copied through.
+	SnapshotImage string `yaml:"snapshot_image"`
+
+	// file is the config file that was read, empty when there was none.
+	file string
+}
+
+type Paths struct {
+	Repos     string `yaml:"repos"`
+	Services  string `yaml:"services"`
+	Ports     string `yaml:"ports"`
+	Notify    string `yaml:"notify"`
+	Staging   string `yaml:"staging"`
+	Download  string `yaml:"download"`
+	Snapshots string `yaml:"snapshots"`
+}
+
+type Cove struct {
+	Address       string `yaml:"address"`
+	ContainerName string `yaml:"container_name"`
+	// ClientSecret only comes from the environment, where Lighthouse saves
+	// it after bootstrapping, so it never ends up in the config file.
+	ClientSecret string `yaml:"-"`
+}
+
+type API struct {
+	ListenAddress string `yaml:"listen_address"`
+	// Containers enables container logs and inspect through the API, which
+	// has no authentication.
+	Containers bool `yaml:"containers"`
+	// Exec enables exec through the API, which has no authentication.
+	Exec bool `yaml:"exec"`
+	// ExecAllowed replaces the commands exec may run. Empty keeps the
+	// read-only defaults.
+	ExecAllowed []string `yaml:"exec_allowed"`
+	// PublicURL is the browser-reachable API, linked from commit statuses.
+	PublicURL string `yaml:"public_url"`
+	// Approve enables approving and rejecting commits through the API,
+	// which has no authentication.
+	Approve bool `yaml:"approve"`
+}
+
+type Log struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+type Retention struct {
+	// Snapshots is how many volume snapshots are kept per container.
+	Snapshots int `yaml:"snapshots"`
+	// BuildLogs is how many builds keep their log lines for replay.
+	BuildLogs int `yaml:"build_logs"`
+}
+
+type Timeouts struct {
+	// HTTP bounds each request to GitHub.
+	HTTP time.Duration `yaml:"http"`
+	// Registry bounds each request to an image registry.
+	Registry time.Duration `yaml:"registry"`
+	// Health is how long a new container gets to become healthy when its
+	// manifest does not say otherwise.
+	Health time.Duration `yaml:"health"`
+	// Step is how long a container may take to start or stop.
+	Step time.Duration `yaml:"step"`
+	// Exec bounds a command run through exec.
+	Exec time.Duration `yaml:"exec"`
+}
+
+// Limits are given to containers whose manifest leaves them out, and Max
+// caps what any container may ask for. See manifest.Resources for the
+// formats.
+type Limits struct {
+	CPU       string `yaml:"cpu"`
+	Memory    string `yaml:"memory"`
+	PIDs      int64  `yaml:"pids"`
+	Restart   string `yaml:"restart"`
+	MaxCPU    string `yaml:"max_cpu"`
+	MaxMemory string `yaml:"max_memory"`
+	MaxPIDs   int64  `yaml:"max_pids"`
+}
+
+type Ports struct {
+	// Range is handed out to public ports that do not ask for a host
+	// port, e.g. "20000-20999".
+	Range string `yaml:"range"`
+}
+
+// Bounds returns the first and last port of the range.
+func (p Ports) Bounds() (int, int, error) {
+
+	lo, hi, ok := strings.Cut(p.Range, "-")
+	start, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	end, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if !ok || err1 != nil || err2 != nil || start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %q", p.Range)
+	}
+
+	return start, end, nil
+}
+
+type Proxy struct {
+	Enabled bool `yaml:"enabled"`
+	// Network is where the proxy reaches routed containers.
+	Network   string `yaml:"network"`
+	HTTPAddr  string `yaml:"http_addr"`
+	HTTPSAddr string `yaml:"https_addr"`
+	// TLS is "", "local" or "acme".
+	TLS           string `yaml:"tls"`
+	CertDir       string `yaml:"cert_dir"`
+	ACMECache     string `yaml:"acme_cache"`
+	ACMEEmail     string `yaml:"acme_email"`
+	ACMEDirectory string `yaml:"acme_directory"`
+}
+
+type GitHub struct {
+	APIURL string `yaml:"api_url"`
+	// CommitStatus posts deploy results back to the deployed commits.
+	CommitStatus bool `yaml:"commit_status"`
+}
+
+type Registry struct {
+	// Insecure registries are reached over plain http.
+	Insecure []string `yaml:"insecure"`
+}
+
+type Self struct {
+	ContainerName string `yaml:"container_name"`
+	// HealthURL is polled after a self-update. Empty derives it from the
+	// container name and the API's port.
+	HealthURL string `yaml:"health_url"`
+}
+
+// GitOps reads the watchlist and managed services from an infra repo
+// instead of the local files, which then only cache the stats.
+type GitOps struct {
+	// Repo is the infra repo, e.g. "https://github.com/owner/infra". Empty
+	// turns GitOps off.
+	Repo string `yaml:"repo"`
+	// Path is the directory of the repo holding the definitions.
+	Path string `yaml:"path"`
+	// Prune removes the containers of a repo or service whose definition
+	// is deleted. Otherwise they are left running, unmanaged.
+	Prune bool `yaml:"prune"`
+}
+
+type Approval struct {
+	// Expiry is how long a commit waits for approval before it is dropped.
+	// Zero keeps it until it is approved or rejected.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// Default returns the settings used for anything not configured.
+func Default() *Config {
+	return &Config{
+		PollInterval:      10 * time.Second,
+		ReconcileInterval: 30 * time.Second,
+		Workers:           1,
+		Paths: Paths{
+			Repos:     "config/repos.json",
+			Services:  "config/services.json",
+			Ports:     "config/ports.json",
+			Staging:   "Server/Staging/",
+			Download:  "Server/Download/",
+			Snapshots: "Server/Snapshots/",
+		},
+		Cove: Cove{
+			Address:       "http://cove:2100",
+			ContainerName: "cove",
+		},
+		API: API{
+			ListenAddress: ":2000",
+		},
+		Log: Log{
+			Format: "text",
+			Level:  "info",
+		},
+		Retention: Retention{
+			Snapshots: 5,
+			BuildLogs: 20,
+		},
+		Timeouts: Timeouts{
+			HTTP:     10 * time.Second,
+			Registry: 30 * time.Second,
+			Health:   60 * time.Second,
+			Step:     30 * time.Second,
+			Exec:     30 * time.Second,
+		},
+		Ports: Ports{
+			Range: "20000-20999",
+		},
+		Proxy: Proxy{
+			Network:   "spark",
+			HTTPAddr:  ":80",
+			HTTPSAddr: ":443",
+		},
+		GitHub: GitHub{
+			APIURL: "https://api.github.com",
+		},
+		Self: Self{
+			ContainerName: "lighthouse",
+		},
+		GitOps: GitOps{
+			Path: "lighthouse",
+		},
+		Approval: Approval{
+			Expiry: 72 * time.Hour,
+		},
+		SnapshotImage: "busybox:stable",
+	}
+}
+
+// Load builds the config from the defaults, the config file, the
+// environment and args, the command line without the program name, and
+// validates it.
+func Load(args []string) (*Config, error) {
+
+	// The config file can be named on the command line, so the flags are
+	// parsed once to find it and again to override what it says.
+	first := Default()
+	fs := flagSet(first)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		path = os.Getenv("LIGHTHOUSE_CONFIG")
+	}
+
+	cfg := Default()
+	if err := cfg.readFile(path); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := flagSet(cfg).Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// File returns the config file the config was read from, or an empty
+// string when there was none.
+func (c *Config) File() string {
+	return c.file
+}
+
+// readFile reads path, or the default config file if there is one when
+// path is empty.
+func (c *Config) readFile(path string) error {
+
+	explicit := path != ""
+	candidates := []string{path}
+	if !explicit {
+		candidates = []string{FileName, "/app/vault/" + FileName}
+	}
+
+	for _, p := range candidates {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read config: %w", err)
+		}
+
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		c.file = p
+		return nil
+	}
+
+	return nil
+}
+
+// flagSet returns the command line flags, which write into c.
+func flagSet(c *Config) *flag.FlagSet {
+
+	fs := flag.NewFlagSet("lighthouse", flag.ContinueOnError)
+	fs.String("config", "", "config file, default "+FileName)
+	fs.DurationVar(&c.PollInterval, "poll-interval", c.PollInterval, "pause between scans of the watchlist")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "repos polled at once")
+	fs.StringVar(&c.API.ListenAddress, "listen", c.API.ListenAddress, "address the HTTP API listens on")
+	fs.StringVar(&c.Cove.Address, "cove-address", c.Cove.Address, "address of Cove")
+	fs.StringVar(&c.Paths.Staging, "staging-path", c.Paths.Staging, "where repos are unpacked and built")
+	fs.StringVar(&c.Paths.Download, "download-path", c.Paths.Download, "where repo archives are downloaded")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "text or json")
+	fs.BoolVar(&c.Proxy.Enabled, "proxy", c.Proxy.Enabled, "run the reverse proxy")
+
+	return fs
+}
+
+// applyEnv overrides c with the environment variables that are set. The
+// names are the ones Lighthouse has always read, so existing .env files
+// keep working.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+
+	var errs []error
+
+	str := func(key string, dst *string) {
+		if v, ok := lookup(key); ok && v != "" {
+			*dst = v
+		}
+	}
+	list := func(key string, dst *[]string) {
+		v, ok := lookup(key)
+		if !ok || v == "" {
+			return
+		}
+		*dst = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*dst = append(*dst, s)
+			}
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v, ok := lookup(key); ok && v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not true or false", key, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(key string, dst *int) {
+		if v, ok := lookup(key); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	integer64 := func(key string, dst *int64) {
+		if v, ok := lookup(key); ok && v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	duration := func(key string, dst *time.Duration) {
+		if v, ok := lookup(key); ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration such as 30s", key, v))
+				return
+			}
+			*dst = d
+		}
+	}
+
+	duration("POLL_INTERVAL", &c.PollInterval)
+	duration("RECONCILE_INTERVAL", &c.ReconcileInterval)
+	integer("WORKERS", &c.Workers)
+
+	str("APP_REPO_PATH", &c.Paths.Repos)
+	str("APP_SERVICES_PATH", &c.Paths.Services)
+	str("APP_PORTS_PATH", &c.Paths.Ports)
+	str("APP_NOTIFY_PATH", &c.Paths.Notify)
+	str("STAGING_PATH", &c.Paths.Staging)
+	str("DOWNLOAD_PATH", &c.Paths.Download)
+	str("SNAPSHOT_PATH", &c.Paths.Snapshots)
+
+	str("COVE_ADDRESS", &c.Cove.Address)
+	str("COVE_CONTAINER_NAME", &c.Cove.ContainerName)
+	str("COVE_CLIENT_SECRET", &c.Cove.ClientSecret)
+
+	str("LISTEN_ADDRESS", &c.API.ListenAddress)
+	boolean("API_CONTAINERS", &c.API.Containers)
+	boolean("API_EXEC", &c.API.Exec)
+	list("EXEC_ALLOWED", &c.API.ExecAllowed)
+	str("PUBLIC_URL", &c.API.PublicURL)
+	boolean("API_APPROVE", &c.API.Approve)
+
+	str("LOG_FORMAT", &c.Log.Format)
+	str("LOG_LEVEL", &c.Log.Level)
+
+	integer("SNAPSHOT_KEEP", &c.Retention.Snapshots)
+	integer("BUILD_LOG_KEEP", &c.Retention.BuildLogs)
+
+	duration("HTTP_TIMEOUT", &c.Timeouts.HTTP)
+	duration("REGISTRY_TIMEOUT", &c.Timeouts.Registry)
+	duration("HEALTH_TIMEOUT", &c.Timeouts.Health)
+	duration("STEP_TIMEOUT", &c.Timeouts.Step)
+	duration("EXEC_TIMEOUT", &c.Timeouts.Exec)
+
+	str("CONTAINER_CPU", &c.Limits.CPU)
+	str("CONTAINER_MEMORY", &c.Limits.Memory)
+	integer64("CONTAINER_PIDS", &c.Limits.PIDs)
+	str("CONTAINER_RESTART", &c.Limits.Restart)
+	str("HOST_MAX_CPU", &c.Limits.MaxCPU)
+	str("HOST_MAX_MEMORY", &c.Limits.MaxMemory)
+	integer64("HOST_MAX_PIDS", &c.Limits.MaxPIDs)
+
+	str("PORT_RANGE", &c.Ports.Range)
+
+	boolean("PROXY", &c.Proxy.Enabled)
+	str("PROXY_NETWORK", &c.Proxy.Network)
+	str("PROXY_HTTP_ADDR", &c.Proxy.HTTPAddr)
+	str("PROXY_HTTPS_ADDR", &c.Proxy.HTTPSAddr)
+	str("PROXY_TLS", &c.Proxy.TLS)
+	str("PROXY_CERT_DIR", &c.Proxy.CertDir)
+	str("PROXY_ACME_CACHE", &c.Proxy.ACMECache)
+	str("PROXY_ACME_EMAIL", &c.Proxy.ACMEEmail)
+	str("PROXY_ACME_DIRECTORY", &c.Proxy.ACMEDirectory)
+
+	str("GITHUB_API_URL", &c.GitHub.APIURL)
+	boolean("GITHUB_COMMIT_STATUS", &c.GitHub.CommitStatus)
+
+	list("REGISTRY_INSECURE", &c.Registry.Insecure)
+
+	str("SELF_CONTAINER_NAME", &c.Self.ContainerName)
+	str("SELF_HEALTH_URL", &c.Self.HealthURL)
+
+	str("GITOPS_REPO", &c.GitOps.Repo)
+	str("GITOPS_PATH", &c.GitOps.Path)
+	boolean("GITOPS_PRUNE", &c.GitOps.Prune)
+
+	duration("APPROVAL_EXPIRY", &c.Approval.Expiry)
+
+	str("SNAPSHOT_IMAGE", &c.SnapshotImage)
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every setting that is missing or out of range.
+func (c *Config) Validate() error {
+
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.PollInterval < time.Second {
+		fail("poll_interval: %s is shorter than 1s", c.PollInterval)
+	}
+	if c.ReconcileInterval < time.Second {
+		fail("reconcile_interval: %s is shorter than 1s", c.ReconcileInterval)
+	}
+	if c.Workers < 1 {
+		fail("workers: must be at least 1, got %d", c.Workers)
+	}
+
+	for name, p := range map[string]string{
+		"paths.repos":     c.Paths.Repos,
+		"paths.services":  c.Paths.Services,
+		"paths.ports":     c.Paths.Ports,
+		"paths.staging":   c.Paths.Staging,
+		"paths.download":  c.Paths.Download,
+		"paths.snapshots": c.Paths.Snapshots,
+	} {
+		if p == "" {
+			fail("%s: is required", name)
+		}
+	}
+
+	if c.Cove.Address == "" {
+		fail("cove.address: is required")
+	}
+	if _, _, err := net.SplitHostPort(c.API.ListenAddress); err != nil {
+		fail("api.listen_address: %v", err)
+	}
+
+	switch strings.ToLower(c.Log.Format) {
+	case "text", "json":
+	default:
+		fail("log.format: %q is not text or json", c.Log.Format)
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("log.level: %q is not debug, info, warn or error", c.Log.Level)
+	}
+
+	if c.Retention.Snapshots < 1 {
+		fail("retention.snapshots: must be at least 1, got %d", c.Retention.Snapshots)
+	}
+	if c.Retention.BuildLogs < 1 {
+		fail("retention.build_logs: must be at least 1, got %d", c.Retention.BuildLogs)
+	}
+
+	for name, d := range map[string]time.Duration{
+		"timeouts.http":     c.Timeouts.HTTP,
+		"timeouts.registry": c.Timeouts.Registry,
+		"timeouts.health":   c.Timeouts.Health,
+		"timeouts.step":     c.Timeouts.Step,
+		"timeouts.exec":     c.Timeouts.Exec,
+	} {
+		if d <= 0 {
+			fail("%s: must be positive, got %s", name, d)
+		}
+	}
+
+	if c.Approval.Expiry < 0 {
+		fail("approval.expiry: may not be negative, got %s", c.Approval.Expiry)
+	}
+
+	for name, s := range map[string]string{"limits.cpu": c.Limits.CPU, "limits.max_cpu": c.Limits.MaxCPU} {
+		if _, err := manifest.ParseCPU(s); err != nil {
+			fail("%s: %v", name, err)
+		}
+	}
+	for name, s := range map[string]string{"limits.memory": c.Limits.Memory, "limits.max_memory": c.Limits.MaxMemory} {
+		if _, err := manifest.ParseMemory(s); err != nil {
+			fail("%s: %v", name, err)
+		}
+	}
+	if c.Limits.PIDs < 0 || c.Limits.MaxPIDs < 0 {
+		fail("limits: pids may not be negative")
+	}
+	switch c.Limits.Restart {
+	case "", "no", "always", "unless-stopped", "on-failure":
+	default:
+		fail("limits.restart: unknown restart policy %q", c.Limits.Restart)
+	}
+
+	if _, _, err := c.Ports.Bounds(); err != nil {
+		fail("ports.range: %v", err)
+	}
+
+	if c.Proxy.Enabled {
+		if c.Proxy.Network == "" {
+			fail("proxy.network: is required")
+		}
+		switch c.Proxy.TLS {
+		case "":
+		case "local":
+			if c.Proxy.CertDir == "" {
+				fail("proxy.cert_dir: is required with tls: local")
+			}
+		case "acme":
+			if c.Proxy.ACMECache == "" {
+				fail("proxy.acme_cache: is required with tls: acme")
+			}
+		default:
+			fail("proxy.tls: %q is not local or acme", c.Proxy.TLS)
+		}
+	}
+
+	if c.GitHub.CommitStatus && c.GitHub.APIURL == "" {
+		fail("github.api_url: is required with commit_status")
+	}
+	if c.Self.ContainerName == "" {
+		fail("self.container_name: is required")
+	}
+	if c.SnapshotImage == "" {
+		fail("snapshot_image: is required")
+	}
+	if c.GitOps.Repo != "" {
+		parts := strings.Split(strings.TrimPrefix(c.GitOps.Repo, "https://github.com/"), "/")
+		if !strings.HasPrefix(c.GitOps.Repo, "https://github.com/") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			fail("gitops.repo: %q is not a https://github.com/owner/name url", c.GitOps.Repo)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	// Sorted so the report reads the same every run, whatever order the
+	// maps above were walked in.
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	slices.Sort(lines)
+
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(lines, "\n  "))
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env lists the variables the tests set, cleared before every case so the
+// environment running the tests does not leak in.
+var env = []string{"LIGHTHOUSE_CONFIG", "LISTEN_ADDRESS", "APP_REPO_PATH", "POLL_INTERVAL", "WORKERS", "PROXY", "PROXY_NETWORK"}
+
+func TestLoadPrecedence(t *testing.T) {
+
+	listen := func(c *Config) string { return c.API.ListenAddress }
+	repos := func(c *Config) string { return c.Paths.Repos }
+	poll := func(c *Config) string { return c.PollInterval.String() }
+	network := func(c *Config) string { return c.Proxy.Network }
+
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		get  func(*Config) string
+		want string
+	}{
+		{name: "default", get: listen, want: ":2000"},
+		{name: "file over default", file: "api:\n  listen_address: \":3000\"\n", get: listen, want: ":3000"},
+		{
+			name: "env over file",
+			file: "api:\n  listen_address: \":3000\"\n",
+			env:  map[string]string{"LISTEN_ADDRESS": ":4000"},
+			get:  listen,
+			want: ":4000",
+		},
+		{
+			name: "flag over env",
+			file: "api:\n  listen_address: \":3000\"\n",
+			env:  map[string]string{"LISTEN_ADDRESS": ":4000"},
+			args: []string{"-listen", ":5000"},
+			get:  listen,
+			want: ":5000",
+		},
+		{
+			name: "empty env keeps the file",
+			file: "api:\n  listen_address: \":3000\"\n",
+			env:  map[string]string{"LISTEN_ADDRESS": ""},
+			get:  listen,
+			want: ":3000",
+		},
+
+		// Legacy names from before the config file still apply.
+		{name: "legacy env over default", env: map[string]string{"APP_REPO_PATH": "/data/repos.json"}, get: repos, want: "/data/repos.json"},
+		{
+			name: "legacy env over file",
+			file: "paths:\n  repos: /etc/repos.json\n",
+			env:  map[string]string{"APP_REPO_PATH": "/data/repos.json"},
+			get:  repos,
+			want: "/data/repos.json",
+		},
+		{
+			name: "duration through every layer",
+			file: "poll_interval: 30s\n",
+			env:  map[string]string{"POLL_INTERVAL": "1m"},
+			args: []string{"-poll-interval", "2m"},
+			get:  poll,
+			want: "2m0s",
+		},
+		{
+			name: "section left out of the file keeps its defaults",
+			file: "proxy:\n  enabled: true\n",
+			get:  network,
+			want: "spark",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, key := range env {
+			t.Setenv(key, "")
+		}
+		for k, v := range tt.env {
+			t.Setenv(k, v)
+		}
+
+		args := tt.args
+		if tt.file != "" {
+			path := filepath.Join(t.TempDir(), FileName)
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args = append([]string{"-config", path}, args...)
+		}
+
+		cfg, err := Load(args)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tt.get(cfg); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+
+	for _, key := range env {
+		t.Setenv(key, "")
+	}
+	path := filepath.Join(t.TempDir(), "custom.yaml")
+	if err := os.WriteFile(path, []byte("workers: 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LIGHTHOUSE_CONFIG", path)
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Workers != 4 || cfg.File() != path {
+		t.Errorf("workers %d from %q, want 4 from %q", cfg.Workers, cfg.File(), path)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "unknown file key", file: "workerz: 2\n", err: "field workerz not found"},
+		{name: "env not a number", env: map[string]string{"WORKERS": "many"}, err: `WORKERS: "many" is not a number`},
+		{name: "env not a duration", env: map[string]string{"POLL_INTERVAL": "10"}, err: "POLL_INTERVAL"},
+		{name: "env not a bool", env: map[string]string{"PROXY": "on"}, err: "PROXY"},
+		{name: "unknown flag", args: []string{"-verbose"}, err: "verbose"},
+		{name: "stray argument", args: []string{"start"}, err: `unexpected argument "start"`},
+		{name: "invalid after every layer", env: map[string]string{"LISTEN_ADDRESS": "2000"}, err: "api.listen_address"},
+	}
+
+	for _, tt := range tests {
+		for _, key := range env {
+			t.Setenv(key, "")
+		}
+		for k, v := range tt.env {
+			t.Setenv(k, v)
+		}
+
+		args := tt.args
+		if tt.file != "" {
+			path := filepath.Join(t.TempDir(), FileName)
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args = append([]string{"-config", path}, args...)
+		}
+
+		_, err := Load(args)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		err    string
+	}{
+		{"listen address without a port", func(c *Config) { c.API.ListenAddress = "localhost" }, "api.listen_address"},
+		{"poll interval too short", func(c *Config) { c.PollInterval = 500 * time.Millisecond }, "poll_interval"},
+		{"no workers", func(c *Config) { c.Workers = 0 }, "workers"},
+		{"missing path", func(c *Config) { c.Paths.Staging = "" }, "paths.staging"},
+		{"log level", func(c *Config) { c.Log.Level = "trace" }, "log.level"},
+		{"zero timeout", func(c *Config) { c.Timeouts.Exec = 0 }, "timeouts.exec"},
+		{"memory limit", func(c *Config) { c.Limits.Memory = "lots" }, "limits.memory"},
+		{"restart policy", func(c *Config) { c.Limits.Restart = "sometimes" }, "limits.restart"},
+		{"port range", func(c *Config) { c.Ports.Range = "21000-20000" }, "ports.range"},
+		{"proxy without network", func(c *Config) { c.Proxy.Enabled = true; c.Proxy.Network = "" }, "proxy.network"},
+		{"proxy tls", func(c *Config) { c.Proxy.Enabled = true; c.Proxy.TLS = "self-signed" }, "proxy.tls"},
+		{"gitops repo", func(c *Config) { c.GitOps.Repo = "https://gitlab.com/owner/infra" }, "gitops.repo"},
+	}
+
+	for _, tt := range tests {
+		c := Default()
+		tt.change(c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.err)
+		}
+	}
+
+	// Every problem is reported at once.
+	c := Default()
+	c.Workers = 0
+	c.Log.Format = "xml"
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "workers") || !strings.Contains(err.Error(), "log.format") {
+		t.Errorf("combined error = %v", err)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"github.com/joho/godotenv"
 )
 
-func Load() (string, error) {
+// LoadEnvFile loads .env from the working directory or the vault into the
+// environment, where Load picks up its overrides and the Cove secret.
+func LoadEnvFile() (string, error) {
 
 	if err := godotenv.Load(".env"); err == nil {
 		return ".env", nil
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// live lists the settings a reload applies to the running daemon. A key
+// ending in a dot covers the whole section. Everything else is read once at
+// startup, so changing it needs a restart.
+var live = []string{
+	"poll_interval",
+	"reconcile_interval",
+	"workers",
+	"log.level",
+	"api.exec_allowed",
+	"retention.snapshots",
+	"timeouts.health",
+	"timeouts.step",
+	"timeouts.exec",
+	"limits.",
+	"self.health_url",
+	"snapshot_image",
+	"approval.expiry",
+}
+
+// Store holds the running config. Reload swaps in a new one, so readers
+// should call Current each time rather than keep the result.
+type Store struct {
+	args []string
+	cur  atomic.Pointer[Config]
+
+	// mu serialises reloads.
+	mu sync.Mutex
+}
+
+// NewStore returns a store running cfg. args are the command line flags cfg
+// was loaded with, read again on every reload.
+func NewStore(cfg *Config, args []string) *Store {
+
+	s := &Store{args: args}
+	s.cur.Store(cfg)
+	return s
+}
+
+// Current returns the running config. It must not be modified.
+func (s *Store) Current() *Config {
+	return s.cur.Load()
+}
+
+// Reload loads the config again and applies the settings that can change
+// while running. It returns the keys it applied and the keys that changed
+// but only take effect after a restart. An invalid config is rejected with
+// an error and the running config is kept.
+func (s *Store) Reload() (applied []string, restart []string, err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next, err := Load(s.args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cur := s.Current()
+	merged := *cur
+	diff(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(next).Elem(), "", func(key string, dst, src reflect.Value) {
+		if !isLive(key) {
+			restart = append(restart, key)
+			return
+		}
+		dst.Set(src)
+		applied = append(applied, key)
+	})
+
+	// A config file created or removed since startup is only picked up by
+	// a restart, like every other path.
+	if next.file != cur.file {
+		restart = append(restart, "config file")
+	}
+
+	if len(applied) > 0 {
+		s.cur.Store(&merged)
+	}
+
+	return applied, restart, nil
+}
+
+// diff calls changed for every setting that differs between a and b, with
+// its key as written in the config file.
+func diff(a, b reflect.Value, prefix string, changed func(key string, a, b reflect.Value)) {
+
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+
+		key := prefix + name
+		if f.Type.Kind() == reflect.Struct {
+			diff(a.Field(i), b.Field(i), key+".", changed)
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed(key, a.Field(i), b.Field(i))
+		}
+	}
+}
+
+func isLive(key string) bool {
+
+	for _, l := range live {
+		if key == l || (strings.HasSuffix(l, ".") && strings.HasPrefix(key, l)) {
+			return true
+		}
+	}
+
+	return false
+}
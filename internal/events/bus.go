@@ -0,0 +1,212 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindLog           Kind = "log"
+	KindPhase         Kind = "phase"
+	KindBuildStarted  Kind = "build.started"
+	KindBuildFinished Kind = "build.finished"
+
+	KindHealthCheckFailed Kind = "healthcheck.failed"
+	KindRollback          Kind = "rollback"
+	KindRepoBroken        Kind = "repo.broken"
+	KindGitHubAuthFailed  Kind = "github.auth_failed"
+
+	// Commits of repos that require approval.
+	KindApprovalPending Kind = "approval.pending"
+	KindApprovalExpired Kind = "approval.expired"
+
+	// Container lifecycle, from the Docker event stream.
+	KindContainerDied      Kind = "container.died"
+	KindContainerOOM       Kind = "container.oom"
+	KindContainerUnhealthy Kind = "container.unhealthy"
+	KindContainerRestarted Kind = "container.restarted"
+	KindContainerStopped   Kind = "container.stopped"
+	KindContainerCrashLoop Kind = "container.crash_loop"
+)
+
+// Number of events a subscriber may fall behind before events are dropped.
+const subscriberBuffer = 256
+
+type Event struct {
+	Kind    Kind   `json:"kind"`
+	BuildID string `json:"buildId"`
+	Repo    string `json:"repo"`
+	// Container is set on container lifecycle events.
+	Container string    `json:"container,omitempty"`
+	SHA       string    `json:"sha,omitempty"`
+	Phase     string    `json:"phase,omitempty"`
+	Line      string    `json:"line,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// IsContainer reports whether this event comes from the Docker event stream.
+func (e Event) IsContainer() bool {
+	switch e.Kind {
+	case KindContainerDied, KindContainerOOM, KindContainerUnhealthy, KindContainerRestarted, KindContainerStopped, KindContainerCrashLoop:
+		return true
+	}
+	return false
+}
+
+// Finished reports whether this event closes out a build.
+func (e Event) Finished() bool {
+	return e.Kind == KindBuildFinished
+}
+
+type subscriber struct {
+	buildID string
+	// accept limits the events the subscriber gets, nil for every one.
+	accept func(Event) bool
+	ch     chan Event
+}
+
+// Bus fans build events out to every subscriber and keeps the
+// events of the most recent builds so they can be replayed.
+type Bus struct {
+	mu      sync.RWMutex
+	subs    map[int]*subscriber
+	nextID  int
+	history map[string][]Event
+	order   []string
+	// keep is the number of builds whose events are kept for late
+	// subscribers.
+	keep int
+}
+
+// NewBus returns a bus replaying the events of the last keep builds.
+func NewBus(keep int) *Bus {
+	return &Bus{
+		subs:    make(map[int]*subscriber),
+		history: make(map[string][]Event),
+		keep:    keep,
+	}
+}
+
+func (b *Bus) Publish(e Event) {
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.BuildID != "" {
+		if _, ok := b.history[e.BuildID]; !ok {
+			b.order = append(b.order, e.BuildID)
+			if len(b.order) > b.keep {
+				delete(b.history, b.order[0])
+				b.order = b.order[1:]
+			}
+		}
+		b.history[e.BuildID] = append(b.history[e.BuildID], e)
+	}
+
+	for _, s := range b.subs {
+		if s.buildID != "" && s.buildID != e.BuildID {
+			continue
+		}
+		if s.accept != nil && !s.accept(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			// Slow subscriber, drop rather than stall the build.
+		}
+	}
+}
+
+// Subscribe returns a channel receiving events for buildID, or for every
+// build when buildID is empty. Events already recorded for buildID are
+// replayed first. The returned func must be called to release the channel.
+func (b *Bus) Subscribe(buildID string) (<-chan Event, func()) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	replay := b.history[buildID]
+	s := &subscriber{
+		buildID: buildID,
+		ch:      make(chan Event, subscriberBuffer+len(replay)),
+	}
+	for _, e := range replay {
+		s.ch <- e
+	}
+
+	return s.ch, b.add(s)
+}
+
+// SubscribeContainers returns a channel receiving only container lifecycle
+// events, so a build streaming log lines cannot crowd them out. The
+// returned func must be called to release the channel.
+func (b *Bus) SubscribeContainers() (<-chan Event, func()) {
+	return b.subscribeTo(Event.IsContainer)
+}
+
+// SubscribeLifecycle returns a channel receiving every event but log lines,
+// so the start and end of a build cannot be crowded out by its output. The
+// returned func must be called to release the channel.
+func (b *Bus) SubscribeLifecycle() (<-chan Event, func()) {
+	return b.subscribeTo(func(e Event) bool { return e.Kind != KindLog })
+}
+
+func (b *Bus) subscribeTo(accept func(Event) bool) (<-chan Event, func()) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &subscriber{
+		accept: accept,
+		ch:     make(chan Event, subscriberBuffer),
+	}
+
+	return s.ch, b.add(s)
+}
+
+// add registers s and returns the func removing it. Must be called with
+// b.mu held.
+func (b *Bus) add(s *subscriber) func() {
+
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = s
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+		})
+	}
+
+	return cancel
+}
+
+// History returns a copy of the recorded events for buildID.
+func (b *Bus) History(buildID string) []Event {
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return append([]Event(nil), b.history[buildID]...)
+}
+
+// Builds returns the IDs of the builds still held in history, oldest first.
+func (b *Bus) Builds() []string {
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return append([]string(nil), b.order...)
+}
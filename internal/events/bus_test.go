@@ -0,0 +1,78 @@
+package events
+
+import "testing"
+
+// drain returns the kinds of the events waiting on ch.
+func drain(ch <-chan Event) []Kind {
+
+	var kinds []Kind
+	for {
+		select {
+		case e := <-ch:
+			kinds = append(kinds, e.Kind)
+		default:
+			return kinds
+		}
+	}
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+
+	b := NewBus(10)
+	all, cancelAll := b.Subscribe("")
+	defer cancelAll()
+	lifecycle, cancelLifecycle := b.SubscribeLifecycle()
+	defer cancelLifecycle()
+	containers, cancelContainers := b.SubscribeContainers()
+	defer cancelContainers()
+
+	// Nothing reads while the build runs, so its log lines overflow every
+	// subscription that takes them.
+	b.Publish(Event{Kind: KindBuildStarted, BuildID: "b1"})
+	for i := 0; i < 2*subscriberBuffer; i++ {
+		b.Publish(Event{Kind: KindLog, BuildID: "b1", Line: "step"})
+	}
+	b.Publish(Event{Kind: KindContainerDied, Container: "app"})
+	b.Publish(Event{Kind: KindBuildFinished, BuildID: "b1", Status: "success"})
+
+	got := drain(lifecycle)
+	want := []Kind{KindBuildStarted, KindContainerDied, KindBuildFinished}
+	if len(got) != len(want) {
+		t.Fatalf("lifecycle got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("lifecycle got %v, want %v", got, want)
+		}
+	}
+
+	if got := drain(containers); len(got) != 1 || got[0] != KindContainerDied {
+		t.Errorf("containers got %v, want [%s]", got, KindContainerDied)
+	}
+
+	got = drain(all)
+	if len(got) != subscriberBuffer || got[len(got)-1] == KindBuildFinished {
+		t.Errorf("unfiltered subscriber kept %d events, want the first %d with the end dropped", len(got), subscriberBuffer)
+	}
+}
+
+func TestSubscribeReplaysBuild(t *testing.T) {
+
+	b := NewBus(1)
+	b.Publish(Event{Kind: KindBuildStarted, BuildID: "b1"})
+	b.Publish(Event{Kind: KindLog, BuildID: "b1", Line: "step"})
+	b.Publish(Event{Kind: KindBuildStarted, BuildID: "b2"})
+
+	if h := b.History("b1"); len(h) != 0 {
+		t.Errorf("b1 kept %d events past the last build", len(h))
+	}
+
+	ch, cancel := b.Subscribe("b2")
+	defer cancel()
+	b.Publish(Event{Kind: KindBuildFinished, BuildID: "b2"})
+	b.Publish(Event{Kind: KindBuildFinished, BuildID: "b3"})
+
+	if got := drain(ch); len(got) != 2 || got[0] != KindBuildStarted || got[1] != KindBuildFinished {
+		t.Errorf("b2 subscriber got %v", got)
+	}
+}
@@ -0,0 +1,28 @@
+package forge
+
+import (
+	"context"
+)
+
+type State string
+
+const (
+	StatePending State = "pending"
+	StateSuccess State = "success"
+	StateFailure State = "failure"
+	StateError   State = "error"
+)
+
+// Status is a deployment state attached to a single commit.
+type Status struct {
+	State       State
+	TargetURL   string
+	Description string
+	Context     string
+}
+
+// Forge is the code host Lighthouse reports deployments back to. repo is
+// the "owner/name" form of the repository.
+type Forge interface {
+	SetCommitStatus(ctx context.Context, repo string, sha string, status Status) error
+}
@@ -0,0 +1,83 @@
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const DefaultGitHubAPI = "https://api.github.com"
+
+// GitHub posts commit statuses through the GitHub REST API. BaseURL can be
+// pointed at GitHub Enterprise or a local fake server.
+type GitHub struct {
+	BaseURL string
+	HTTP    *http.Client
+	Token   func() string
+}
+
+func NewGitHub(baseURL string, http *http.Client, token func() string) *GitHub {
+
+	if baseURL == "" {
+		baseURL = DefaultGitHubAPI
+	}
+
+	return &GitHub{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTP:    http,
+		Token:   token,
+	}
+}
+
+func (g *GitHub) SetCommitStatus(ctx context.Context, repo string, sha string, status Status) error {
+
+	payload := map[string]string{
+		"state":       string(status.State),
+		"description": truncate(status.Description, 140),
+		"context":     status.Context,
+	}
+	if status.TargetURL != "" {
+		payload["target_url"] = status.TargetURL
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/statuses/%s", g.BaseURL, repo, sha)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+g.Token())
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("set commit status on %s@%s: %s: %s", repo, sha, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// truncate shortens s to n characters, which is how GitHub limits a
+// description, cutting between runes so the result stays valid UTF-8.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-3]) + "..."
+}
@@ -0,0 +1,126 @@
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fakeGitHub records the commit statuses posted to it.
+type fakeGitHub struct {
+	srv      *httptest.Server
+	statuses chan postedStatus
+}
+
+type postedStatus struct {
+	Path    string
+	Auth    string
+	Payload map[string]string
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+
+	t.Helper()
+
+	f := &fakeGitHub{statuses: make(chan postedStatus, 16)}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/repos/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var payload map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decode status: %v", err)
+		}
+		if strings.Contains(r.URL.Path, "/denied/") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "Resource not accessible by personal access token"}`))
+			return
+		}
+		f.statuses <- postedStatus{Path: r.URL.Path, Auth: r.Header.Get("Authorization"), Payload: payload}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(f.srv.Close)
+
+	return f
+}
+
+func (f *fakeGitHub) client() *GitHub {
+	return NewGitHub(f.srv.URL+"/", f.srv.Client(), func() string { return "pat" })
+}
+
+func TestSetCommitStatus(t *testing.T) {
+
+	f := newFakeGitHub(t)
+
+	err := f.client().SetCommitStatus(context.Background(), "LSariol/app", "abc123", Status{
+		State:       StateSuccess,
+		TargetURL:   "https://lighthouse.lan/builds/b1/logs",
+		Description: "Deployed by Lighthouse",
+		Context:     statusContext,
+	})
+	if err != nil {
+		t.Fatalf("SetCommitStatus: %v", err)
+	}
+
+	got := <-f.statuses
+	if got.Path != "/repos/LSariol/app/statuses/abc123" {
+		t.Errorf("path = %q", got.Path)
+	}
+	if got.Auth != "token pat" {
+		t.Errorf("Authorization = %q", got.Auth)
+	}
+	want := map[string]string{
+		"state":       "success",
+		"target_url":  "https://lighthouse.lan/builds/b1/logs",
+		"description": "Deployed by Lighthouse",
+		"context":     "lighthouse/deploy",
+	}
+	for k, v := range want {
+		if got.Payload[k] != v {
+			t.Errorf("%s = %q, want %q", k, got.Payload[k], v)
+		}
+	}
+}
+
+func TestSetCommitStatusError(t *testing.T) {
+
+	f := newFakeGitHub(t)
+
+	err := f.client().SetCommitStatus(context.Background(), "LSariol/denied", "abc123", Status{State: StatePending, Context: statusContext})
+	if err == nil {
+		t.Fatal("SetCommitStatus succeeded on a 403")
+	}
+	if !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "not accessible") {
+		t.Errorf("error does not carry GitHub's answer: %v", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"one too long", 11, "one too ..."},
+		{"déploiement échoué", 10, "déploie..."},
+		{"构建失败构建失败", 6, "构建失..."},
+	}
+
+	for _, tt := range tests {
+		got := truncate(tt.in, tt.n)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) is not valid UTF-8", tt.in, tt.n)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+)
+
+const statusContext = "lighthouse/deploy"
+
+// Reporter mirrors build events onto commit statuses.
+type Reporter struct {
+	Forge Forge
+
+	// Resolve maps a watched repo's display name to its "owner/name".
+	Resolve func(repo string) (string, bool)
+
+	// PublicURL is where the Lighthouse API can be reached from a browser,
+	// used to link each status to its build log. Empty leaves statuses unlinked.
+	PublicURL string
+}
+
+func NewReporter(f Forge, resolve func(string) (string, bool), publicURL string) *Reporter {
+	return &Reporter{
+		Forge:     f,
+		Resolve:   resolve,
+		PublicURL: strings.TrimSuffix(publicURL, "/"),
+	}
+}
+
+// Start subscribes to bus and reports build events until ctx is cancelled.
+// Events published after Start returns are not missed.
+func (r *Reporter) Start(ctx context.Context, bus *events.Bus) {
+
+	// Log lines are left out so a chatty build cannot push its own end
+	// out of the subscription.
+	ch, cancel := bus.SubscribeLifecycle()
+	go func() {
+		defer cancel()
+		r.run(ctx, ch)
+	}()
+}
+
+func (r *Reporter) run(ctx context.Context, ch <-chan events.Event) {
+
+	// Statuses go out one at a time so pending never lands after success,
+	// while the bus subscription keeps being drained.
+	type job struct {
+		event  events.Event
+		status Status
+	}
+	jobs := make(chan job, 64)
+	defer close(jobs)
+
+	go func() {
+		for j := range jobs {
+			r.report(ctx, j.event, j.status)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			status, ok := r.statusFor(e)
+			if !ok {
+				continue
+			}
+			jobs <- job{event: e, status: status}
+		}
+	}
+}
+
+func (r *Reporter) statusFor(e events.Event) (Status, bool) {
+
+	status := Status{Context: statusContext}
+	if r.PublicURL != "" && e.BuildID != "" {
+		status.TargetURL = fmt.Sprintf("%s/builds/%s/logs", r.PublicURL, e.BuildID)
+	}
+
+	switch e.Kind {
+	case events.KindBuildStarted:
+		status.State = StatePending
+		status.Description = "Deploying " + e.BuildID
+	case events.KindBuildFinished:
+		if e.Status == "success" {
+			status.State = StateSuccess
+			status.Description = "Deployed by Lighthouse"
+		} else {
+			status.State = StateFailure
+			status.Description = "Deploy failed: " + e.Message
+		}
+	case events.KindRollback:
+		status.State = StateFailure
+		status.Description = "Rolled back: " + e.Message
+	default:
+		return Status{}, false
+	}
+
+	return status, true
+}
+
+func (r *Reporter) report(ctx context.Context, e events.Event, status Status) {
+
+	if e.SHA == "" {
+		return
+	}
+
+	repo, ok := r.Resolve(e.Repo)
+	if !ok {
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	if err := r.Forge.SetCommitStatus(reqCtx, repo, e.SHA, status); err != nil {
+		slog.Warn("failed to report commit status", "repo", e.Repo, "sha", e.SHA, "build_id", e.BuildID, "state", status.State, "err", err)
+	}
+}
@@ -0,0 +1,97 @@
+package forge
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+)
+
+func resolveApp(repo string) (string, bool) {
+	if repo == "app" {
+		return "LSariol/app", true
+	}
+	return "", false
+}
+
+func TestReporterStatusFor(t *testing.T) {
+
+	r := NewReporter(nil, resolveApp, "https://lighthouse.lan/")
+
+	tests := []struct {
+		event events.Event
+		want  State
+		desc  string
+	}{
+		{events.Event{Kind: events.KindBuildStarted, BuildID: "b1"}, StatePending, "Deploying b1"},
+		{events.Event{Kind: events.KindBuildFinished, BuildID: "b1", Status: "success"}, StateSuccess, "Deployed by Lighthouse"},
+		{events.Event{Kind: events.KindBuildFinished, BuildID: "b1", Status: "failed", Message: "exit 1"}, StateFailure, "Deploy failed: exit 1"},
+		{events.Event{Kind: events.KindRollback, BuildID: "b1", Message: "daemon unhealthy"}, StateFailure, "Rolled back: daemon unhealthy"},
+	}
+
+	for _, tt := range tests {
+		got, ok := r.statusFor(tt.event)
+		if !ok {
+			t.Errorf("%s: no status", tt.event.Kind)
+			continue
+		}
+		if got.State != tt.want || got.Description != tt.desc {
+			t.Errorf("%s: got %s %q, want %s %q", tt.event.Kind, got.State, got.Description, tt.want, tt.desc)
+		}
+		if got.TargetURL != "https://lighthouse.lan/builds/b1/logs" {
+			t.Errorf("%s: target URL = %q", tt.event.Kind, got.TargetURL)
+		}
+	}
+
+	for _, kind := range []events.Kind{events.KindLog, events.KindPhase, events.KindContainerDied} {
+		if _, ok := r.statusFor(events.Event{Kind: kind, BuildID: "b1"}); ok {
+			t.Errorf("%s produced a status", kind)
+		}
+	}
+}
+
+func TestReporterStart(t *testing.T) {
+
+	f := newFakeGitHub(t)
+	bus := events.NewBus(10)
+	r := NewReporter(f.client(), resolveApp, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx, bus)
+
+	bus.Publish(events.Event{Kind: events.KindBuildStarted, BuildID: "b1", Repo: "app", SHA: "abc123"})
+
+	// A build logging more than a subscriber buffers must not push its
+	// end out.
+	for i := 0; i < 1000; i++ {
+		bus.Publish(events.Event{Kind: events.KindLog, BuildID: "b1", Repo: "app", SHA: "abc123", Line: "step"})
+	}
+
+	select {
+	case first := <-f.statuses:
+		if first.Payload["state"] != "pending" || first.Path != "/repos/LSariol/app/statuses/abc123" {
+			t.Fatalf("first status = %+v", first)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pending status posted")
+	}
+
+	// Unknown repos are not reported.
+	bus.Publish(events.Event{Kind: events.KindBuildFinished, BuildID: "b2", Repo: "other", SHA: "def456", Status: "success"})
+	bus.Publish(events.Event{Kind: events.KindBuildFinished, BuildID: "b1", Repo: "app", SHA: "abc123", Status: "failed", Message: "health check failed"})
+
+	select {
+	case got := <-f.statuses:
+		if got.Payload["state"] != "failure" || !strings.Contains(got.Payload["description"], "health check failed") {
+			t.Fatalf("final status = %+v", got)
+		}
+		if got.Path != "/repos/LSariol/app/statuses/abc123" {
+			t.Fatalf("final status posted to %s", got.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no failure status posted")
+	}
+}
@@ -0,0 +1,232 @@
+package gitops
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/pathfilter"
+	"github.com/LSariol/LightHouse/internal/registry"
+	"github.com/LSariol/LightHouse/internal/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+// EmptyMarker is a file that declares the definitions directory empty on
+// purpose. Without it no definitions at all is taken for a mistake, such as
+// a wrong gitops.path or a bad merge, rather than for a request to stop
+// managing everything.
+const EmptyMarker = ".lighthouse-empty"
+
+// ErrNoDefinitions is returned by ReadArchive when it finds neither a
+// definition nor an EmptyMarker.
+var ErrNoDefinitions = errors.New("no definitions found, add a " + EmptyMarker + " file to stop managing everything")
+
+// Definition is one repo or managed service declared in the infra repo, a
+// YAML file of its own. Exactly one of Repo, Image, Compose or Manifest is
+// set. See the GitOps section of the README for an example of each.
+type Definition struct {
+	// Name is the display name. Empty uses the file name.
+	Name string `yaml:"name"`
+
+	// Repo is the GitHub url of a repo to watch and build, and Dir the
+	// directory of it this service is built from when it is a monorepo.
+	Repo string `yaml:"repo"`
+	Dir  string `yaml:"dir"`
+
+	// Image, Compose and Manifest declare a managed service, see
+	// models.ManagedService.
+	Image                string `yaml:"image"`
+	Compose              string `yaml:"compose"`
+	Manifest             string `yaml:"manifest"`
+	WatchImage           bool   `yaml:"watch_image"`
+	TagPolicy            string `yaml:"tag_policy"`
+	RegistryAuthFromCove string `yaml:"registry_auth_from_cove"`
+
+	DependsOn []string `yaml:"depends_on"`
+	// Desired is running or stopped. Empty means running.
+	Desired string `yaml:"desired"`
+
+	// PollInterval and Windows schedule a repo, Paths and IgnorePaths
+	// filter the changes it deploys on, and Approval "required" holds its
+	// commits for an operator, see models.WatchedRepo.
+	PollInterval string   `yaml:"poll_interval"`
+	Windows      []string `yaml:"windows"`
+	Paths        []string `yaml:"paths"`
+	IgnorePaths  []string `yaml:"ignore_paths"`
+	Approval     string   `yaml:"approval"`
+
+	// File is the path in the infra repo the definition was read from.
+	File string `yaml:"-"`
+}
+
+// IsRepo reports whether d declares a watched repo rather than a service.
+func (d Definition) IsRepo() bool {
+	return d.Repo != ""
+}
+
+// Parse reads the definition in file.
+func Parse(file string, data []byte) (Definition, error) {
+
+	var d Definition
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&d); err != nil && !errors.Is(err, io.EOF) {
+		return Definition{}, fmt.Errorf("%s: %w", file, err)
+	}
+
+	d.File = file
+	if d.Name == "" {
+		d.Name = strings.TrimSuffix(path.Base(file), path.Ext(file))
+	}
+
+	if err := d.Validate(); err != nil {
+		return Definition{}, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return d, nil
+}
+
+func (d Definition) Validate() error {
+
+	sources := 0
+	for _, s := range []string{d.Repo, d.Image, d.Compose, d.Manifest} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of repo, image, compose or manifest is required")
+	}
+
+	if d.IsRepo() && (d.WatchImage || d.TagPolicy != "" || d.RegistryAuthFromCove != "") {
+		return fmt.Errorf("watch_image, tag_policy and registry_auth_from_cove apply to services, not repos")
+	}
+	if !d.IsRepo() && d.Dir != "" {
+		return fmt.Errorf("dir applies to repos, not services")
+	}
+	if _, err := models.CleanDir(d.Dir); err != nil {
+		return err
+	}
+	if !d.IsRepo() && (d.PollInterval != "" || len(d.Windows) > 0 || len(d.Paths) > 0 || len(d.IgnorePaths) > 0 || d.Approval != "") {
+		return fmt.Errorf("poll_interval, windows, paths, ignore_paths and approval apply to repos, not services")
+	}
+	if err := (pathfilter.Filter{Paths: d.Paths, Ignore: d.IgnorePaths}).Validate(); err != nil {
+		return err
+	}
+	if d.Approval != "" && d.Approval != models.ApprovalRequired {
+		return fmt.Errorf("approval: %q is not %q", d.Approval, models.ApprovalRequired)
+	}
+	if _, err := schedule.ParseAll(d.Windows); err != nil {
+		return err
+	}
+	if d.Compose != "" && d.TagPolicy != "" {
+		return fmt.Errorf("tag_policy applies to image and manifest services")
+	}
+	if d.TagPolicy != "" {
+		if _, err := registry.ParsePolicy(d.TagPolicy); err != nil {
+			return err
+		}
+	}
+
+	switch d.Desired {
+	case "", "running", "stopped":
+	default:
+		return fmt.Errorf("desired: %q is not running or stopped", d.Desired)
+	}
+
+	if slices.Contains(d.DependsOn, d.Name) {
+		return fmt.Errorf("%s cannot depend on itself", d.Name)
+	}
+
+	return nil
+}
+
+// ReadArchive reads every definition under dir in a zip of the infra repo,
+// as GitHub serves it with everything under one top level directory. All
+// problems are reported together so one push can fix them all. An archive
+// without any definition is only accepted with an EmptyMarker in dir.
+func ReadArchive(data []byte, dir string) ([]Definition, error) {
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("open infra archive: %w", err)
+	}
+
+	dir = strings.Trim(dir, "/")
+
+	var defs []Definition
+	var errs []error
+	names := map[string]string{}
+	marked := false
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		// Drop the "owner-repo-sha/" GitHub puts everything under.
+		_, file, ok := strings.Cut(f.Name, "/")
+		if !ok {
+			continue
+		}
+		if dir != "" && !strings.HasPrefix(file, dir+"/") {
+			continue
+		}
+		if file == path.Join(dir, EmptyMarker) {
+			marked = true
+			continue
+		}
+		if ext := path.Ext(file); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		data, err := readZipFile(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+
+		d, err := Parse(file, data)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if other, ok := names[d.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: %s is already declared by %s", file, d.Name, other))
+			continue
+		}
+		names[d.Name] = file
+		defs = append(defs, d)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(defs) == 0 && !marked {
+		return nil, ErrNoDefinitions
+	}
+
+	slices.SortFunc(defs, func(a, b Definition) int {
+		return strings.Compare(a.File, b.File)
+	})
+
+	return defs, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
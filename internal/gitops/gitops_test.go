@@ -0,0 +1,197 @@
+package gitops
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// archive zips files under the top level directory GitHub puts them in.
+func archive(t *testing.T, files map[string]string) []byte {
+
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create("owner-infra-abc123/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		file string
+		data string
+		name string
+		err  string
+	}{
+		{"apps/api.yaml", "repo: https://github.com/owner/api\n", "api", ""},
+		{"apps/api.yaml", "name: backend\nrepo: https://github.com/owner/mono\ndir: services/api\n", "backend", ""},
+		{"svc/redis.yml", "image: redis:7\nwatch_image: true\n", "redis", ""},
+		{"svc/stack.yaml", "compose: stacks/stack.yml\n", "stack", ""},
+		{"svc/db.yaml", "manifest: manifests/db.yaml\ndesired: stopped\n", "db", ""},
+
+		// Exactly one source.
+		{"apps/none.yaml", "desired: running\n", "", "exactly one of"},
+		{"apps/empty.yaml", "", "", "exactly one of"},
+		{"apps/two.yaml", "repo: https://github.com/owner/api\nimage: api:latest\n", "", "exactly one of"},
+		{"apps/three.yaml", "image: a\ncompose: b\nmanifest: c\n", "", "exactly one of"},
+
+		{"apps/typo.yaml", "repo: https://github.com/owner/api\nrepos: x\n", "", "field repos not found"},
+		{"svc/dir.yaml", "image: redis:7\ndir: sub\n", "", "dir applies to repos"},
+		{"apps/escape.yaml", "repo: https://github.com/owner/api\ndir: ../etc\n", "", ".."},
+		{"svc/poll.yaml", "image: redis:7\npoll_interval: 5m\n", "", "apply to repos"},
+		{"apps/watch.yaml", "repo: https://github.com/owner/api\nwatch_image: true\n", "", "apply to services"},
+		{"svc/policy.yaml", "compose: stack.yml\ntag_policy: 2.x\n", "", "tag_policy applies"},
+		{"apps/desired.yaml", "repo: https://github.com/owner/api\ndesired: paused\n", "", "desired"},
+		{"apps/self.yaml", "repo: https://github.com/owner/api\ndepends_on: [self]\n", "", "depend on itself"},
+	}
+
+	for _, tt := range tests {
+		d, err := Parse(tt.file, []byte(tt.data))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want one containing %q", tt.file, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if d.Name != tt.name || d.File != tt.file {
+			t.Errorf("%s: name %q from %q, want %q from %q", tt.file, d.Name, d.File, tt.name, tt.file)
+		}
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		dir   string
+		want  []string
+		err   string
+	}{
+		{
+			name: "definitions sorted by file",
+			files: map[string]string{
+				"web.yaml":   "repo: https://github.com/owner/web\n",
+				"api.yml":    "repo: https://github.com/owner/api\n",
+				"README.md":  "# infra\n",
+				"redis.json": "{}",
+			},
+			want: []string{"api", "web"},
+		},
+		{
+			name: "only under dir",
+			files: map[string]string{
+				"lighthouse/api.yaml":    "repo: https://github.com/owner/api\n",
+				"lighthouse/sub/db.yaml": "image: postgres:16\n",
+				"lighthousex/other.yaml": "image: other\n",
+				"k8s/deployment.yaml":    "kind: Deployment\n",
+				"lighthouse.yaml":        "image: top\n",
+			},
+			dir:  "/lighthouse/",
+			want: []string{"api", "db"},
+		},
+		{
+			name:  "nothing is a mistake",
+			files: map[string]string{"README.md": "# infra\n"},
+			err:   ErrNoDefinitions.Error(),
+		},
+		{
+			name:  "nothing under dir is a mistake",
+			files: map[string]string{"apps/api.yaml": "repo: https://github.com/owner/api\n"},
+			dir:   "lighthouse",
+			err:   ErrNoDefinitions.Error(),
+		},
+		{
+			name:  "marked empty",
+			files: map[string]string{EmptyMarker: ""},
+			want:  []string{},
+		},
+		{
+			name: "marked empty under dir",
+			files: map[string]string{
+				"lighthouse/" + EmptyMarker: "",
+				"apps/api.yaml":             "repo: https://github.com/owner/api\n",
+			},
+			dir:  "lighthouse",
+			want: []string{},
+		},
+		{
+			name: "marker outside dir does not count",
+			files: map[string]string{
+				EmptyMarker:            "",
+				"lighthouse/README.md": "",
+			},
+			dir: "lighthouse",
+			err: ErrNoDefinitions.Error(),
+		},
+		{
+			name: "duplicate names",
+			files: map[string]string{
+				"apps/api.yaml":  "repo: https://github.com/owner/api\n",
+				"other/api.yaml": "image: api:latest\n",
+			},
+			err: "api is already declared by",
+		},
+		{
+			name: "duplicate explicit name",
+			files: map[string]string{
+				"a.yaml": "name: shared\nimage: a\n",
+				"b.yaml": "name: shared\nimage: b\n",
+			},
+			err: "shared is already declared by",
+		},
+	}
+
+	for _, tt := range tests {
+		defs, err := ReadArchive(archive(t, tt.files), tt.dir)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, d := range defs {
+			got = append(got, d.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: definitions %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Every problem is reported at once.
+	_, err := ReadArchive(archive(t, map[string]string{
+		"bad.yaml":  "image: a\ncompose: b\n",
+		"typo.yaml": "imagee: c\n",
+	}), "")
+	if err == nil || !strings.Contains(err.Error(), "bad.yaml") || !strings.Contains(err.Error(), "typo.yaml") {
+		t.Errorf("combined error = %v", err)
+	}
+	if errors.Is(err, ErrNoDefinitions) {
+		t.Errorf("invalid definitions reported as none: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// Level is the level of the default logger and can be changed at runtime.
+var Level = new(slog.LevelVar)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   = map[string]struct{}{}
+)
+
+// Setup installs the default slog logger. format is "json" or "text".
+func Setup(w io.Writer, format string, level string) error {
+
+	if err := SetLevel(level); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: Level}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(&redactHandler{inner: h}))
+	return nil
+}
+
+// SetLevel changes the level of the default logger. An empty level means info.
+func SetLevel(level string) error {
+
+	if level == "" {
+		level = "info"
+	}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	Level.Set(l)
+	return nil
+}
+
+// AddSecret registers a value that must never appear in log output.
+func AddSecret(value string) {
+
+	// Very short values would redact ordinary words.
+	if len(value) < 4 {
+		return
+	}
+
+	secretsMu.Lock()
+	secrets[value] = struct{}{}
+	secretsMu.Unlock()
+}
+
+// Redact replaces every registered secret in s.
+func Redact(s string) string {
+
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	for secret := range secrets {
+		if strings.Contains(s, secret) {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+
+	return s
+}
+
+// redactHandler scrubs registered secrets from messages and attributes
+// before handing the record to the wrapped handler.
+type redactHandler struct {
+	inner slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+
+	return h.inner.Handle(ctx, out)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = redactAttr(a)
+	}
+
+	return &redactHandler{inner: h.inner.WithAttrs(clean)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{inner: h.inner.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+
+	v := a.Value.Resolve()
+
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		clean := make([]any, len(group))
+		for i, g := range group {
+			clean[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, clean...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+		return slog.String(a.Key, Redact(fmt.Sprint(v.Any())))
+	}
+
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Writer passes output on to an underlying writer a line at a time with
+// every registered secret redacted. Lines are written whole, so several
+// Writers can share one underlying writer if it is safe for concurrent use.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+// NewWriter returns a Writer that writes to w, starting each line with prefix.
+func NewWriter(w io.Writer, prefix string) *Writer {
+	return &Writer{w: w, prefix: prefix}
+}
+
+func (rw *Writer) Write(p []byte) (int, error) {
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	rw.buf.Write(p)
+	for {
+		line, err := rw.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line, keep it until the rest arrives.
+			rw.buf.Reset()
+			rw.buf.WriteString(line)
+			break
+		}
+		if _, err := io.WriteString(rw.w, rw.prefix+Redact(line)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes any trailing output that did not end in a newline.
+func (rw *Writer) Flush() error {
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(rw.w, rw.prefix+Redact(rw.buf.String())+"\n")
+	rw.buf.Reset()
+
+	return err
+}
@@ -0,0 +1,321 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is where a repository keeps its manifest, relative to its root.
+const FileName = "lighthouse.yaml"
+
+// Manifest describes how Lighthouse should build and run a service.
+// See lighthouse.example.yaml for the meaning of each field.
+type Manifest struct {
+	Version int    `yaml:"version"`
+	Service string `yaml:"service"`
+	Image   Image  `yaml:"image"`
+	Run     Run    `yaml:"run"`
+	Deploy  Deploy `yaml:"deploy"`
+
+	// DependsOn names the repos and services that must be healthy before
+	// this service is started.
+	DependsOn []string `yaml:"depends_on"`
+}
+
+type Image struct {
+	Name  string `yaml:"name"`
+	Build Build  `yaml:"build"`
+}
+
+type Build struct {
+	Context    string   `yaml:"context"`
+	Dockerfile string   `yaml:"dockerfile"`
+	Args       []string `yaml:"args"`
+
+	// ArgsFromCove are Cove keys handed to the build as BuildKit secrets
+	// of the same id rather than as build args, so they never end up in a
+	// layer or the image history. A Dockerfile reads one with
+	// RUN --mount=type=secret,id=KEY. "ID=KEY" mounts a key under another
+	// id.
+	ArgsFromCove []string `yaml:"args_from_cove"`
+
+	// SSHKeyFromCove is the Cove key of an SSH private key served to the
+	// build by a temporary agent, for RUN --mount=type=ssh.
+	SSHKeyFromCove string `yaml:"ssh_key_from_cove"`
+
+	// Target is the stage of a multi-stage Dockerfile to build and
+	// Platform the platform to build for, such as "linux/arm64".
+	Target   string `yaml:"target"`
+	Platform string `yaml:"platform"`
+}
+
+// Empty reports whether b leaves the build as the compose file has it.
+func (b Build) Empty() bool {
+	return b.Context == "" && b.Dockerfile == "" && len(b.Args) == 0 && len(b.ArgsFromCove) == 0 && b.SSHKeyFromCove == "" && b.Target == "" && b.Platform == ""
+}
+
+// CoveSecrets maps the id of each build secret to its Cove key.
+func (b Build) CoveSecrets() map[string]string {
+
+	secrets := map[string]string{}
+	for _, entry := range b.ArgsFromCove {
+		id, key, ok := strings.Cut(entry, "=")
+		if !ok {
+			key = id
+		}
+		secrets[id] = key
+	}
+
+	return secrets
+}
+
+type Run struct {
+	Command     []string    `yaml:"command"`
+	Ports       []Port      `yaml:"ports"`
+	Volumes     []Volume    `yaml:"volumes"`
+	Env         []string    `yaml:"env"`
+	EnvFromCove []string    `yaml:"env_from_cove"`
+	Healthcheck Healthcheck `yaml:"healthcheck"`
+	Resources   Resources   `yaml:"resources"`
+}
+
+type Port struct {
+	Name          string `yaml:"name"`
+	ContainerPort int    `yaml:"container_port"`
+	Protocol      string `yaml:"protocol"`
+	Public        bool   `yaml:"public"`
+
+	// HostPort pins a public port to a host port. Left out, Lighthouse
+	// assigns one.
+	HostPort int `yaml:"host_port"`
+}
+
+type Volume struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mount_path"`
+	Type      string `yaml:"type"`
+	Size      string `yaml:"size"`
+
+	// Backup snapshots a persistent volume before each deploy that changes
+	// the image.
+	Backup bool `yaml:"backup"`
+}
+
+// Persistent reports whether v is a named volume Lighthouse owns.
+func (v Volume) Persistent() bool {
+	return v.Type == "" || v.Type == "persistent"
+}
+
+type Healthcheck struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Retries  int           `yaml:"retries"`
+}
+
+// Resources are the limits put on the container. CPU is in cores ("0.5")
+// or millicores ("500m"), Memory in bytes with an optional Ki, Mi, Gi or
+// Ti suffix (K, M, G and T mean the same), and PIDs caps the process count.
+type Resources struct {
+	CPU    string `yaml:"cpu"`
+	Memory string `yaml:"memory"`
+	PIDs   int64  `yaml:"pids"`
+}
+
+type Deploy struct {
+	Strategy string            `yaml:"strategy"`
+	Restart  string            `yaml:"restart"`
+	Labels   map[string]string `yaml:"labels"`
+	Networks []string          `yaml:"networks"`
+
+	// Routes are served by the Lighthouse proxy, which sends them to the
+	// port named http.
+	Routes []Route `yaml:"routes"`
+}
+
+// Route matches requests by hostname, path prefix or both.
+type Route struct {
+	Host string `yaml:"host"`
+	Path string `yaml:"path"`
+}
+
+// HTTPPort returns the port named http, which routes are sent to.
+func (m *Manifest) HTTPPort() (Port, bool) {
+	for _, p := range m.Run.Ports {
+		if p.Name == "http" {
+			return p, true
+		}
+	}
+	return Port{}, false
+}
+
+func Load(path string) (*Manifest, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return m, nil
+}
+
+func Parse(data []byte) (*Manifest, error) {
+
+	var m Manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (m *Manifest) Validate() error {
+
+	if m.Version != 1 {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.Service == "" {
+		return fmt.Errorf("manifest: service is required")
+	}
+
+	if err := m.Image.Build.validate(); err != nil {
+		return fmt.Errorf("manifest: build: %w", err)
+	}
+
+	for _, p := range m.Run.Ports {
+		if p.ContainerPort <= 0 || p.ContainerPort > 65535 {
+			return fmt.Errorf("manifest: port %q: invalid container_port %d", p.Name, p.ContainerPort)
+		}
+		switch p.Protocol {
+		case "", "tcp", "udp":
+		default:
+			return fmt.Errorf("manifest: port %q: unknown protocol %q", p.Name, p.Protocol)
+		}
+		if p.HostPort < 0 || p.HostPort > 65535 {
+			return fmt.Errorf("manifest: port %q: invalid host_port %d", p.Name, p.HostPort)
+		}
+		if p.HostPort != 0 && !p.Public {
+			return fmt.Errorf("manifest: port %q: host_port is only used by public ports", p.Name)
+		}
+	}
+
+	for _, v := range m.Run.Volumes {
+		if v.Name == "" || v.MountPath == "" {
+			return fmt.Errorf("manifest: volumes need a name and mount_path")
+		}
+		switch v.Type {
+		case "", "persistent", "bind", "tmpfs":
+		default:
+			return fmt.Errorf("manifest: volume %q: unknown type %q", v.Name, v.Type)
+		}
+		if v.Backup && !v.Persistent() {
+			return fmt.Errorf("manifest: volume %q: only persistent volumes can be backed up", v.Name)
+		}
+		if strings.ContainsAny(v.Name, "/\\ .") {
+			return fmt.Errorf("manifest: volume %q: name may not contain '/', '\\', '.' or spaces", v.Name)
+		}
+	}
+
+	if _, err := ParseCPU(m.Run.Resources.CPU); err != nil {
+		return fmt.Errorf("manifest: resources: %w", err)
+	}
+	if _, err := ParseMemory(m.Run.Resources.Memory); err != nil {
+		return fmt.Errorf("manifest: resources: %w", err)
+	}
+	if m.Run.Resources.PIDs < 0 {
+		return fmt.Errorf("manifest: resources: invalid pids %d", m.Run.Resources.PIDs)
+	}
+
+	switch m.Deploy.Restart {
+	case "", "no", "always", "unless-stopped", "on-failure":
+	default:
+		return fmt.Errorf("manifest: unknown restart policy %q", m.Deploy.Restart)
+	}
+
+	for _, r := range m.Deploy.Routes {
+		if r.Host == "" && r.Path == "" {
+			return fmt.Errorf("manifest: routes need a host, a path or both")
+		}
+		if strings.ContainsAny(r.Host, ":/ ,") {
+			return fmt.Errorf("manifest: route host %q: give the hostname only", r.Host)
+		}
+		if r.Path != "" && (!strings.HasPrefix(r.Path, "/") || strings.ContainsAny(r.Path, " ,")) {
+			return fmt.Errorf("manifest: route path %q must start with '/'", r.Path)
+		}
+	}
+	if len(m.Deploy.Routes) > 0 {
+		p, ok := m.HTTPPort()
+		if !ok {
+			return fmt.Errorf("manifest: routes need a port named http")
+		}
+		if p.Protocol == "udp" {
+			return fmt.Errorf("manifest: port \"http\" must be tcp")
+		}
+	}
+
+	for _, d := range m.DependsOn {
+		if d == "" || d == m.Service {
+			return fmt.Errorf("manifest: invalid depends_on entry %q", d)
+		}
+	}
+
+	return nil
+}
+
+// coveKeyRx matches what compose accepts as the environment variable a
+// secret is read from, which is named after its Cove key.
+var coveKeyRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var secretIDRx = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func (b Build) validate() error {
+
+	for _, arg := range b.Args {
+		if k, _, ok := strings.Cut(arg, "="); !ok || k == "" {
+			return fmt.Errorf("arg %q is not KEY=VALUE", arg)
+		}
+	}
+	ids := map[string]bool{}
+	for _, entry := range b.ArgsFromCove {
+		id, key, ok := strings.Cut(entry, "=")
+		if !ok {
+			key = id
+		}
+		if !secretIDRx.MatchString(id) || !coveKeyRx.MatchString(key) {
+			return fmt.Errorf("args_from_cove: %q is not KEY or ID=KEY", entry)
+		}
+		if ids[id] {
+			return fmt.Errorf("args_from_cove: secret id %q is used twice", id)
+		}
+		ids[id] = true
+	}
+	if b.SSHKeyFromCove != "" && !coveKeyRx.MatchString(b.SSHKeyFromCove) {
+		return fmt.Errorf("ssh_key_from_cove: %q is not a valid key name", b.SSHKeyFromCove)
+	}
+	if strings.ContainsAny(b.Target, " /") {
+		return fmt.Errorf("invalid target %q", b.Target)
+	}
+	if b.Platform != "" {
+		parts := strings.Split(b.Platform, "/")
+		if len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+			return fmt.Errorf("platform %q is not os/arch or os/arch/variant", b.Platform)
+		}
+	}
+
+	return nil
+}
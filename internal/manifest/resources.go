@@ -0,0 +1,79 @@
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Sizes of the memory suffixes, matched case-insensitively with or without
+// a trailing "i".
+var memoryUnits = map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+// ParseCPU converts cores ("1.5") or millicores ("500m") to the nano CPUs
+// Docker expects. An empty string is no limit and gives 0.
+func ParseCPU(s string) (int64, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	scale := 1e9
+	num := s
+	if strings.HasSuffix(s, "m") {
+		scale = 1e6
+		num = strings.TrimSuffix(s, "m")
+	}
+
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid cpu %q", s)
+	}
+
+	return int64(v * scale), nil
+}
+
+// ParseMemory converts a size such as "512Mi" to bytes. An empty string is
+// no limit and gives 0.
+func ParseMemory(s string) (int64, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	num := s
+	size := int64(1)
+	trimmed := strings.TrimSuffix(s, "i")
+	if n := len(trimmed); n > 0 {
+		if u, ok := memoryUnits[strings.ToUpper(trimmed[n-1:])[0]]; ok {
+			num, size = trimmed[:n-1], u
+		}
+	}
+
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid memory %q", s)
+	}
+
+	return int64(v * float64(size)), nil
+}
+
+// FormatMemory renders bytes the way manifests write them.
+func FormatMemory(b int64) string {
+
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"Ti", 1 << 40}, {"Gi", 1 << 30}, {"Mi", 1 << 20}, {"Ki", 1 << 10}} {
+		if b >= u.size && b%u.size == 0 {
+			return strconv.FormatInt(b/u.size, 10) + u.suffix
+		}
+	}
+
+	return strconv.FormatInt(b, 10)
+}
+
+// FormatCPU renders nano CPUs as cores.
+func FormatCPU(nano int64) string {
+	return strconv.FormatFloat(float64(nano)/1e9, 'f', -1, 64)
+}
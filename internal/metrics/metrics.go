@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "lighthouse"
+
+var (
+	Polls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "polls_total",
+		Help:      "GitHub polls made per watched repo.",
+	}, []string{"repo"})
+
+	PollErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "poll_errors_total",
+		Help:      "Failed GitHub polls per watched repo and error type.",
+	}, []string{"repo", "type"})
+
+	GitHubRateLimitRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Requests left in the current GitHub rate limit window.",
+	})
+
+	Builds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "builds_total",
+		Help:      "Builds per watched repo and outcome.",
+	}, []string{"repo", "outcome"})
+
+	BuildPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_phase_duration_seconds",
+		Help:      "Time spent in each build phase.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"repo", "phase"})
+
+	CommitToDeploy = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "commit_to_deploy_seconds",
+		Help:      "Time from a commit being made to it running on the host.",
+		Buckets:   []float64{30, 60, 120, 300, 600, 1800, 3600, 21600, 86400},
+	}, []string{"repo"})
+
+	ReconcileActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_actions_total",
+		Help:      "Corrective actions taken by the reconciler per repo or service and action.",
+	}, []string{"name", "action"})
+
+	CoveLookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cove_lookup_duration_seconds",
+		Help:      "Latency of secret lookups against Cove.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	CoveLookupFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cove_lookup_failures_total",
+		Help:      "Secret lookups against Cove that failed.",
+	})
+)
+
+// ObserveCoveLookup records a Cove lookup that started at start.
+func ObserveCoveLookup(start time.Time, err error) {
+	CoveLookupDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		CoveLookupFailures.Inc()
+	}
+}
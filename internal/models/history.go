@@ -0,0 +1,83 @@
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+// Number of history entries kept per repo or service.
+const historyLimit = 50
+
+// HistoryEntry is one notable thing that happened to a repo or service,
+// such as a deploy or its container dying.
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	SHA     string    `json:"sha,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// ContainerStats counts what the Docker event stream reported about a
+// repo's or service's container.
+type ContainerStats struct {
+	Deaths       int        `json:"deaths"`
+	OOMKills     int        `json:"oomKills"`
+	Restarts     int        `json:"restarts"`
+	Unhealthy    int        `json:"unhealthy"`
+	LastExitCode *int       `json:"lastExitCode"`
+	LastEvent    string     `json:"lastEvent,omitempty"`
+	LastEventAt  *time.Time `json:"lastEventAt"`
+}
+
+// AppendHistory adds entry to history, dropping the oldest entries beyond
+// historyLimit.
+func AppendHistory(history []HistoryEntry, entry HistoryEntry) []HistoryEntry {
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	history = append(history, entry)
+	if len(history) > historyLimit {
+		history = append([]HistoryEntry(nil), history[len(history)-historyLimit:]...)
+	}
+
+	return history
+}
+
+// RecordContainerEvent counts a container event of kind, as named on the
+// event bus, with status carrying the exit code of a death.
+func RecordContainerEvent(stats ContainerStats, kind string, status string, at time.Time) ContainerStats {
+
+	switch kind {
+	case "container.died":
+		stats.Deaths += 1
+		if code, err := strconv.Atoi(status); err == nil {
+			stats.LastExitCode = &code
+		}
+	case "container.oom":
+		stats.OOMKills += 1
+	case "container.restarted":
+		stats.Restarts += 1
+	case "container.unhealthy":
+		stats.Unhealthy += 1
+	}
+
+	stats.LastEvent = kind
+	stats.LastEventAt = &at
+
+	return stats
+}
+
+// RecentEvents counts entries of event in history since t.
+func RecentEvents(history []HistoryEntry, event string, since time.Time) int {
+
+	n := 0
+	for _, h := range history {
+		if h.Event == event && !h.Time.Before(since) {
+			n++
+		}
+	}
+
+	return n
+}
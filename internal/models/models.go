@@ -1,22 +1,132 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/pathfilter"
+)
 
 type WatchedRepo struct {
-	DisplayName   string    `json:"displayName"`
-	ContainerName string    `json:"containerName"`
-	URL           string    `json:"url"`
-	APIURL        string    `json:"apiURL"`
-	DownloadURL   string    `json:"downloadURL"`
-	Stats         RepoStats `json:"stats"`
+	DisplayName   string   `json:"displayName"`
+	ContainerName string   `json:"containerName"`
+	URL           string   `json:"url"`
+	APIURL        string   `json:"apiURL"`
+	DownloadURL   string   `json:"downloadURL"`
+	DependsOn     []string `json:"dependsOn,omitempty"`
+	Desired       string   `json:"desired,omitempty"`
+	// Dir is the directory of a monorepo holding this service's compose
+	// file and manifest. Several entries may watch one repo, each with its
+	// own Dir.
+	Dir string `json:"dir,omitempty"`
+
+	// PollInterval is how often this repo is polled, e.g. "5m". Empty uses
+	// the daemon's poll interval.
+	PollInterval string `json:"pollInterval,omitempty"`
+	// Paused repos are still polled, but new commits wait for a resume.
+	Paused bool `json:"paused,omitempty"`
+	// Windows limit when new commits may be deployed, see schedule.Window.
+	Windows []string `json:"windows,omitempty"`
+	// Paths and IgnorePaths filter which changed files deploy a new commit,
+	// see pathfilter.Filter.
+	Paths       []string `json:"paths,omitempty"`
+	IgnorePaths []string `json:"ignorePaths,omitempty"`
+	// Approval "required" queues new commits in PendingApprovals until an
+	// operator approves one.
+	Approval         string            `json:"approval,omitempty"`
+	PendingApprovals []PendingApproval `json:"pendingApprovals,omitempty"`
+
+	Stats RepoStats `json:"stats"`
+
+	History []HistoryEntry `json:"history,omitempty"`
+}
+
+// Desired states of a repo or managed service, enforced by the reconciler.
+// An empty state means running.
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// Filter returns the path filter of the repo. A monorepo service without
+// paths of its own deploys on changes under its Dir.
+func (r WatchedRepo) Filter() pathfilter.Filter {
+
+	paths := r.Paths
+	if len(paths) == 0 && r.Dir != "" {
+		paths = []string{"/" + r.Dir + "/"}
+	}
+
+	return pathfilter.Filter{Paths: paths, Ignore: r.IgnorePaths}
+}
+
+// CleanDir checks dir is a directory inside a repo and returns it in the
+// form Dir is kept in, without leading or trailing slashes.
+func CleanDir(dir string) (string, error) {
+
+	if dir == "" {
+		return "", nil
+	}
+
+	clean := path.Clean(strings.Trim(dir, "/"))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || strings.ContainsAny(dir, "\\*?[") {
+		return "", fmt.Errorf("dir %q is not a directory inside the repo", dir)
+	}
+
+	return clean, nil
+}
+
+func (r WatchedRepo) WantsRunning() bool {
+	return r.Desired != DesiredStopped
+}
+
+// ApprovalRequired is the Approval of a repo whose commits wait for an
+// operator before they are deployed.
+const ApprovalRequired = "required"
+
+func (r WatchedRepo) RequiresApproval() bool {
+	return r.Approval == ApprovalRequired
+}
+
+// PendingApproval is a commit waiting for an operator to approve or reject
+// it, oldest first in a repo's queue.
+type PendingApproval struct {
+	// Repo is only set when approvals of several repos are listed together.
+	Repo       string    `json:"repo,omitempty"`
+	SHA        string    `json:"sha"`
+	Message    string    `json:"message"`
+	Author     string    `json:"author"`
+	DetectedAt time.Time `json:"detectedAt"`
+	// ExpiresAt is only set when listed, since it follows the configured
+	// expiry.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Number of commits kept waiting for approval per repo.
+const approvalLimit = 20
+
+// QueueApproval adds entry to queue, dropping the oldest entries beyond
+// approvalLimit. Approving a commit deploys everything before it too, so
+// the oldest are the least missed.
+func QueueApproval(queue []PendingApproval, entry PendingApproval) []PendingApproval {
+
+	queue = append(queue, entry)
+	if len(queue) > approvalLimit {
+		queue = append([]PendingApproval(nil), queue[len(queue)-approvalLimit:]...)
+	}
+
+	return queue
 }
 
 type RepoStats struct {
-	Meta      MetaStats     `json:"meta"`
-	Queries   QueryStats    `json:"queries"`
-	Updates   UpdateStats   `json:"updates"`
-	Builds    BuildStats    `json:"builds"`
-	Downloads DownloadStats `json:"downloads"`
+	Meta       MetaStats      `json:"meta"`
+	Queries    QueryStats     `json:"queries"`
+	Updates    UpdateStats    `json:"updates"`
+	Builds     BuildStats     `json:"builds"`
+	Downloads  DownloadStats  `json:"downloads"`
+	Containers ContainerStats `json:"containers"`
 }
 
 type MetaStats struct {
@@ -34,14 +144,29 @@ type QueryStats struct {
 type UpdateStats struct {
 	LastUpdatedAt     *time.Time `json:"lastUpdatedAt"`
 	LastSeenCommitSha *string    `json:"lastSeenCommitSha"`
+	LastSeenCommitAt  *time.Time `json:"lastSeenCommitAt"`
 	LastSeenTag       *string    `json:"lastSeenTag"`
 	UpdateCount       int        `json:"updateCount"`
+	// PendingCommitSha is the commit to deploy next: the latest one, or the
+	// one approved, held back while a pause or maintenance window says so.
+	PendingCommitSha *string `json:"pendingCommitSha,omitempty"`
 }
 
 type BuildStats struct {
 	LastBuildAt         *time.Time `json:"lastBuildAt"`
 	LastBuildStatus     *string    `json:"lastBuildStatus"`
+	LastBuildID         string     `json:"lastBuildId"`
 	BuildTriggeredCount int        `json:"buildTriggeredCount"`
+	DeployedSha         *string    `json:"deployedSha"`
+	FailedCommitSha     *string    `json:"failedCommitSha"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Broken              bool       `json:"broken"`
+
+	// HandoverSha is the commit a self-update handed over to and
+	// HandoverFromSha the one deployed before it, kept until the next
+	// daemon learns whether the update held.
+	HandoverSha     *string `json:"handoverSha,omitempty"`
+	HandoverFromSha *string `json:"handoverFromSha,omitempty"`
 }
 
 type DownloadStats struct {
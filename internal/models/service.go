@@ -0,0 +1,151 @@
+package models
+
+import "time"
+
+// ManagedService is a container Lighthouse runs but does not build, such as
+// an upstream image. Exactly one of Image, ComposePath or ManifestPath is set.
+type ManagedService struct {
+	Name          string `json:"name"`
+	ContainerName string `json:"containerName"`
+	Image         string `json:"image,omitempty"`
+	ComposePath   string `json:"composePath,omitempty"`
+	ManifestPath  string `json:"manifestPath,omitempty"`
+	WatchImage    bool   `json:"watchImage"`
+
+	// TagPolicy picks which tag to follow, e.g. "2.x" for the newest 2.y.z
+	// release. Empty watches the digest of the configured tag.
+	TagPolicy string `json:"tagPolicy,omitempty"`
+
+	// RegistryAuthFromCove names a Cove secret holding "username:password"
+	// for a private registry. Empty pulls anonymously.
+	RegistryAuthFromCove string `json:"registryAuthFromCove,omitempty"`
+
+	// DependsOn names the repos and services that must be healthy before
+	// this one is started at boot.
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// Desired is running or stopped, see DesiredRunning.
+	Desired string `json:"desired,omitempty"`
+
+	Stats ServiceStats `json:"stats"`
+
+	History []HistoryEntry `json:"history,omitempty"`
+}
+
+type ServiceStats struct {
+	Meta       MetaStats        `json:"meta"`
+	Updates    ImageUpdateStats `json:"updates"`
+	Deploys    DeployStats      `json:"deploys"`
+	Containers ContainerStats   `json:"containers"`
+}
+
+type ImageUpdateStats struct {
+	LastCheckedAt   *time.Time `json:"lastCheckedAt"`
+	LastSeenImageID *string    `json:"lastSeenImageId"`
+	LastSeenDigest  *string    `json:"lastSeenDigest"`
+	CurrentTag      string     `json:"currentTag,omitempty"`
+	FailedDigest    *string    `json:"failedDigest"`
+	LastUpdatedAt   *time.Time `json:"lastUpdatedAt"`
+	UpdateCount     int        `json:"updateCount"`
+}
+
+type DeployStats struct {
+	LastDeployAt     *time.Time `json:"lastDeployAt"`
+	LastDeployStatus *string    `json:"lastDeployStatus"`
+	LastDeployID     string     `json:"lastDeployId"`
+	DeployCount      int        `json:"deployCount"`
+}
+
+const (
+	ServiceKindImage    = "image"
+	ServiceKindCompose  = "compose"
+	ServiceKindManifest = "manifest"
+)
+
+func NewManagedService(name string, containerName string, kind string, source string, watch bool) ManagedService {
+
+	svc := ManagedService{
+		Name:          name,
+		ContainerName: containerName,
+		WatchImage:    watch,
+		Stats: ServiceStats{
+			Meta: MetaStats{
+				StartedWatchingAt: time.Now(),
+			},
+		},
+	}
+
+	switch kind {
+	case ServiceKindImage:
+		svc.Image = source
+	case ServiceKindCompose:
+		svc.ComposePath = source
+	case ServiceKindManifest:
+		svc.ManifestPath = source
+	}
+
+	return svc
+}
+
+func (s ManagedService) WantsRunning() bool {
+	return s.Desired != DesiredStopped
+}
+
+func (s ManagedService) Kind() string {
+	switch {
+	case s.ComposePath != "":
+		return ServiceKindCompose
+	case s.ManifestPath != "":
+		return ServiceKindManifest
+	default:
+		return ServiceKindImage
+	}
+}
+
+func UpdateImageCheckStats(svc ManagedService) ManagedService {
+	now := time.Now()
+	svc.Stats.Updates.LastCheckedAt = &now
+
+	return svc
+}
+
+func UpdateImageStats(svc ManagedService, imageID string) ManagedService {
+	now := time.Now()
+	svc.Stats.Updates.LastSeenImageID = &imageID
+	svc.Stats.Updates.FailedDigest = nil
+	svc.Stats.Updates.LastUpdatedAt = &now
+	svc.Stats.Updates.UpdateCount += 1
+
+	return svc
+}
+
+// UpdateDigestStats records that the registry now serves digest under tag
+// and that it is running.
+func UpdateDigestStats(svc ManagedService, tag string, digest string) ManagedService {
+	now := time.Now()
+	svc.Stats.Updates.LastSeenDigest = &digest
+	svc.Stats.Updates.CurrentTag = tag
+	svc.Stats.Updates.FailedDigest = nil
+	svc.Stats.Updates.LastUpdatedAt = &now
+	svc.Stats.Updates.UpdateCount += 1
+
+	return svc
+}
+
+// RecordFailedDigest remembers a digest that failed to deploy so it is not
+// retried until the registry moves on.
+func RecordFailedDigest(svc ManagedService, digest string) ManagedService {
+	svc.Stats.Updates.FailedDigest = &digest
+
+	return svc
+}
+
+func UpdateDeployStats(svc ManagedService, deployID string, status string) ManagedService {
+	now := time.Now()
+	svc.Stats.Deploys.LastDeployAt = &now
+	svc.Stats.Deploys.LastDeployStatus = &status
+	svc.Stats.Deploys.LastDeployID = deployID
+	svc.Stats.Deploys.DeployCount += 1
+
+	return svc
+}
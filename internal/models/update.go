@@ -10,9 +10,10 @@ func UpdateQueryStats(repo WatchedRepo) WatchedRepo {
 	return repo
 }
 
-func UpdateUpdateStats(repo WatchedRepo, sha string) WatchedRepo {
+func UpdateUpdateStats(repo WatchedRepo, sha string, committedAt time.Time) WatchedRepo {
 
 	repo.Stats.Updates.LastSeenCommitSha = &sha
+	repo.Stats.Updates.LastSeenCommitAt = &committedAt
 	currentTime := time.Now()
 	repo.Stats.Updates.LastUpdatedAt = &currentTime
 	repo.Stats.Updates.UpdateCount += 1
@@ -47,3 +48,37 @@ func UpdateBuildStats(repo WatchedRepo, buildStatus string) WatchedRepo {
 
 	return repo
 }
+
+// RecordBuildFailure counts consecutive failed builds of sha and marks the
+// repo broken once maxAttempts is reached.
+func RecordBuildFailure(repo WatchedRepo, sha string, maxAttempts int) WatchedRepo {
+
+	if repo.Stats.Builds.FailedCommitSha == nil || *repo.Stats.Builds.FailedCommitSha != sha {
+		repo.Stats.Builds.FailedCommitSha = &sha
+		repo.Stats.Builds.ConsecutiveFailures = 0
+		repo.Stats.Builds.Broken = false
+	}
+
+	repo.Stats.Builds.ConsecutiveFailures += 1
+	if repo.Stats.Builds.ConsecutiveFailures >= maxAttempts {
+		repo.Stats.Builds.Broken = true
+	}
+
+	return repo
+}
+
+// RecordDeployedSha notes the commit that is now running.
+func RecordDeployedSha(repo WatchedRepo, sha string) WatchedRepo {
+	repo.Stats.Builds.DeployedSha = &sha
+
+	return repo
+}
+
+func ClearBuildFailures(repo WatchedRepo) WatchedRepo {
+
+	repo.Stats.Builds.FailedCommitSha = nil
+	repo.Stats.Builds.ConsecutiveFailures = 0
+	repo.Stats.Builds.Broken = false
+
+	return repo
+}
@@ -0,0 +1,345 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"text/template"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/metrics"
+	"github.com/lsariol/coveclient"
+)
+
+// Notification event names. Builds finishing are split by outcome, every
+// other name matches the bus event kind it comes from.
+const (
+	BuildStarted       = "build.started"
+	BuildSucceeded     = "build.succeeded"
+	BuildFailed        = "build.failed"
+	HealthCheckFailed  = string(events.KindHealthCheckFailed)
+	Rollback           = string(events.KindRollback)
+	RepoBroken         = string(events.KindRepoBroken)
+	GitHubAuthFailed   = string(events.KindGitHubAuthFailed)
+	ContainerDied      = string(events.KindContainerDied)
+	ContainerOOM       = string(events.KindContainerOOM)
+	ContainerUnhealthy = string(events.KindContainerUnhealthy)
+	ContainerRestarted = string(events.KindContainerRestarted)
+	ContainerCrashLoop = string(events.KindContainerCrashLoop)
+	ApprovalPending    = string(events.KindApprovalPending)
+	ApprovalExpired    = string(events.KindApprovalExpired)
+)
+
+var defaultTemplates = map[string]string{
+	BuildStarted:       `{{.Repo}}: build {{.BuildID}} started for {{short .SHA}}`,
+	BuildSucceeded:     `{{.Repo}}: {{short .SHA}} deployed ({{.BuildID}})`,
+	BuildFailed:        `{{.Repo}}: build {{.BuildID}} of {{short .SHA}} failed: {{.Message}}`,
+	HealthCheckFailed:  `{{.Repo}}: health check failed for {{short .SHA}}: {{.Message}}`,
+	Rollback:           `{{.Repo}}: rolled back: {{.Message}}`,
+	RepoBroken:         `{{.Repo}}: marked broken at {{short .SHA}}: {{.Message}}`,
+	GitHubAuthFailed:   `GitHub authentication failed: {{.Message}}`,
+	ContainerDied:      `{{.Repo}}: {{.Message}}`,
+	ContainerOOM:       `{{.Repo}}: {{.Message}}`,
+	ContainerUnhealthy: `{{.Repo}}: {{.Message}}`,
+	ContainerRestarted: `{{.Repo}}: {{.Message}}`,
+	ContainerCrashLoop: `{{.Repo}}: crash loop: {{.Message}}`,
+	ApprovalPending:    `{{.Repo}}: {{short .SHA}} is waiting for approval: {{.Message}}`,
+	ApprovalExpired:    `{{.Repo}}: approval of {{short .SHA}} expired: {{.Message}}`,
+}
+
+// Notification is the data handed to sinks and message templates.
+type Notification struct {
+	Event   string    `json:"event"`
+	Repo    string    `json:"repo,omitempty"`
+	SHA     string    `json:"sha,omitempty"`
+	BuildID string    `json:"buildId,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+type Config struct {
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Routing. Empty lists match everything.
+	Events []string `json:"events"`
+	Repos  []string `json:"repos"`
+
+	// Message templates keyed by event name, falling back to Template and
+	// then to the built in default for the event.
+	Template  string            `json:"template"`
+	Templates map[string]string `json:"templates"`
+
+	URL           string `json:"url"`
+	URLFromCove   string `json:"urlFromCove"`
+	Token         string `json:"token"`
+	TokenFromCove string `json:"tokenFromCove"`
+
+	// SMTP
+	Host             string   `json:"host"`
+	Port             int      `json:"port"`
+	Username         string   `json:"username"`
+	PasswordFromCove string   `json:"passwordFromCove"`
+	Password         string   `json:"-"`
+	From             string   `json:"from"`
+	To               []string `json:"to"`
+}
+
+// Sink delivers a rendered notification somewhere.
+type Sink interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+type route struct {
+	cfg       SinkConfig
+	sink      Sink
+	templates map[string]*template.Template
+}
+
+type Notifier struct {
+	routes []route
+}
+
+// Load reads the notifier config at path and builds its sinks, resolving any
+// Cove-held values. A missing path yields a notifier without sinks.
+func Load(path string, cc *coveclient.Client) (*Notifier, error) {
+
+	if path == "" {
+		return &Notifier{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Notifier{}, nil
+		}
+		return nil, fmt.Errorf("read notify config: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse notify config: %w", err)
+	}
+
+	return New(cfg, cc)
+}
+
+func New(cfg Config, cc *coveclient.Client) (*Notifier, error) {
+
+	n := &Notifier{}
+
+	for _, sc := range cfg.Sinks {
+		if err := resolveSecrets(&sc, cc); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+
+		sink, err := newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+
+		templates, err := parseTemplates(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+
+		n.routes = append(n.routes, route{cfg: sc, sink: sink, templates: templates})
+	}
+
+	return n, nil
+}
+
+// Start subscribes to bus and delivers notifications for its events until
+// ctx is cancelled. Events published after Start returns are not missed.
+func (n *Notifier) Start(ctx context.Context, bus *events.Bus) {
+
+	if len(n.routes) == 0 {
+		return
+	}
+
+	// Log lines are never notified, and leaving them out keeps a chatty
+	// build from pushing the events that are out of the subscription.
+	ch, cancel := bus.SubscribeLifecycle()
+	go func() {
+		defer cancel()
+		n.run(ctx, ch)
+	}()
+}
+
+func (n *Notifier) run(ctx context.Context, ch <-chan events.Event) {
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			name := eventName(e)
+			if name == "" {
+				continue
+			}
+			n.Notify(ctx, Notification{
+				Event:   name,
+				Repo:    e.Repo,
+				SHA:     e.SHA,
+				BuildID: e.BuildID,
+				Message: e.Message,
+				Time:    e.Time,
+			})
+		}
+	}
+}
+
+// Notify sends note to every sink whose routing rules match it.
+func (n *Notifier) Notify(ctx context.Context, note Notification) {
+
+	for _, r := range n.routes {
+		if !r.matches(note) {
+			continue
+		}
+
+		msg := note
+		text, err := r.render(note)
+		if err != nil {
+			slog.Error("notification template failed", "sink", r.cfg.Name, "event", note.Event, "err", err)
+			continue
+		}
+		msg.Text = text
+
+		go func(r route) {
+			sendCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			defer cancel()
+			if err := r.sink.Send(sendCtx, msg); err != nil {
+				slog.Error("notification failed", "sink", r.cfg.Name, "event", msg.Event, "repo", msg.Repo, "err", err)
+			}
+		}(r)
+	}
+}
+
+func eventName(e events.Event) string {
+
+	switch e.Kind {
+	case events.KindBuildStarted:
+		return BuildStarted
+	case events.KindBuildFinished:
+		if e.Status == "success" {
+			return BuildSucceeded
+		}
+		return BuildFailed
+	case events.KindHealthCheckFailed, events.KindRollback, events.KindRepoBroken, events.KindGitHubAuthFailed,
+		events.KindContainerDied, events.KindContainerOOM, events.KindContainerUnhealthy, events.KindContainerRestarted, events.KindContainerCrashLoop,
+		events.KindApprovalPending, events.KindApprovalExpired:
+		return string(e.Kind)
+	}
+
+	return ""
+}
+
+func (r route) matches(n Notification) bool {
+
+	if len(r.cfg.Events) > 0 && !slices.Contains(r.cfg.Events, n.Event) {
+		return false
+	}
+
+	// Events without a repo, like auth failures, go to every sink that wants them.
+	if len(r.cfg.Repos) > 0 && n.Repo != "" && !slices.Contains(r.cfg.Repos, n.Repo) {
+		return false
+	}
+
+	return true
+}
+
+func (r route) render(n Notification) (string, error) {
+
+	t, ok := r.templates[n.Event]
+	if !ok {
+		t = r.templates[""]
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, n); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+var templateFuncs = template.FuncMap{
+	"short": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+}
+
+func parseTemplates(sc SinkConfig) (map[string]*template.Template, error) {
+
+	sources := make(map[string]string, len(defaultTemplates)+1)
+	for name, text := range defaultTemplates {
+		sources[name] = text
+		if sc.Template != "" {
+			sources[name] = sc.Template
+		}
+	}
+	for name, text := range sc.Templates {
+		sources[name] = text
+	}
+	sources[""] = `{{.Event}} {{.Repo}} {{.Message}}`
+	if sc.Template != "" {
+		sources[""] = sc.Template
+	}
+
+	templates := make(map[string]*template.Template, len(sources))
+	for name, text := range sources {
+		t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", name, err)
+		}
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+func resolveSecrets(sc *SinkConfig, cc *coveclient.Client) error {
+
+	fields := []struct {
+		key string
+		dst *string
+	}{
+		{sc.URLFromCove, &sc.URL},
+		{sc.TokenFromCove, &sc.Token},
+		{sc.PasswordFromCove, &sc.Password},
+	}
+
+	for _, f := range fields {
+		if f.key == "" {
+			continue
+		}
+		if cc == nil {
+			return fmt.Errorf("%s requires a Cove client", f.key)
+		}
+		start := time.Now()
+		val, err := cc.GetSecret(f.key)
+		metrics.ObserveCoveLookup(start, err)
+		if err != nil {
+			return fmt.Errorf("fetch %s from Cove: %w", f.key, err)
+		}
+		logging.AddSecret(val)
+		*f.dst = val
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+var httpClient = &http.Client{}
+
+func newSink(sc SinkConfig) (Sink, error) {
+
+	switch strings.ToLower(sc.Type) {
+	case "webhook":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("webhook requires a url")
+		}
+		return &webhookSink{url: sc.URL, token: sc.Token}, nil
+
+	case "discord":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("discord requires a url")
+		}
+		return &chatSink{url: sc.URL, field: "content"}, nil
+
+	case "slack":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("slack requires a url")
+		}
+		return &chatSink{url: sc.URL, field: "text"}, nil
+
+	case "ntfy":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("ntfy requires a topic url")
+		}
+		return &ntfySink{url: sc.URL, token: sc.Token}, nil
+
+	case "gotify":
+		if sc.URL == "" || sc.Token == "" {
+			return nil, fmt.Errorf("gotify requires a url and an app token")
+		}
+		return &gotifySink{url: strings.TrimSuffix(sc.URL, "/"), token: sc.Token}, nil
+
+	case "smtp", "email":
+		if sc.Host == "" || sc.From == "" || len(sc.To) == 0 {
+			return nil, fmt.Errorf("smtp requires host, from and to")
+		}
+		port := sc.Port
+		if port == 0 {
+			port = 587
+		}
+		return &smtpSink{
+			addr:     net.JoinHostPort(sc.Host, strconv.Itoa(port)),
+			host:     sc.Host,
+			username: sc.Username,
+			password: sc.Password,
+			from:     sc.From,
+			to:       sc.To,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+}
+
+// webhookSink posts the whole notification as JSON.
+type webhookSink struct {
+	url   string
+	token string
+}
+
+func (s *webhookSink) Send(ctx context.Context, n Notification) error {
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	if s.token != "" {
+		headers["Authorization"] = "Bearer " + s.token
+	}
+
+	return post(ctx, s.url, body, headers)
+}
+
+// chatSink posts to Discord and Slack compatible incoming webhooks, which
+// only differ in the name of the message field.
+type chatSink struct {
+	url   string
+	field string
+}
+
+func (s *chatSink) Send(ctx context.Context, n Notification) error {
+
+	body, err := json.Marshal(map[string]string{s.field: n.Text})
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, s.url, body, map[string]string{"Content-Type": "application/json"})
+}
+
+type ntfySink struct {
+	url   string
+	token string
+}
+
+func (s *ntfySink) Send(ctx context.Context, n Notification) error {
+
+	headers := map[string]string{
+		"Title": "LightHouse: " + n.Event,
+		"Tags":  ntfyTag(n.Event),
+	}
+	if priority(n.Event) > 5 {
+		headers["Priority"] = "high"
+	}
+	if s.token != "" {
+		headers["Authorization"] = "Bearer " + s.token
+	}
+
+	return post(ctx, s.url, []byte(n.Text), headers)
+}
+
+func ntfyTag(event string) string {
+	switch event {
+	case BuildSucceeded:
+		return "white_check_mark"
+	case BuildStarted:
+		return "hammer"
+	default:
+		return "warning"
+	}
+}
+
+type gotifySink struct {
+	url   string
+	token string
+}
+
+func (s *gotifySink) Send(ctx context.Context, n Notification) error {
+
+	body, err := json.Marshal(map[string]any{
+		"title":    "LightHouse: " + n.Event,
+		"message":  n.Text,
+		"priority": priority(n.Event),
+	})
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, s.url+"/message", body, map[string]string{
+		"Content-Type": "application/json",
+		"X-Gotify-Key": s.token,
+	})
+}
+
+// priority maps events onto Gotify's 0-10 scale.
+func priority(event string) int {
+	switch event {
+	case BuildStarted, BuildSucceeded, ContainerRestarted:
+		return 2
+	case BuildFailed, HealthCheckFailed, Rollback, ContainerDied, ContainerUnhealthy:
+		return 7
+	default:
+		return 9
+	}
+}
+
+type smtpSink struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (s *smtpSink) Send(ctx context.Context, n Notification) error {
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: LightHouse: %s %s\r\n", n.Event, n.Repo)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", n.Text)
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	// net/smtp has no context support, so run it aside and give up on cancel.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, auth, s.from, s.to, msg.Bytes())
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func post(ctx context.Context, url string, body []byte, headers map[string]string) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package pathfilter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Filter picks the changed files of a commit that matter for a deploy. A
+// file matters when it matches one of Paths, or Paths is empty, and none of
+// Ignore.
+//
+// Patterns follow .gitignore: "*.md" matches in every directory, a pattern
+// with a slash such as "cmd/*.go" is relative to the repo root, "docs/"
+// matches everything under any docs directory, "docs/**" under the top
+// level one, and "**/" matches any directories in front.
+type Filter struct {
+	Paths  []string
+	Ignore []string
+}
+
+// Empty reports whether the filter lets every file through.
+func (f Filter) Empty() bool {
+	return len(f.Paths) == 0 && len(f.Ignore) == 0
+}
+
+// Validate reports the first malformed pattern.
+func (f Filter) Validate() error {
+
+	for _, patterns := range [][]string{f.Paths, f.Ignore} {
+		if err := Validate(patterns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate reports the first malformed pattern in patterns.
+func Validate(patterns []string) error {
+
+	for _, p := range patterns {
+		core, _, _ := parse(p)
+		if core == "" {
+			return fmt.Errorf("path pattern %q is empty", p)
+		}
+		if strings.Contains(core, "**") {
+			return fmt.Errorf("path pattern %q: ** is only supported at the start or end", p)
+		}
+		if _, err := path.Match(core, ""); err != nil {
+			return fmt.Errorf("path pattern %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// Match reports whether file, a slash separated path from the repo root,
+// matters.
+func (f Filter) Match(file string) bool {
+
+	if len(f.Paths) > 0 && !matchAny(f.Paths, file) {
+		return false
+	}
+
+	return !matchAny(f.Ignore, file)
+}
+
+// Any reports whether at least one of files matters.
+func (f Filter) Any(files []string) bool {
+
+	for _, file := range files {
+		if f.Match(file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []string, file string) bool {
+
+	for _, p := range patterns {
+		if match(p, file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match reports whether pattern matches file or a directory it is in.
+func match(pattern string, file string) bool {
+
+	core, anyDepth, dirOnly := parse(pattern)
+	segments := strings.Count(core, "/") + 1
+	parts := strings.Split(file, "/")
+
+	for start := range parts {
+		if start > 0 && !anyDepth {
+			break
+		}
+		candidate := parts[start:]
+		// The file itself or a directory it is in. A directory-only
+		// pattern needs at least one more segment for the file.
+		if len(candidate) < segments || (dirOnly && len(candidate) == segments) {
+			continue
+		}
+		candidate = candidate[:segments]
+		if ok, _ := path.Match(core, strings.Join(candidate, "/")); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parse splits pattern into the part matched with path.Match and whether it
+// may start in any directory or only matches directories.
+func parse(pattern string) (core string, anyDepth bool, dirOnly bool) {
+
+	core = strings.TrimSpace(pattern)
+
+	// As in .gitignore, a slash anywhere but at the end ties the pattern
+	// to the repo root.
+	anyDepth = !strings.Contains(strings.TrimSuffix(core, "/"), "/")
+	core = strings.TrimPrefix(core, "/")
+
+	if rest, ok := strings.CutPrefix(core, "**/"); ok {
+		core = rest
+		anyDepth = true
+	}
+	if rest, ok := strings.CutSuffix(core, "/**"); ok {
+		core = rest
+		dirOnly = true
+	} else if rest, ok := strings.CutSuffix(core, "/"); ok {
+		core = rest
+		dirOnly = true
+	}
+
+	return core, anyDepth, dirOnly
+}
@@ -0,0 +1,99 @@
+package pathfilter
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		// No slash matches in any directory.
+		{"*.md", "README.md", true},
+		{"*.md", "docs/guide/intro.md", true},
+		{"*.md", "main.go", false},
+		{"Makefile", "tools/Makefile", true},
+
+		// A slash ties the pattern to the repo root.
+		{"cmd/*.go", "cmd/main.go", true},
+		{"cmd/*.go", "tools/cmd/main.go", false},
+		{"cmd/*.go", "cmd/lighthouse/main.go", false},
+		{"/go.mod", "go.mod", true},
+		{"/go.mod", "sub/go.mod", false},
+
+		// A trailing slash matches everything under a directory of that
+		// name, but not a file of that name.
+		{"docs/", "docs/index.md", true},
+		{"docs/", "site/docs/index.md", true},
+		{"docs/", "docs", false},
+		{"docs/", "docsite/index.md", false},
+
+		// /** is the top level directory only.
+		{"docs/**", "docs/a/b.md", true},
+		{"docs/**", "site/docs/a.md", false},
+
+		// **/ matches any directories in front.
+		{"**/testdata/*.json", "testdata/a.json", true},
+		{"**/testdata/*.json", "internal/x/testdata/a.json", true},
+		{"**/testdata/*.json", "internal/x/testdata/sub/a.json", false},
+
+		// A pattern naming a directory covers the files in it.
+		{"services/api", "services/api/main.go", true},
+		{"services/api", "services/api-old/main.go", false},
+		{"vendor", "vendor/x/y.go", true},
+	}
+
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.file); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		filter Filter
+		files  []string
+		want   bool
+	}{
+		{"empty lets everything through", Filter{}, []string{"README.md"}, true},
+		{"no files", Filter{}, nil, false},
+		{"path matches", Filter{Paths: []string{"services/api/", "shared/"}}, []string{"shared/log.go"}, true},
+		{"path misses", Filter{Paths: []string{"services/api/"}}, []string{"services/web/main.go", "README.md"}, false},
+		{"only ignored files", Filter{Ignore: []string{"*.md", "docs/"}}, []string{"README.md", "docs/setup.txt"}, false},
+		{"one file not ignored", Filter{Ignore: []string{"*.md"}}, []string{"README.md", "main.go"}, true},
+		{"ignore beats paths", Filter{Paths: []string{"services/api/"}, Ignore: []string{"*.md"}}, []string{"services/api/README.md"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.Any(tt.files); got != tt.want {
+			t.Errorf("%s: Any(%v) = %v, want %v", tt.name, tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"*.go", true},
+		{"**/vendor/", true},
+		{"docs/**", true},
+		{"", false},
+		{"  ", false},
+		{"a/**/b", false},
+		{"[", false},
+	}
+
+	for _, tt := range tests {
+		err := Validate([]string{tt.pattern})
+		if (err == nil) != tt.ok {
+			t.Errorf("Validate(%q) = %v, want ok %v", tt.pattern, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package ports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Assignment is a host port held by a repo or managed service.
+type Assignment struct {
+	HostPort      int    `json:"hostPort"`
+	Protocol      string `json:"protocol"`
+	Owner         string `json:"owner"`
+	Port          string `json:"port"`
+	ContainerPort int    `json:"containerPort"`
+
+	// Fixed assignments were asked for by number and are never moved.
+	Fixed bool `json:"fixed"`
+}
+
+func (a Assignment) key() string {
+	return strconv.Itoa(a.HostPort) + "/" + a.Protocol
+}
+
+// Request is a port an owner wants published on the host.
+type Request struct {
+	// Port names the port within its owner, e.g. a manifest port name.
+	Port          string
+	ContainerPort int
+	Protocol      string
+	// HostPort asks for a specific host port. Zero lets the registry pick.
+	HostPort int
+}
+
+// Conflict is a host port wanted by one owner but held by someone else.
+type Conflict struct {
+	HostPort int    `json:"hostPort"`
+	Protocol string `json:"protocol"`
+	Owner    string `json:"owner"`
+	Port     string `json:"port"`
+	HeldBy   string `json:"heldBy"`
+}
+
+func (c Conflict) String() string {
+	if c.HostPort == 0 {
+		return fmt.Sprintf("no free host port for %s: %s", c.Port, c.HeldBy)
+	}
+	return fmt.Sprintf("host port %d/%s for %s is held by %s", c.HostPort, c.Protocol, c.Port, c.HeldBy)
+}
+
+// Registry records which host ports belong to which repo or service.
+type Registry struct {
+	path string
+	// Public ports that do not ask for a host port get one from this range.
+	rangeStart int
+	rangeEnd   int
+
+	mu          sync.Mutex
+	assignments []Assignment
+}
+
+// NewRegistry returns a registry stored at path that assigns ports from
+// start to end. An empty path keeps it in memory only.
+func NewRegistry(path string, start int, end int) *Registry {
+	return &Registry{path: path, rangeStart: start, rangeEnd: end}
+}
+
+// Load reads the registry from disk. A missing file is an empty registry.
+func (r *Registry) Load() error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("load ports: %w", err)
+	}
+
+	var assignments []Assignment
+	if err := json.Unmarshal(data, &assignments); err != nil {
+		return fmt.Errorf("load ports: %w", err)
+	}
+	r.assignments = assignments
+
+	return nil
+}
+
+func (r *Registry) store() {
+
+	if r.path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(r.assignments, "", "	")
+	if err != nil {
+		slog.Error("failed to marshal ports", "err", err)
+		return
+	}
+
+	if err := os.WriteFile(r.path, data, 0644); err != nil {
+		slog.Error("failed to write ports", "path", r.path, "err", err)
+	}
+}
+
+// Plan works out the host ports owner would get for reqs without claiming
+// them. external maps "port/protocol" to whatever already publishes that
+// port outside the registry, such as a container Lighthouse does not manage.
+func (r *Registry) Plan(owner string, reqs []Request, external map[string]string) ([]Assignment, []Conflict) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.plan(owner, reqs, external)
+}
+
+// Claim assigns host ports for reqs to owner, replacing what it held
+// before. Nothing changes when any of the ports is held by someone else.
+func (r *Registry) Claim(owner string, reqs []Request, external map[string]string) ([]Assignment, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	assigned, conflicts := r.plan(owner, reqs, external)
+	if len(conflicts) > 0 {
+		msgs := make([]string, len(conflicts))
+		for i, c := range conflicts {
+			msgs[i] = c.String()
+		}
+		return nil, fmt.Errorf("port conflict: %s", strings.Join(msgs, "; "))
+	}
+
+	r.assignments = slices.DeleteFunc(r.assignments, func(a Assignment) bool { return a.Owner == owner })
+	r.assignments = append(r.assignments, assigned...)
+	r.store()
+
+	return assigned, nil
+}
+
+// Release frees every host port held by owner.
+func (r *Registry) Release(owner string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before := len(r.assignments)
+	r.assignments = slices.DeleteFunc(r.assignments, func(a Assignment) bool { return a.Owner == owner })
+	if len(r.assignments) != before {
+		r.store()
+	}
+}
+
+// Rename moves the ports of owner to a new name.
+func (r *Registry) Rename(owner string, name string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for i := range r.assignments {
+		if r.assignments[i].Owner == owner {
+			r.assignments[i].Owner = name
+			changed = true
+		}
+	}
+	if changed {
+		r.store()
+	}
+}
+
+// All returns every assignment ordered by host port.
+func (r *Registry) All() []Assignment {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := append([]Assignment(nil), r.assignments...)
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].HostPort != all[j].HostPort {
+			return all[i].HostPort < all[j].HostPort
+		}
+		return all[i].Protocol < all[j].Protocol
+	})
+
+	return all
+}
+
+// Owned returns the assignments of owner.
+func (r *Registry) Owned(owner string) []Assignment {
+
+	var owned []Assignment
+	for _, a := range r.All() {
+		if a.Owner == owner {
+			owned = append(owned, a)
+		}
+	}
+
+	return owned
+}
+
+func (r *Registry) plan(owner string, reqs []Request, external map[string]string) ([]Assignment, []Conflict) {
+
+	held := map[string]string{}
+	for k, v := range external {
+		held[k] = v
+	}
+	previous := map[string]Assignment{}
+	for _, a := range r.assignments {
+		if a.Owner == owner {
+			previous[a.Port] = a
+			continue
+		}
+		held[a.key()] = a.Owner
+	}
+
+	var assigned []Assignment
+	var conflicts []Conflict
+	var floating []Request
+
+	// Fixed ports go first so a floating port never takes one of them.
+	for _, req := range reqs {
+		if req.Protocol == "" {
+			req.Protocol = "tcp"
+		}
+		if req.HostPort == 0 {
+			floating = append(floating, req)
+			continue
+		}
+
+		a := Assignment{HostPort: req.HostPort, Protocol: req.Protocol, Owner: owner, Port: req.Port, ContainerPort: req.ContainerPort, Fixed: true}
+		if by, ok := held[a.key()]; ok {
+			conflicts = append(conflicts, Conflict{HostPort: a.HostPort, Protocol: a.Protocol, Owner: owner, Port: req.Port, HeldBy: by})
+			continue
+		}
+		held[a.key()] = owner
+		assigned = append(assigned, a)
+	}
+
+	start, end := r.rangeStart, r.rangeEnd
+	for _, req := range floating {
+		a := Assignment{Protocol: req.Protocol, Owner: owner, Port: req.Port, ContainerPort: req.ContainerPort}
+
+		// Keep the port given last time, else try the container port
+		// itself, else the first free one in the range.
+		candidates := []int{}
+		if prev, ok := previous[req.Port]; ok && !prev.Fixed && prev.Protocol == req.Protocol {
+			candidates = append(candidates, prev.HostPort)
+		}
+		candidates = append(candidates, req.ContainerPort)
+		for _, port := range candidates {
+			a.HostPort = port
+			if _, ok := held[a.key()]; !ok {
+				break
+			}
+			a.HostPort = 0
+		}
+		for port := start; a.HostPort == 0 && port <= end; port++ {
+			a.HostPort = port
+			if _, ok := held[a.key()]; ok {
+				a.HostPort = 0
+			}
+		}
+
+		if a.HostPort == 0 {
+			conflicts = append(conflicts, Conflict{Protocol: req.Protocol, Owner: owner, Port: req.Port, HeldBy: fmt.Sprintf("ports %d-%d are all taken", start, end)})
+			continue
+		}
+		held[a.key()] = owner
+		assigned = append(assigned, a)
+	}
+
+	return assigned, conflicts
+}
@@ -0,0 +1,116 @@
+package ports
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+
+	// api holds 8080 and the first port of the range, and web last got
+	// 20001 for its http port.
+	existing := []Assignment{
+		{HostPort: 8080, Protocol: "tcp", Owner: "api", Port: "http", ContainerPort: 8080, Fixed: true},
+		{HostPort: 20000, Protocol: "tcp", Owner: "api", Port: "metrics", ContainerPort: 9100},
+		{HostPort: 20001, Protocol: "tcp", Owner: "web", Port: "http", ContainerPort: 3000},
+		{HostPort: 5432, Protocol: "tcp", Owner: "web", Port: "db", ContainerPort: 5432, Fixed: true},
+	}
+
+	tests := []struct {
+		name      string
+		owner     string
+		reqs      []Request
+		external  map[string]string
+		want      []Assignment
+		conflicts []Conflict
+	}{
+		{
+			name:  "fixed port that is free",
+			owner: "web",
+			reqs:  []Request{{Port: "admin", ContainerPort: 9000, HostPort: 9000}},
+			want:  []Assignment{{HostPort: 9000, Protocol: "tcp", Owner: "web", Port: "admin", ContainerPort: 9000, Fixed: true}},
+		},
+		{
+			name:      "fixed port held by another owner",
+			owner:     "web",
+			reqs:      []Request{{Port: "http", ContainerPort: 80, HostPort: 8080}},
+			conflicts: []Conflict{{HostPort: 8080, Protocol: "tcp", Owner: "web", Port: "http", HeldBy: "api"}},
+		},
+		{
+			name:  "same number on another protocol",
+			owner: "web",
+			reqs:  []Request{{Port: "dns", ContainerPort: 53, Protocol: "udp", HostPort: 8080}},
+			want:  []Assignment{{HostPort: 8080, Protocol: "udp", Owner: "web", Port: "dns", ContainerPort: 53, Fixed: true}},
+		},
+		{
+			name:  "an owner keeps its own fixed port",
+			owner: "web",
+			reqs:  []Request{{Port: "db", ContainerPort: 5432, HostPort: 5432}},
+			want:  []Assignment{{HostPort: 5432, Protocol: "tcp", Owner: "web", Port: "db", ContainerPort: 5432, Fixed: true}},
+		},
+		{
+			name:      "fixed port published outside lighthouse",
+			owner:     "web",
+			reqs:      []Request{{Port: "ssh", ContainerPort: 22, HostPort: 2222}},
+			external:  map[string]string{"2222/tcp": "container gitea"},
+			conflicts: []Conflict{{HostPort: 2222, Protocol: "tcp", Owner: "web", Port: "ssh", HeldBy: "container gitea"}},
+		},
+		{
+			name:  "floating port keeps its last host port",
+			owner: "web",
+			reqs:  []Request{{Port: "http", ContainerPort: 3000}},
+			want:  []Assignment{{HostPort: 20001, Protocol: "tcp", Owner: "web", Port: "http", ContainerPort: 3000}},
+		},
+		{
+			name:  "floating port takes its container port when free",
+			owner: "docs",
+			reqs:  []Request{{Port: "http", ContainerPort: 4000}},
+			want:  []Assignment{{HostPort: 4000, Protocol: "tcp", Owner: "docs", Port: "http", ContainerPort: 4000}},
+		},
+		{
+			name:  "floating port falls back to the first free one in the range",
+			owner: "docs",
+			reqs:  []Request{{Port: "http", ContainerPort: 8080}},
+			want:  []Assignment{{HostPort: 20002, Protocol: "tcp", Owner: "docs", Port: "http", ContainerPort: 8080}},
+		},
+		{
+			name:  "fixed ports are placed before floating ones",
+			owner: "docs",
+			reqs: []Request{
+				{Port: "http", ContainerPort: 4000},
+				{Port: "admin", ContainerPort: 9000, HostPort: 4000},
+			},
+			want: []Assignment{
+				{HostPort: 4000, Protocol: "tcp", Owner: "docs", Port: "admin", ContainerPort: 9000, Fixed: true},
+				{HostPort: 20002, Protocol: "tcp", Owner: "docs", Port: "http", ContainerPort: 4000},
+			},
+		},
+		{
+			name:  "range exhausted",
+			owner: "docs",
+			reqs: []Request{
+				{Port: "a", ContainerPort: 8080},
+				{Port: "b", ContainerPort: 8080},
+				{Port: "c", ContainerPort: 8080},
+			},
+			want: []Assignment{
+				{HostPort: 20002, Protocol: "tcp", Owner: "docs", Port: "a", ContainerPort: 8080},
+				{HostPort: 20003, Protocol: "tcp", Owner: "docs", Port: "b", ContainerPort: 8080},
+			},
+			conflicts: []Conflict{{Protocol: "tcp", Owner: "docs", Port: "c", HeldBy: "ports 20000-20003 are all taken"}},
+		},
+	}
+
+	for _, tt := range tests {
+		r := NewRegistry("", 20000, 20003)
+		r.assignments = slices.Clone(existing)
+
+		got, conflicts := r.plan(tt.owner, tt.reqs, tt.external)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: assigned %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !slices.Equal(conflicts, tt.conflicts) {
+			t.Errorf("%s: conflicts %+v, want %+v", tt.name, conflicts, tt.conflicts)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Route sends requests for Host and Path to Target, the address of a
+// container on the proxy network.
+type Route struct {
+	Owner     string `json:"owner"`
+	Container string `json:"container"`
+	// Host is matched without its port. Empty matches every host.
+	Host string `json:"host"`
+	// Path matches itself and everything below it, and is passed on as is.
+	Path   string `json:"path"`
+	Target string `json:"target"`
+}
+
+func (r Route) String() string {
+	host := r.Host
+	if host == "" {
+		host = "*"
+	}
+	return host + r.Path
+}
+
+// ParseRoute splits "host/path", "host" or "/path" into a route matching it.
+func ParseRoute(s string) (Route, error) {
+
+	s = strings.TrimSpace(s)
+	host, path := s, "/"
+	if i := strings.Index(s, "/"); i >= 0 {
+		host, path = s[:i], s[i:]
+	}
+	host = strings.ToLower(host)
+	if host == "" && path == "/" && s != "/" {
+		return Route{}, fmt.Errorf("route %q: host or path is required", s)
+	}
+	if strings.ContainsAny(host, ": ") || strings.Contains(path, " ") {
+		return Route{}, fmt.Errorf("invalid route %q", s)
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	return Route{Host: host, Path: path}, nil
+}
+
+type entry struct {
+	route   Route
+	handler http.Handler
+}
+
+// Proxy routes requests to containers by hostname and path. The routing
+// table is swapped as a whole, so a request sees either the old routes or
+// the new ones and never a mix.
+type Proxy struct {
+	table atomic.Pointer[[]entry]
+}
+
+func New() *Proxy {
+	p := &Proxy{}
+	p.table.Store(&[]entry{})
+	return p
+}
+
+// Replace makes routes the whole routing table. When two owners claim the
+// same host and path, the first one keeps it and the conflict is returned.
+func (p *Proxy) Replace(routes []Route) []string {
+
+	var conflicts []string
+	var table []entry
+	claimed := map[string]Route{}
+
+	for _, r := range routes {
+		if prev, ok := claimed[r.String()]; ok {
+			if prev.Owner != r.Owner {
+				conflicts = append(conflicts, fmt.Sprintf("route %s of %s is already used by %s", r, r.Owner, prev.Owner))
+			}
+			continue
+		}
+
+		target, err := url.Parse("http://" + r.Target)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("route %s of %s: invalid target %q", r, r.Owner, r.Target))
+			continue
+		}
+		claimed[r.String()] = r
+		table = append(table, entry{route: r, handler: reverseProxy(target)})
+	}
+
+	// Hostnames beat catch-alls and longer paths beat shorter ones, so the
+	// first match is the most specific.
+	sort.SliceStable(table, func(i, j int) bool {
+		a, b := table[i].route, table[j].route
+		if (a.Host == "") != (b.Host == "") {
+			return a.Host != ""
+		}
+		return len(a.Path) > len(b.Path)
+	})
+	p.table.Store(&table)
+
+	return conflicts
+}
+
+// Routes returns the routing table in the order routes are matched.
+func (p *Proxy) Routes() []Route {
+
+	table := *p.table.Load()
+	routes := make([]Route, len(table))
+	for i, e := range table {
+		routes[i] = e.route
+	}
+
+	return routes
+}
+
+// HasHost reports whether any route is for host.
+func (p *Proxy) HasHost(host string) bool {
+
+	host = strings.ToLower(host)
+	for _, e := range *p.table.Load() {
+		if e.route.Host == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, e := range *p.table.Load() {
+		if e.route.Host != "" && e.route.Host != host {
+			continue
+		}
+		if !matchPath(e.route.Path, r.URL.Path) {
+			continue
+		}
+		e.handler.ServeHTTP(w, r)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// matchPath reports whether path is prefix or below it.
+func matchPath(prefix string, path string) bool {
+
+	if prefix == "/" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+func reverseProxy(target *url.URL) http.Handler {
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("proxy request failed", "host", r.Host, "path", r.URL.Path, "target", target.Host, "err", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How the proxy gets certificates.
+const (
+	// TLSOff serves plain HTTP only.
+	TLSOff = ""
+	// TLSLocal reads certificates from a directory.
+	TLSLocal = "local"
+	// TLSACME obtains certificates from Let's Encrypt, or another ACME CA,
+	// for the hostnames that have routes.
+	TLSACME = "acme"
+)
+
+// Options are where the proxy listens and how it does TLS.
+type Options struct {
+	HTTPAddr  string
+	HTTPSAddr string
+	TLS       string
+
+	// CertDir holds <host>.crt and <host>.key for TLSLocal, with
+	// default.crt and default.key used for any other host.
+	CertDir string
+
+	// ACMECache keeps issued certificates across restarts.
+	ACMECache string
+	ACMEEmail string
+	// ACMEDirectory is the CA's directory URL, Let's Encrypt when empty.
+	ACMEDirectory string
+}
+
+// Run serves the proxy until ctx is cancelled. With TLS, plain HTTP
+// requests are redirected to HTTPS.
+func (p *Proxy) Run(ctx context.Context, opts Options) error {
+
+	var servers []*http.Server
+
+	switch opts.TLS {
+	case TLSOff:
+		servers = append(servers, newServer(opts.HTTPAddr, p, nil))
+
+	case TLSLocal:
+		certs := &certDir{dir: opts.CertDir, loaded: map[string]*cachedCert{}}
+		servers = append(servers,
+			newServer(opts.HTTPAddr, http.HandlerFunc(redirectHTTPS), nil),
+			newServer(opts.HTTPSAddr, p, &tls.Config{GetCertificate: certs.get, MinVersion: tls.VersionTLS12}),
+		)
+
+	case TLSACME:
+		m := &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  autocert.DirCache(opts.ACMECache),
+			Email:  opts.ACMEEmail,
+			// Only hostnames something is routed to get a certificate, so
+			// stray SNI names cannot run up the CA's rate limits.
+			HostPolicy: func(_ context.Context, host string) error {
+				if !p.HasHost(host) {
+					return fmt.Errorf("no route for host %q", host)
+				}
+				return nil
+			},
+		}
+		if opts.ACMEDirectory != "" {
+			m.Client = &acme.Client{DirectoryURL: opts.ACMEDirectory}
+		}
+		servers = append(servers,
+			newServer(opts.HTTPAddr, m.HTTPHandler(nil), nil),
+			newServer(opts.HTTPSAddr, p, m.TLSConfig()),
+		)
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("proxy %s: %w", srv.Addr, err)
+				return
+			}
+			errs <- nil
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+
+	return err
+}
+
+func newServer(addr string, h http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// certDir serves the certificates of a directory, reloading a pair when
+// its files change so renewed certificates are picked up without a restart.
+type certDir struct {
+	dir string
+
+	mu     sync.Mutex
+	loaded map[string]*cachedCert
+}
+
+type cachedCert struct {
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certDir) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	host := strings.ToLower(hello.ServerName)
+	for _, name := range []string{host, "default"} {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			continue
+		}
+		cert, err := c.load(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return cert, err
+	}
+
+	return nil, fmt.Errorf("no certificate for %q in %s", host, c.dir)
+}
+
+func (c *certDir) load(name string) (*tls.Certificate, error) {
+
+	certFile := filepath.Join(c.dir, name+".crt")
+	keyFile := filepath.Join(c.dir, name+".key")
+
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.loaded[name]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %s: %w", name, err)
+	}
+	c.loaded[name] = &cachedCert{cert: &cert, modTime: info.ModTime()}
+
+	return &cert, nil
+}
@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Credentials for a registry. Empty credentials mean anonymous access.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Client talks to the Docker Registry HTTP API v2.
+type Client struct {
+	HTTP *http.Client
+
+	// Insecure lists registries reached over plain http, such as a local
+	// registry:2. localhost and 127.0.0.1 are always plain http.
+	Insecure []string
+}
+
+func NewClient(http *http.Client, insecure []string) *Client {
+	return &Client{
+		HTTP:     http,
+		Insecure: insecure,
+	}
+}
+
+// Digest returns the manifest digest ref currently points at.
+func (c *Client) Digest(ctx context.Context, ref Reference, creds Credentials) (string, error) {
+
+	resp, err := c.do(ctx, http.MethodHead, ref, "/manifests/"+ref.Tag, creds, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("%s: registry returned no digest", ref)
+	}
+
+	return digest, nil
+}
+
+// Tags lists every tag of ref's repository.
+func (c *Client) Tags(ctx context.Context, ref Reference, creds Credentials) ([]string, error) {
+
+	var tags []string
+	path := "/tags/list"
+
+	for path != "" {
+		resp, err := c.do(ctx, http.MethodGet, ref, path, creds, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: decode tags: %w", ref.Repository, err)
+		}
+		tags = append(tags, page.Tags...)
+
+		path = nextPage(resp.Header.Get("Link"), ref.Repository)
+	}
+
+	return tags, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, ref Reference, path string, creds Credentials, accept []string) (*http.Response, error) {
+
+	target := fmt.Sprintf("%s://%s/v2/%s%s", c.scheme(ref.Registry), ref.Registry, ref.Repository, path)
+
+	send := func(auth string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return c.HTTP.Do(req)
+	}
+
+	resp, err := send("")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		auth, err := c.authorize(ctx, challenge, creds)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref.Repository, err)
+		}
+		resp, err = send(auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, target, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
+
+// authorize answers a WWW-Authenticate challenge with an Authorization header.
+func (c *Client) authorize(ctx context.Context, challenge string, creds Credentials) (string, error) {
+
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds.Username == "" {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+
+	case "bearer":
+		realm := params["realm"]
+		if realm == "" {
+			return "", fmt.Errorf("bearer challenge without realm")
+		}
+		q := url.Values{}
+		if params["service"] != "" {
+			q.Set("service", params["service"])
+		}
+		if params["scope"] != "" {
+			q.Set("scope", params["scope"])
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if creds.Username != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("fetch registry token: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("fetch registry token: %s", resp.Status)
+		}
+
+		var tok struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+			return "", fmt.Errorf("decode registry token: %w", err)
+		}
+		if tok.Token == "" {
+			tok.Token = tok.AccessToken
+		}
+
+		return "Bearer " + tok.Token, nil
+	}
+
+	return "", fmt.Errorf("unsupported auth challenge %q", challenge)
+}
+
+func (c *Client) scheme(registry string) string {
+
+	host := registry
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	if host == "localhost" || host == "127.0.0.1" {
+		return "http"
+	}
+	for _, r := range c.Insecure {
+		if r == registry {
+			return "http"
+		}
+	}
+
+	return "https"
+}
+
+// parseChallenge splits `Bearer realm="...",service="..."` into its parts.
+func parseChallenge(challenge string) (string, map[string]string) {
+
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	params := map[string]string{}
+
+	for rest != "" {
+		var pair string
+		// Values are quoted and may contain commas, e.g. scope lists.
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.TrimSpace(key)
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end < 0 {
+				break
+			}
+			pair = after[1 : end+1]
+			rest = strings.TrimPrefix(after[end+2:], ",")
+		} else {
+			pair, rest, _ = strings.Cut(after, ",")
+		}
+		params[key] = pair
+	}
+
+	return scheme, params
+}
+
+// nextPage returns the path of the next tag page from a Link header.
+func nextPage(link string, repository string) string {
+
+	if link == "" {
+		return ""
+	}
+
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+
+	u, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(u.Path, "/v2/"+repository) + "?" + u.RawQuery
+}
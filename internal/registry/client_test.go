@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// fakeRegistry serves the parts of the registry:2 API the client uses. It
+// wants a bearer token from its own /token endpoint and pages tags two at a
+// time, as Docker Hub does.
+func fakeRegistry(t *testing.T, repository string, tags []string) *httptest.Server {
+
+	t.Helper()
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") == "Bearer secret-token" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, srv.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	mux.HandleFunc("GET /token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "ci" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if got := r.URL.Query().Get("scope"); got != "repository:"+repository+":pull" {
+			t.Errorf("token scope = %q", got)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "secret-token"})
+	})
+
+	mux.HandleFunc("HEAD /v2/"+repository+"/manifests/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		if !slices.Contains(r.Header.Values("Accept"), "application/vnd.oci.image.index.v1+json") {
+			t.Errorf("manifest request does not accept OCI indexes: %v", r.Header.Values("Accept"))
+		}
+		if !slices.Contains(tags, r.PathValue("tag")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", testDigest)
+	})
+
+	mux.HandleFunc("GET /v2/"+repository+"/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		start := 0
+		if last := r.URL.Query().Get("last"); last != "" {
+			start = slices.Index(tags, last) + 1
+		}
+		end := min(start+2, len(tags))
+		if end < len(tags) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=2&last=%s>; rel="next"`, repository, tags[end-1]))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"name": repository, "tags": tags[start:end]})
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func testClient(srv *httptest.Server) (*Client, string) {
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	return NewClient(srv.Client(), []string{host}), host
+}
+
+func TestDigest(t *testing.T) {
+
+	srv := fakeRegistry(t, "team/app", []string{"latest", "1.0.0"})
+	c, host := testClient(srv)
+	creds := Credentials{Username: "ci", Password: "hunter2"}
+
+	digest, err := c.Digest(context.Background(), Reference{Registry: host, Repository: "team/app", Tag: "latest"}, creds)
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if digest != testDigest {
+		t.Errorf("Digest = %q, want %q", digest, testDigest)
+	}
+
+	if _, err := c.Digest(context.Background(), Reference{Registry: host, Repository: "team/app", Tag: "missing"}, creds); err == nil {
+		t.Error("Digest of a missing tag succeeded")
+	}
+
+	if _, err := c.Digest(context.Background(), Reference{Registry: host, Repository: "team/app", Tag: "latest"}, Credentials{}); err == nil {
+		t.Error("Digest without credentials succeeded")
+	}
+}
+
+func TestTags(t *testing.T) {
+
+	want := []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0-rc1", "latest"}
+	srv := fakeRegistry(t, "team/app", want)
+	c, host := testClient(srv)
+
+	got, err := c.Tags(context.Background(), Reference{Registry: host, Repository: "team/app", Tag: "latest"}, Credentials{Username: "ci", Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("Tags: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Tags = %v, want %v", got, want)
+	}
+
+	tag, ok := Policy{semver: true, major: 1, minor: -1}.Select(got)
+	if !ok || tag != "1.2.0" {
+		t.Errorf("Select(1.x) = %q, %v, want 1.2.0", tag, ok)
+	}
+}
+
+func TestScheme(t *testing.T) {
+
+	c := NewClient(http.DefaultClient, []string{"registry.lan:5000"})
+
+	tests := []struct {
+		registry string
+		want     string
+	}{
+		{"localhost:5000", "http"},
+		{"127.0.0.1:5000", "http"},
+		{"registry.lan:5000", "http"},
+		{"registry.lan", "https"},
+		{dockerHub, "https"},
+		{"ghcr.io", "https"},
+	}
+
+	for _, tt := range tests {
+		if got := c.scheme(tt.registry); got != tt.want {
+			t.Errorf("scheme(%q) = %q, want %q", tt.registry, got, tt.want)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("scheme = %q", scheme)
+	}
+
+	want := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull,push",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("params[%q] = %q, want %q", k, params[k], v)
+		}
+	}
+}
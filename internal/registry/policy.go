@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Policy picks which tag of a repository to follow. The zero Policy follows
+// the reference's own tag, watching its digest.
+type Policy struct {
+	semver bool
+	major  int // -1 matches any
+	minor  int // -1 matches any
+}
+
+// ParsePolicy accepts "" (follow the tag as is), "semver" (newest release),
+// "2.x" (newest 2.y.z) and "2.4.x" (newest 2.4 patch). A leading "v" and a
+// trailing ".x" are optional, so "2" and "v2.4" work too.
+func ParsePolicy(s string) (Policy, error) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Policy{}, nil
+	}
+
+	p := Policy{semver: true, major: -1, minor: -1}
+	if s == "semver" {
+		return p, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > 0 && parts[len(parts)-1] == "x" {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) == 0 || len(parts) > 2 {
+		return Policy{}, fmt.Errorf("invalid tag policy %q, expected semver, 2.x or 2.4.x", s)
+	}
+
+	nums := []*int{&p.major, &p.minor}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Policy{}, fmt.Errorf("invalid tag policy %q, expected semver, 2.x or 2.4.x", s)
+		}
+		*nums[i] = n
+	}
+
+	return p, nil
+}
+
+// Follows reports whether the policy tracks a fixed tag.
+func (p Policy) Follows() bool {
+	return !p.semver
+}
+
+func (p Policy) String() string {
+	switch {
+	case !p.semver:
+		return ""
+	case p.major < 0:
+		return "semver"
+	case p.minor < 0:
+		return fmt.Sprintf("%d.x", p.major)
+	default:
+		return fmt.Sprintf("%d.%d.x", p.major, p.minor)
+	}
+}
+
+// Select returns the newest tag the policy allows. Pre-release and variant
+// tags such as "2.4.1-rc1" or "2.4.1-alpine" are never picked.
+func (p Policy) Select(tags []string) (string, bool) {
+
+	var best string
+	var bestVer version
+
+	for _, tag := range tags {
+		v, ok := parseVersion(tag)
+		if !ok {
+			continue
+		}
+		if p.major >= 0 && v.major != p.major {
+			continue
+		}
+		if p.minor >= 0 && v.minor != p.minor {
+			continue
+		}
+		if best == "" || bestVer.less(v) {
+			best, bestVer = tag, v
+		}
+	}
+
+	return best, best != ""
+}
+
+type version struct {
+	major, minor, patch int
+	parts               int
+}
+
+func parseVersion(tag string) (version, bool) {
+
+	var v version
+
+	parts := strings.Split(strings.TrimPrefix(tag, "v"), ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	v.parts = len(parts)
+
+	return v, true
+}
+
+// less orders versions, preferring the fully qualified tag when "2.4" and
+// "2.4.0" compare equal.
+func (v version) less(o version) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	if v.patch != o.patch {
+		return v.patch < o.patch
+	}
+	return v.parts < o.parts
+}
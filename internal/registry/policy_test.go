@@ -0,0 +1,79 @@
+package registry
+
+import "testing"
+
+func TestParsePolicy(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		want    string
+		follows bool
+		wantErr bool
+	}{
+		{in: "", want: "", follows: true},
+		{in: "  ", want: "", follows: true},
+		{in: "semver", want: "semver"},
+		{in: "2.x", want: "2.x"},
+		{in: "2", want: "2.x"},
+		{in: "v2", want: "2.x"},
+		{in: "2.4.x", want: "2.4.x"},
+		{in: "v2.4", want: "2.4.x"},
+		{in: "2.4.1", wantErr: true},
+		{in: "x", wantErr: true},
+		{in: "latest", wantErr: true},
+		{in: "2.-1.x", wantErr: true},
+		{in: "2..x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePolicy(%q) = %v, want an error", tt.in, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePolicy(%q): %v", tt.in, err)
+			continue
+		}
+		if p.String() != tt.want || p.Follows() != tt.follows {
+			t.Errorf("ParsePolicy(%q) = %q (follows %v), want %q (follows %v)", tt.in, p, p.Follows(), tt.want, tt.follows)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+
+	tags := []string{"latest", "1.9.0", "2.3.7", "2.4", "2.4.0", "v2.4.2", "2.4.10-rc1", "2.4.3-alpine", "3.0.0", "nightly"}
+
+	tests := []struct {
+		policy string
+		want   string
+		ok     bool
+	}{
+		{"semver", "3.0.0", true},
+		{"2.x", "v2.4.2", true},
+		{"2.4.x", "v2.4.2", true},
+		{"2.3.x", "2.3.7", true},
+		{"1.x", "1.9.0", true},
+		{"4.x", "", false},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("ParsePolicy(%q): %v", tt.policy, err)
+		}
+		got, ok := p.Select(tags)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: Select = %q, %v, want %q, %v", tt.policy, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// Of two tags naming the same version, the fully qualified one wins.
+	p, _ := ParsePolicy("2.4.x")
+	if got, _ := p.Select([]string{"2.4.0", "2.4"}); got != "2.4.0" {
+		t.Errorf("Select(2.4.0, 2.4) = %q, want 2.4.0", got)
+	}
+}
@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+const dockerHub = "registry-1.docker.io"
+
+// Reference is an image reference split into the parts the registry API uses.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+}
+
+// ParseReference splits refs such as "nginx", "pihole/pihole:latest" or
+// "localhost:5000/team/app:1.2.3", applying Docker Hub's defaults.
+func ParseReference(ref string) (Reference, error) {
+
+	if ref == "" {
+		return Reference{}, fmt.Errorf("empty image reference")
+	}
+	if strings.Contains(ref, "@") {
+		return Reference{}, fmt.Errorf("%s: digest references cannot be watched", ref)
+	}
+
+	r := Reference{Registry: dockerHub, Tag: "latest"}
+
+	name := ref
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		r.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.Registry = parts[0]
+		name = parts[1]
+	}
+	if r.Registry == "docker.io" {
+		r.Registry = dockerHub
+	}
+	if r.Registry == dockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	r.Repository = name
+	return r, nil
+}
+
+// WithTag returns a copy of r pointing at tag.
+func (r Reference) WithTag(tag string) Reference {
+	r.Tag = tag
+	return r
+}
+
+// String returns the reference in the form Docker pulls it by.
+func (r Reference) String() string {
+
+	name := r.Repository
+	if r.Registry != dockerHub {
+		name = r.Registry + "/" + name
+	} else {
+		name = strings.TrimPrefix(name, "library/")
+	}
+
+	return name + ":" + r.Tag
+}
@@ -0,0 +1,233 @@
+package schedule
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a span of the week deploys are allowed in, or with Deny,
+// never allowed in. It is written as optional days and an optional time
+// range, e.g. "02:00-05:00", "Mon-Thu 22:00-02:00", "Sat,Sun" or "!Fri".
+// Times are the daemon's local time. A range that ends before it starts
+// runs past midnight and belongs to the day it starts on.
+type Window struct {
+	Deny bool
+	// Days holds the allowed weekdays, indexed by time.Weekday. All false
+	// means every day.
+	Days [7]bool
+	// From and To are minutes after midnight. Both zero means all day.
+	From, To int
+
+	spec string
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// Parse reads one window.
+func Parse(spec string) (Window, error) {
+
+	w := Window{spec: spec}
+	s := strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		w.Deny = true
+		s = strings.TrimSpace(rest)
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Window{}, fmt.Errorf("window %q: expected [days] [HH:MM-HH:MM]", spec)
+	}
+
+	if len(fields) == 2 && strings.Contains(fields[0], ":") == strings.Contains(fields[1], ":") {
+		return Window{}, fmt.Errorf("window %q: expected [days] [HH:MM-HH:MM]", spec)
+	}
+
+	for _, f := range fields {
+		var err error
+		if strings.Contains(f, ":") {
+			w.From, w.To, err = parseTimes(f)
+		} else {
+			w.Days, err = parseDays(f)
+		}
+		if err != nil {
+			return Window{}, fmt.Errorf("window %q: %w", spec, err)
+		}
+	}
+
+	return w, nil
+}
+
+// ParseAll reads every window in specs.
+func ParseAll(specs []string) (Windows, error) {
+
+	var ws Windows
+	for _, s := range specs {
+		w, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	return ws, nil
+}
+
+func (w Window) String() string {
+	return w.spec
+}
+
+// Contains reports whether t falls inside the window, ignoring Deny.
+func (w Window) Contains(t time.Time) bool {
+
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.From != w.To {
+		switch {
+		case w.From < w.To:
+			if minute < w.From || minute >= w.To {
+				return false
+			}
+		case minute >= w.From:
+		case minute < w.To:
+			// Past midnight, still the window of the day before.
+			day = (day + 6) % 7
+		default:
+			return false
+		}
+	}
+
+	return w.Days == [7]bool{} || w.Days[day]
+}
+
+// Windows are the maintenance windows of a repo.
+type Windows []Window
+
+// Open reports whether a deploy may start at t: no deny window contains it
+// and, when there are allow windows, at least one does. No windows at all
+// is always open.
+func (ws Windows) Open(t time.Time) bool {
+
+	allowed, anyAllow := false, false
+	for _, w := range ws {
+		if w.Deny {
+			if w.Contains(t) {
+				return false
+			}
+			continue
+		}
+		anyAllow = true
+		if w.Contains(t) {
+			allowed = true
+		}
+	}
+
+	return allowed || !anyAllow
+}
+
+// NextOpen returns the first minute after t at which a deploy may start,
+// or false when the windows never open. Openness only changes where a
+// window starts or ends or at midnight, so those are the only times
+// looked at, over the coming week.
+func (ws Windows) NextOpen(t time.Time) (time.Time, bool) {
+
+	var candidates []time.Time
+	for day := 0; day <= 7; day++ {
+		at := func(minute int) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day()+day, minute/60, minute%60, 0, 0, t.Location())
+		}
+		candidates = append(candidates, at(0))
+		for _, w := range ws {
+			candidates = append(candidates, at(w.From), at(w.To))
+		}
+	}
+	slices.SortFunc(candidates, time.Time.Compare)
+
+	for _, c := range candidates {
+		if c.After(t) && ws.Open(c) {
+			return c, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func parseDays(s string) ([7]bool, error) {
+
+	var days [7]bool
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		start, err := parseDay(from)
+		if err != nil {
+			return days, err
+		}
+		end := start
+		if isRange {
+			if end, err = parseDay(to); err != nil {
+				return days, err
+			}
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func parseDay(s string) (time.Weekday, error) {
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	if d, ok := dayNames[s]; ok {
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("unknown day %q", s)
+}
+
+func parseTimes(s string) (int, int, error) {
+
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("time range %q is not HH:MM-HH:MM", s)
+	}
+
+	start, err := parseClock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("time range %q is empty", s)
+	}
+
+	return start, end, nil
+}
+
+// parseClock reads HH:MM as minutes after midnight. 24:00 is the end of
+// the day.
+func parseClock(s string) (int, error) {
+
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 24 || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+
+	return hour*60 + minute, nil
+}
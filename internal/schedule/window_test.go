@@ -0,0 +1,148 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns the given weekday and time in the week of 2024-01-01, a Monday.
+func at(day time.Weekday, clock string) time.Time {
+
+	t, err := time.ParseInLocation("15:04", clock, time.UTC)
+	if err != nil {
+		panic(err)
+	}
+	offset := (int(day) + 6) % 7
+
+	return time.Date(2024, time.January, 1+offset, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func TestWindowContains(t *testing.T) {
+
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"02:00-05:00", at(time.Wednesday, "02:00"), true},
+		{"02:00-05:00", at(time.Wednesday, "04:59"), true},
+		{"02:00-05:00", at(time.Wednesday, "05:00"), false},
+		{"02:00-05:00", at(time.Wednesday, "01:59"), false},
+
+		{"Sat,Sun", at(time.Saturday, "13:00"), true},
+		{"Sat,Sun", at(time.Friday, "23:59"), false},
+		{"Mon-Thu", at(time.Thursday, "12:00"), true},
+		{"Mon-Thu", at(time.Friday, "12:00"), false},
+		{"Fri-Mon", at(time.Sunday, "12:00"), true},
+		{"Fri-Mon", at(time.Tuesday, "12:00"), false},
+
+		// Past midnight belongs to the day the range starts on.
+		{"Mon-Thu 22:00-02:00", at(time.Thursday, "23:00"), true},
+		{"Mon-Thu 22:00-02:00", at(time.Friday, "01:30"), true},
+		{"Mon-Thu 22:00-02:00", at(time.Friday, "23:00"), false},
+		{"Mon-Thu 22:00-02:00", at(time.Monday, "01:30"), false},
+		{"Mon-Thu 22:00-02:00", at(time.Tuesday, "02:00"), false},
+
+		{"20:00-24:00", at(time.Monday, "23:59"), true},
+		{"20:00-24:00", at(time.Tuesday, "00:00"), false},
+
+		// Deny is ignored by Contains.
+		{"!Fri", at(time.Friday, "09:00"), true},
+	}
+
+	for _, tt := range tests {
+		w, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		if got := w.Contains(tt.t); got != tt.want {
+			t.Errorf("%q contains %s = %v, want %v", tt.spec, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestWindowsOpen(t *testing.T) {
+
+	tests := []struct {
+		specs []string
+		t     time.Time
+		want  bool
+	}{
+		{nil, at(time.Friday, "12:00"), true},
+		{[]string{"!Fri"}, at(time.Friday, "12:00"), false},
+		{[]string{"!Fri"}, at(time.Saturday, "12:00"), true},
+		{[]string{"02:00-05:00", "Sat,Sun"}, at(time.Saturday, "12:00"), true},
+		{[]string{"02:00-05:00", "Sat,Sun"}, at(time.Monday, "03:00"), true},
+		{[]string{"02:00-05:00", "Sat,Sun"}, at(time.Monday, "12:00"), false},
+		{[]string{"02:00-05:00", "!Fri"}, at(time.Friday, "03:00"), false},
+		{[]string{"02:00-05:00", "!Fri"}, at(time.Thursday, "03:00"), true},
+	}
+
+	for _, tt := range tests {
+		ws, err := ParseAll(tt.specs)
+		if err != nil {
+			t.Fatalf("ParseAll(%q): %v", tt.specs, err)
+		}
+		if got := ws.Open(tt.t); got != tt.want {
+			t.Errorf("%q open at %s = %v, want %v", tt.specs, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestWindowsNextOpen(t *testing.T) {
+
+	tests := []struct {
+		specs []string
+		t     time.Time
+		want  time.Time
+		ok    bool
+	}{
+		{[]string{"02:00-05:00"}, at(time.Monday, "12:00"), at(time.Tuesday, "02:00"), true},
+		{[]string{"02:00-05:00"}, at(time.Monday, "01:00"), at(time.Monday, "02:00"), true},
+		{[]string{"Sat,Sun"}, at(time.Wednesday, "09:30"), at(time.Saturday, "00:00"), true},
+		{[]string{"!Fri"}, at(time.Friday, "09:30"), at(time.Saturday, "00:00"), true},
+		// Wednesday's range runs on past midnight, where !Wed no longer
+		// applies.
+		{[]string{"Mon-Thu 22:00-02:00", "!Wed"}, at(time.Wednesday, "23:00"), at(time.Thursday, "00:00"), true},
+		{[]string{"Mon-Thu 22:00-02:00", "!Wed"}, at(time.Thursday, "03:00"), at(time.Thursday, "22:00"), true},
+		{[]string{"Sat", "!Sat"}, at(time.Monday, "12:00"), time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		ws, err := ParseAll(tt.specs)
+		if err != nil {
+			t.Fatalf("ParseAll(%q): %v", tt.specs, err)
+		}
+		got, ok := ws.NextOpen(tt.t)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("%q next open after %s = %s, %v, want %s, %v", tt.specs, tt.t.Format("Mon 15:04"), got.Format("Mon 15:04"), ok, tt.want.Format("Mon 15:04"), tt.ok)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"02:00-05:00", true},
+		{"Mon-Thu 22:00-02:00", true},
+		{"!Fri", true},
+		{"saturday,sunday", true},
+		{"", false},
+		{"02:00-02:00", false},
+		{"25:00-26:00", false},
+		{"Funday", false},
+		{"Mon Tue", false},
+		{"02:00 05:00", false},
+		{"Mon 02:00-05:00 extra", false},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse(%q) = %v, want ok %v", tt.spec, err, tt.ok)
+		}
+	}
+}
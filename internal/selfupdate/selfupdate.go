@@ -0,0 +1,268 @@
+package selfupdate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// UpdaterName is the name of the short-lived helper container. It is left
+// behind once it exits so the next daemon can read how the update went.
+const UpdaterName = "lighthouse-updater"
+
+// ExitRolledBack is the helper's exit code when the new daemon never became
+// healthy and the previous one was restored.
+const ExitRolledBack = 3
+
+var ErrRolledBack = errors.New("new daemon did not become healthy, rolled back")
+
+type Options struct {
+	Container string
+	Image     string
+	HealthURL string
+	Deadline  time.Duration
+}
+
+func (o Options) args() []string {
+	return []string{
+		"self-update",
+		"-container", o.Container,
+		"-image", o.Image,
+		"-health-url", o.HealthURL,
+		"-deadline", o.Deadline.String(),
+	}
+}
+
+func ParseArgs(args []string) (Options, error) {
+
+	var opts Options
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	fs.StringVar(&opts.Container, "container", "lighthouse", "name of the daemon container to replace")
+	fs.StringVar(&opts.Image, "image", "", "image the new daemon runs")
+	fs.StringVar(&opts.HealthURL, "health-url", "http://lighthouse:2000/healthz", "URL that answers 200 once the new daemon is up")
+	fs.DurationVar(&opts.Deadline, "deadline", 2*time.Minute, "how long the new daemon has to become healthy")
+
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+	if opts.Image == "" {
+		return Options{}, fmt.Errorf("self-update: -image is required")
+	}
+
+	return opts, nil
+}
+
+// Launch starts the helper container that swaps the running daemon for one
+// on opts.Image. The helper runs the new image, shares the daemon's Docker
+// socket and networks, and outlives the daemon it stops.
+func Launch(ctx context.Context, docker *client.Client, opts Options) error {
+
+	current, err := docker.ContainerInspect(ctx, opts.Container)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", opts.Container, err)
+	}
+
+	if err := removeIfExists(ctx, docker, UpdaterName); err != nil {
+		return err
+	}
+
+	endpoints := map[string]*network.EndpointSettings{}
+	for name := range current.NetworkSettings.Networks {
+		endpoints[name] = &network.EndpointSettings{}
+	}
+
+	cfg := &container.Config{
+		Image:  opts.Image,
+		Cmd:    append([]string{"/lighthouse"}, opts.args()...),
+		Labels: map[string]string{"managed-by": "lighthouse"},
+	}
+	hostCfg := &container.HostConfig{
+		Binds: []string{"/var/run/docker.sock:/var/run/docker.sock"},
+	}
+
+	created, err := docker.ContainerCreate(ctx, cfg, hostCfg, &network.NetworkingConfig{EndpointsConfig: endpoints}, nil, UpdaterName)
+	if err != nil {
+		return fmt.Errorf("create updater: %w", err)
+	}
+
+	if err := docker.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("start updater: %w", err)
+	}
+
+	return nil
+}
+
+// Run is the helper side of a self-update. It recreates opts.Container on
+// the new image with the same mounts and networks, and restores the
+// previous container if the new one is not healthy before the deadline.
+func Run(ctx context.Context, docker *client.Client, opts Options) error {
+
+	log := slog.With("container", opts.Container, "image", opts.Image)
+	previousName := opts.Container + "-previous"
+
+	old, err := docker.ContainerInspect(ctx, opts.Container)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", opts.Container, err)
+	}
+
+	if err := removeIfExists(ctx, docker, previousName); err != nil {
+		return err
+	}
+
+	log.Info("stopping current daemon")
+	if err := docker.ContainerRename(ctx, old.ID, previousName); err != nil {
+		return fmt.Errorf("rename %s: %w", opts.Container, err)
+	}
+	if err := docker.ContainerStop(ctx, old.ID, container.StopOptions{}); err != nil {
+		restore(ctx, docker, old.ID, opts.Container, log)
+		return fmt.Errorf("stop %s: %w", opts.Container, err)
+	}
+
+	cfg := old.Config
+	cfg.Image = opts.Image
+	cfg.Hostname = ""
+
+	endpoints := map[string]*network.EndpointSettings{}
+	for name, ep := range old.NetworkSettings.Networks {
+		endpoints[name] = &network.EndpointSettings{Aliases: ep.Aliases}
+	}
+
+	created, err := docker.ContainerCreate(ctx, cfg, old.HostConfig, &network.NetworkingConfig{EndpointsConfig: endpoints}, nil, opts.Container)
+	if err != nil {
+		restore(ctx, docker, old.ID, opts.Container, log)
+		return fmt.Errorf("create new daemon: %w", err)
+	}
+
+	log.Info("starting new daemon", "id", created.ID)
+	if err := docker.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		docker.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+		restore(ctx, docker, old.ID, opts.Container, log)
+		return fmt.Errorf("start new daemon: %w", err)
+	}
+
+	if err := waitHealthy(ctx, docker, created.ID, opts.HealthURL, opts.Deadline); err != nil {
+		log.Error("new daemon unhealthy, rolling back", "err", err)
+		docker.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+		restore(ctx, docker, old.ID, opts.Container, log)
+		return fmt.Errorf("%w: %v", ErrRolledBack, err)
+	}
+
+	log.Info("new daemon healthy, removing previous container")
+	if err := docker.ContainerRemove(ctx, old.ID, container.RemoveOptions{}); err != nil {
+		log.Warn("failed to remove previous container", "err", err)
+	}
+
+	return nil
+}
+
+// Result reports how the last self-update went, if there was one. A helper
+// still running is waiting for this daemon to become healthy, so Result
+// waits for it to exit. The helper container is removed once read.
+func Result(ctx context.Context, docker *client.Client) (done bool, rolledBack bool, err error) {
+
+	info, err := docker.ContainerInspect(ctx, UpdaterName)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+
+	if info.State != nil && info.State.Running {
+		waitCh, errCh := docker.ContainerWait(ctx, info.ID, container.WaitConditionNotRunning)
+		select {
+		case <-waitCh:
+		case err := <-errCh:
+			return false, false, fmt.Errorf("wait for %s: %w", UpdaterName, err)
+		}
+		if info, err = docker.ContainerInspect(ctx, info.ID); err != nil {
+			return false, false, err
+		}
+	}
+	if info.State == nil {
+		return false, false, nil
+	}
+
+	rolledBack = info.State.ExitCode == ExitRolledBack
+	if err := docker.ContainerRemove(ctx, info.ID, container.RemoveOptions{}); err != nil {
+		return true, rolledBack, fmt.Errorf("remove %s: %w", UpdaterName, err)
+	}
+
+	return true, rolledBack, nil
+}
+
+func waitHealthy(ctx context.Context, docker *client.Client, id string, healthURL string, deadline time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	httpClient := &http.Client{Timeout: 3 * time.Second}
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return lastErr
+		case <-ticker.C:
+		}
+
+		info, err := docker.ContainerInspect(ctx, id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if info.State == nil || !info.State.Running {
+			return fmt.Errorf("new daemon exited")
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		lastErr = fmt.Errorf("health check returned %s", resp.Status)
+	}
+}
+
+// restore puts the previous daemon back under its own name and starts it.
+func restore(ctx context.Context, docker *client.Client, id string, name string, log *slog.Logger) {
+
+	if err := docker.ContainerRename(ctx, id, name); err != nil {
+		log.Error("failed to rename previous daemon back", "err", err)
+	}
+	if err := docker.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		log.Error("failed to restart previous daemon", "err", err)
+	}
+}
+
+func removeIfExists(ctx context.Context, docker *client.Client, name string) error {
+
+	err := docker.ContainerRemove(ctx, name, container.RemoveOptions{Force: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+
+	return nil
+}
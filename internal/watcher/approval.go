@@ -0,0 +1,223 @@
+package watcher
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+// requestApproval queues the new commit of a repo that requires approval
+// and lets the operators know. Must be called with w.mu held.
+func (w *Watcher) requestApproval(repo models.WatchedRepo, latest latestCommit) models.WatchedRepo {
+
+	for _, a := range repo.PendingApprovals {
+		if a.SHA == latest.SHA {
+			return repo
+		}
+	}
+
+	pending := models.PendingApproval{
+		SHA:        latest.SHA,
+		Message:    firstLine(latest.Message),
+		Author:     latest.Author,
+		DetectedAt: time.Now(),
+	}
+	repo.PendingApprovals = models.QueueApproval(repo.PendingApprovals, pending)
+
+	summary := fmt.Sprintf("%s (%s)", pending.Message, pending.Author)
+	slog.Info("commit awaiting approval", "repo", repo.DisplayName, "sha", latest.SHA, "author", pending.Author)
+	repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "approval.pending", SHA: latest.SHA, Message: summary})
+	w.publish(events.Event{
+		Kind:    events.KindApprovalPending,
+		Repo:    repo.DisplayName,
+		SHA:     latest.SHA,
+		Message: summary,
+	})
+
+	return repo
+}
+
+// expireApprovals drops the commits that waited longer than the configured
+// expiry. Must be called with w.mu held.
+func (w *Watcher) expireApprovals(now time.Time) {
+
+	expiry := w.Config().Approval.Expiry
+	if expiry == 0 {
+		return
+	}
+
+	for i := range w.WatchList {
+		repo := &w.WatchList[i]
+
+		var kept []models.PendingApproval
+		for _, a := range repo.PendingApprovals {
+			if now.Before(a.DetectedAt.Add(expiry)) {
+				kept = append(kept, a)
+				continue
+			}
+
+			message := fmt.Sprintf("not approved within %s", expiry)
+			slog.Info("approval expired", "repo", repo.DisplayName, "sha", a.SHA)
+			repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "approval.expired", SHA: a.SHA, Message: message})
+			w.publish(events.Event{
+				Kind:    events.KindApprovalExpired,
+				Repo:    repo.DisplayName,
+				SHA:     a.SHA,
+				Message: message,
+			})
+		}
+
+		if len(kept) != len(repo.PendingApprovals) {
+			repo.PendingApprovals = kept
+			w.Builder.SetWatchList(w.WatchList)
+			w.storeWatchList()
+		}
+	}
+}
+
+// Approvals lists the commits waiting for approval across all repos, oldest
+// first within each repo.
+func (w *Watcher) Approvals() []models.PendingApproval {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	expiry := w.Config().Approval.Expiry
+
+	approvals := []models.PendingApproval{}
+	for _, repo := range w.WatchList {
+		for _, a := range repo.PendingApprovals {
+			a.Repo = repo.DisplayName
+			if expiry > 0 {
+				expiresAt := a.DetectedAt.Add(expiry)
+				a.ExpiresAt = &expiresAt
+			}
+			approvals = append(approvals, a)
+		}
+	}
+
+	return approvals
+}
+
+// Approve releases a commit of repo for deploy, the newest waiting one when
+// sha is empty, and returns its full SHA. The commits queued before it are
+// dropped, since deploying it deploys them too. Pauses and maintenance
+// windows still apply.
+func (w *Watcher) Approve(name string, sha string) (string, error) {
+
+	var approved models.PendingApproval
+	err := w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		i, err := findApproval(*repo, sha)
+		if err != nil {
+			return err
+		}
+		approved = repo.PendingApprovals[i]
+		repo.PendingApprovals = append([]models.PendingApproval(nil), repo.PendingApprovals[i+1:]...)
+		repo.Stats.Updates.PendingCommitSha = &approved.SHA
+		repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "approval.approved", SHA: approved.SHA, Message: approved.Message})
+
+		if reason := holdReason(*repo, time.Now()); reason != "" {
+			repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "build.held", SHA: approved.SHA, Message: reason})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("commit approved", "repo", name, "sha", approved.SHA)
+	w.pollSoon(name)
+	return approved.SHA, nil
+}
+
+// Reject drops a waiting commit of repo, or every waiting commit when sha
+// is empty, and returns the SHAs dropped.
+func (w *Watcher) Reject(name string, sha string) ([]string, error) {
+
+	var rejected []string
+	err := w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		var kept []models.PendingApproval
+		if sha == "" {
+			if len(repo.PendingApprovals) == 0 {
+				return fmt.Errorf("%s has no commits awaiting approval", repo.DisplayName)
+			}
+		} else {
+			i, err := findApproval(*repo, sha)
+			if err != nil {
+				return err
+			}
+			kept = append(kept, repo.PendingApprovals[:i]...)
+			kept = append(kept, repo.PendingApprovals[i+1:]...)
+		}
+
+		for _, a := range repo.PendingApprovals {
+			if sha != "" && !strings.HasPrefix(a.SHA, sha) {
+				continue
+			}
+			rejected = append(rejected, a.SHA)
+			repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "approval.rejected", SHA: a.SHA, Message: a.Message})
+		}
+		repo.PendingApprovals = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("commits rejected", "repo", name, "shas", rejected)
+	return rejected, nil
+}
+
+// SetApproval sets whether new commits of a repo wait for approval, with
+// approval "required" or "" for deploying them straight away.
+func (w *Watcher) SetApproval(name string, approval string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+	if approval != "" && approval != models.ApprovalRequired {
+		return fmt.Errorf("approval %q is not %q or empty", approval, models.ApprovalRequired)
+	}
+
+	return w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.Approval = approval
+		return nil
+	})
+}
+
+// findApproval returns the index of the waiting commit of repo sha is a
+// prefix of, or of the newest one when sha is empty.
+func findApproval(repo models.WatchedRepo, sha string) (int, error) {
+
+	if len(repo.PendingApprovals) == 0 {
+		return 0, fmt.Errorf("%s has no commits awaiting approval", repo.DisplayName)
+	}
+	if sha == "" {
+		return len(repo.PendingApprovals) - 1, nil
+	}
+
+	found := -1
+	for i, a := range repo.PendingApprovals {
+		if !strings.HasPrefix(a.SHA, sha) {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("%s matches more than one commit of %s", sha, repo.DisplayName)
+		}
+		found = i
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%s is not awaiting approval for %s", sha, repo.DisplayName)
+	}
+
+	return found, nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSpace(line)
+}
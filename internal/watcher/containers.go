@@ -0,0 +1,160 @@
+package watcher
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+const (
+	// Deaths within crashLoopWindow that count as a crash loop.
+	crashLoopDeaths = 3
+	crashLoopWindow = 10 * time.Minute
+)
+
+// recordContainerEvent adds a container event to the stats and history of
+// the repo or service it belongs to, and reports crash loops.
+func (w *Watcher) recordContainerEvent(e events.Event) {
+
+	// Deliberate stops are only interesting to the reconciler.
+	if e.Kind == events.KindContainerStopped {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry := models.HistoryEntry{Time: e.Time, Event: string(e.Kind), SHA: e.SHA, Message: e.Message}
+
+	for i := range w.WatchList {
+		repo := &w.WatchList[i]
+		if repo.DisplayName != e.Repo && !strings.EqualFold(repo.ContainerName, e.Container) {
+			continue
+		}
+		repo.Stats.Containers = models.RecordContainerEvent(repo.Stats.Containers, string(e.Kind), e.Status, e.Time)
+		repo.History = models.AppendHistory(repo.History, entry)
+		w.checkCrashLoop(repo.DisplayName, repo.History, e)
+		w.Builder.SetWatchList(w.WatchList)
+		w.storeWatchList()
+		return
+	}
+
+	for i := range w.Services {
+		svc := &w.Services[i]
+		if svc.Name != e.Repo && svc.ContainerName != e.Container {
+			continue
+		}
+		svc.Stats.Containers = models.RecordContainerEvent(svc.Stats.Containers, string(e.Kind), e.Status, e.Time)
+		svc.History = models.AppendHistory(svc.History, entry)
+		w.checkCrashLoop(svc.Name, svc.History, e)
+		w.Builder.SetServices(w.Services)
+		w.storeServices()
+		return
+	}
+
+	slog.Debug("container event for unknown repo", "repo", e.Repo, "container", e.Container, "kind", e.Kind)
+}
+
+// checkCrashLoop publishes a crash loop when the death just recorded is the
+// crashLoopDeaths-th within crashLoopWindow, so each loop is reported once.
+func (w *Watcher) checkCrashLoop(name string, history []models.HistoryEntry, e events.Event) {
+
+	if e.Kind != events.KindContainerDied {
+		return
+	}
+
+	deaths := models.RecentEvents(history, string(events.KindContainerDied), e.Time.Add(-crashLoopWindow))
+	if deaths != crashLoopDeaths {
+		return
+	}
+
+	slog.Error("container is crash looping", "repo", name, "container", e.Container, "deaths", deaths)
+	w.publish(events.Event{
+		Kind:      events.KindContainerCrashLoop,
+		Repo:      name,
+		Container: e.Container,
+		SHA:       e.SHA,
+		Message:   fmt.Sprintf("%s died %d times in %s, last with code %s", e.Container, deaths, crashLoopWindow, e.Status),
+	})
+}
+
+// buildHistory describes the outcome of a build or deploy for history.
+func buildHistory(repo models.WatchedRepo, buildID string, trigger string, err error) models.HistoryEntry {
+
+	entry := models.HistoryEntry{Event: "build.succeeded", Message: trigger + " " + buildID}
+	if sha := repo.Stats.Updates.LastSeenCommitSha; sha != nil {
+		entry.SHA = *sha
+	}
+	if err != nil {
+		entry.Event = "build.failed"
+		entry.Message = fmt.Sprintf("%s %s: %v", trigger, buildID, err)
+	}
+
+	return entry
+}
+
+// deployHistory describes the outcome of a managed service deploy for history.
+func deployHistory(deployID string, err error) models.HistoryEntry {
+
+	if err != nil {
+		return models.HistoryEntry{Event: "deploy.failed", Message: fmt.Sprintf("%s: %v", deployID, err)}
+	}
+
+	return models.HistoryEntry{Event: "deploy.succeeded", Message: deployID}
+}
+
+// History returns the recorded history of a repo or managed service.
+func (w *Watcher) History(name string) ([]models.HistoryEntry, bool) {
+
+	if repo, ok := w.lookupRepo(name); ok {
+		return slices.Clone(repo.History), true
+	}
+	if svc, ok := w.GetService(name); ok {
+		return slices.Clone(svc.History), true
+	}
+
+	return nil, false
+}
+
+// ResolveContainers lists the containers belonging to a repo or managed
+// service, primary container first.
+func (w *Watcher) ResolveContainers(name string) ([]string, error) {
+
+	var containers []string
+	var err error
+
+	if svc, ok := w.GetService(name); ok {
+		containers, err = w.Builder.ServiceContainers(svc)
+	} else if repo, ok := w.GetRepo(name); ok {
+		containers, err = w.Builder.RepoContainers(repo)
+	} else {
+		return nil, fmt.Errorf("%s is not a watched repo or managed service", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("%s has no containers", name)
+	}
+
+	return containers, nil
+}
+
+// hostPorts lists the host ports owner holds, for display.
+func (w *Watcher) hostPorts(owner string) string {
+
+	var held []string
+	for _, a := range w.Builder.Ports.Owned(owner) {
+		held = append(held, fmt.Sprintf("%d/%s", a.HostPort, a.Protocol))
+	}
+	if len(held) == 0 {
+		return "-"
+	}
+
+	return strings.Join(held, ", ")
+}
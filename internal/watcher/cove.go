@@ -2,30 +2,72 @@ package watcher
 
 import (
 	"fmt"
-	"os"
+	"log/slog"
+	"time"
 
+	"github.com/LSariol/LightHouse/internal/config"
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/metrics"
 	"github.com/lsariol/coveclient"
 )
 
 func (w *Watcher) loadGitCredentials() error {
 
-	fmt.Println("Getting GITHUB PAT")
+	slog.Debug("loading GitHub PAT from Cove")
 
+	start := time.Now()
 	gitToken, err := w.CC.GetSecret("LIGHTHOUSE_GITHUB_PAT")
+	metrics.ObserveCoveLookup(start, err)
 	if err != nil {
-		fmt.Println(err)
 		return fmt.Errorf("loadGitCredentials: %v", err)
 	}
 
-	fmt.Println("GOT TOKEN")
-	w.GitToken = gitToken
+	logging.AddSecret(gitToken)
+	slog.Info("loaded GitHub PAT from Cove")
+	w.mu.Lock()
+	w.gitToken = gitToken
+	w.mu.Unlock()
 	return nil
 }
 
-func NewCoveClient() *coveclient.Client {
+// Backoff between attempts to load the GitHub PAT.
+const (
+	credentialsRetryMin = time.Second
+	credentialsRetryMax = time.Minute
+)
+
+// awaitGitCredentials loads the GitHub PAT, retrying with backoff until it
+// succeeds or the daemon stops.
+func (w *Watcher) awaitGitCredentials() error {
+
+	wait := credentialsRetryMin
+	for {
+		err := w.loadGitCredentials()
+		if err == nil {
+			return nil
+		}
+		slog.Error("cannot poll GitHub without the PAT, retrying", "err", err, "retry_in", wait)
+
+		select {
+		case <-w.Ctx.Done():
+			return fmt.Errorf("gave up loading the GitHub PAT: %w", err)
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, credentialsRetryMax)
+	}
+}
+
+// Token returns the GitHub PAT loaded from Cove.
+func (w *Watcher) Token() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.gitToken
+}
+
+func NewCoveClient(cfg config.Cove) *coveclient.Client {
 
-	clientSecret := os.Getenv("COVE_CLIENT_SECRET")
-	var coveClient *coveclient.Client = coveclient.New(os.Getenv("COVE_ADDRESS"), clientSecret, "lighthouse")
+	clientSecret := cfg.ClientSecret
+	var coveClient *coveclient.Client = coveclient.New(cfg.Address, clientSecret, "lighthouse")
 
 	if clientSecret == "" {
 		clientSecret, err := coveClient.Bootstrap()
@@ -35,5 +77,7 @@ func NewCoveClient() *coveclient.Client {
 		coveClient.ClientSecret = clientSecret
 	}
 
+	logging.AddSecret(coveClient.ClientSecret)
+
 	return coveClient
 }
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/pathfilter"
+)
+
+// skipMarkers in the message of a new commit keep it from being deployed.
+// They are matched without regard to case.
+var skipMarkers = []string{"[skip deploy]", "[deploy skip]"}
+
+// skipReason says why the new commit latest of repo is not deployed, or
+// returns an empty string when it is. Changed files are compared against
+// the commit last deployed, so everything since then counts. When the
+// comparison cannot be made the commit is deployed.
+func (w *Watcher) skipReason(repo models.WatchedRepo, latest latestCommit) string {
+
+	message := strings.ToLower(latest.Message)
+	for _, marker := range skipMarkers {
+		if strings.Contains(message, marker) {
+			return "commit message has " + marker
+		}
+	}
+
+	filter := repo.Filter()
+	deployed := repo.Stats.Builds.DeployedSha
+	if filter.Empty() || deployed == nil || *deployed == latest.SHA {
+		return ""
+	}
+
+	files, complete, err := w.changedFiles(repo.APIURL, w.Token(), *deployed, latest.SHA)
+	if err != nil {
+		slog.Warn("could not list changed files, deploying without path filters", "repo", repo.DisplayName, "sha", latest.SHA, "err", err)
+		return ""
+	}
+	if !complete || filter.Any(files) {
+		return ""
+	}
+
+	return fmt.Sprintf("none of the %d files changed since %s match the path filters", len(files), shortSHA(*deployed))
+}
+
+// SetPaths sets the paths a change has to touch to deploy a repo. No paths
+// deploys on changes anywhere.
+func (w *Watcher) SetPaths(name string, paths []string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+	if err := pathfilter.Validate(paths); err != nil {
+		return err
+	}
+
+	return w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.Paths = paths
+		return nil
+	})
+}
+
+// SetIgnorePaths sets the paths whose changes never deploy a repo.
+func (w *Watcher) SetIgnorePaths(name string, ignore []string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+	if err := pathfilter.Validate(ignore); err != nil {
+		return err
+	}
+
+	return w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.IgnorePaths = ignore
+		return nil
+	})
+}
+
+func shortSHA(sha string) string {
+	return sha[:min(7, len(sha))]
+}
@@ -4,15 +4,49 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/metrics"
 )
 
-func (w *Watcher) getLatestSHA(URL string, PAT string) (string, error) {
+// apiError is returned when GitHub answers with a non 200 status.
+type apiError struct {
+	StatusCode   int
+	Status       string
+	RateLimitHit bool
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("GitHub API Error: %s", e.Status)
+}
+
+// decodeError is returned when GitHub's response cannot be understood.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("decode GitHub response: %v", e.err)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+type latestCommit struct {
+	SHA         string
+	CommittedAt time.Time
+	Message     string
+	Author      string
+}
+
+func (w *Watcher) getLatestSHA(URL string, PAT string) (latestCommit, error) {
 
 	req, err := http.NewRequest("GET", URL+"/commits", nil)
 	if err != nil {
-		return "", err
+		return latestCommit{}, err
 	}
 
 	req.Header.Set("Authorization", "token "+PAT)
@@ -20,25 +54,122 @@ func (w *Watcher) getLatestSHA(URL string, PAT string) (string, error) {
 
 	resp, err := w.HTTP.Do(req)
 	if err != nil {
-		return "", err
+		return latestCommit{}, err
 	}
 	defer resp.Body.Close()
 
+	remaining, rateErr := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if rateErr == nil {
+		metrics.GitHubRateLimitRemaining.Set(float64(remaining))
+	}
+
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("GitHub API Error: %s", resp.Status)
+		return latestCommit{}, &apiError{
+			StatusCode:   resp.StatusCode,
+			Status:       resp.Status,
+			RateLimitHit: rateErr == nil && remaining == 0,
+		}
 	}
 
 	body, err := io.ReadAll(resp.Body)
 
 	if err != nil {
-		return "", err
+		return latestCommit{}, err
 	}
 
-	var commits []map[string]interface{}
+	var commits []struct {
+		SHA    string `json:"sha"`
+		Commit struct {
+			Message string `json:"message"`
+			Author  struct {
+				Name string `json:"name"`
+			} `json:"author"`
+			Committer struct {
+				Date time.Time `json:"date"`
+			} `json:"committer"`
+		} `json:"commit"`
+	}
 	err = json.Unmarshal(body, &commits)
 	if err != nil {
-		log.Fatal("Failed to unmarshal:", err)
+		return latestCommit{}, &decodeError{err: err}
+	}
+
+	if len(commits) == 0 {
+		return latestCommit{}, &decodeError{err: fmt.Errorf("no commits returned")}
+	}
+
+	return latestCommit{
+		SHA:         commits[0].SHA,
+		CommittedAt: commits[0].Commit.Committer.Date,
+		Message:     commits[0].Commit.Message,
+		Author:      commits[0].Commit.Author.Name,
+	}, nil
+}
+
+// GitHub lists at most this many files in a comparison, so a full page may
+// be missing some.
+const compareFileLimit = 300
+
+// changedFiles lists the files that differ between base and head, renamed
+// files under both names. complete is false when GitHub cut the list short.
+func (w *Watcher) changedFiles(URL string, PAT string, base string, head string) (files []string, complete bool, err error) {
+
+	req, err := http.NewRequest("GET", URL+"/compare/"+base+"..."+head, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "token "+PAT)
+
+	resp, err := w.HTTP.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, false, &apiError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var comparison struct {
+		Files []struct {
+			Filename         string `json:"filename"`
+			PreviousFilename string `json:"previous_filename"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&comparison); err != nil {
+		return nil, false, &decodeError{err: err}
+	}
+
+	for _, f := range comparison.Files {
+		files = append(files, f.Filename)
+		if f.PreviousFilename != "" {
+			files = append(files, f.PreviousFilename)
+		}
+	}
+
+	return files, len(comparison.Files) < compareFileLimit, nil
+}
+
+// pollErrorType buckets a getLatestSHA error for the poll error metric.
+func pollErrorType(err error) string {
+
+	if _, ok := err.(*decodeError); ok {
+		return "decode"
+	}
+
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		return "network"
+	}
+
+	switch {
+	case apiErr.RateLimitHit:
+		return "rate_limit"
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		return "auth"
+	case apiErr.StatusCode == http.StatusNotFound:
+		return "not_found"
+	default:
+		return "http"
 	}
-	shaHash := commits[0]["sha"].(string)
-	return shaHash, nil
 }
@@ -0,0 +1,274 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/gitops"
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+// errGitOps is returned by edits to the watchlist or services while they
+// come from the infra repo, where the edit would be overwritten.
+var errGitOps = errors.New("the watchlist and services are managed by the GitOps repo, change them there")
+
+// gitOps reports whether the watchlist and services come from an infra repo.
+func (w *Watcher) gitOps() bool {
+	return w.Config().GitOps.Repo != ""
+}
+
+// syncGitOps applies the definitions in the infra repo when it has a new
+// commit. A commit with an invalid definition is rejected as a whole and
+// the running watchlist and services are kept.
+func (w *Watcher) syncGitOps() error {
+
+	cfg := w.Config().GitOps
+	if cfg.Repo == "" {
+		return nil
+	}
+
+	_, apiURL, _, err := parseURL(cfg.Repo)
+	if err != nil {
+		return fmt.Errorf("syncGitOps: %w", err)
+	}
+
+	latest, err := w.getLatestSHA(apiURL, w.Token())
+	if err != nil {
+		return fmt.Errorf("syncGitOps: %w", err)
+	}
+	if latest.SHA == w.gitopsSHA {
+		return nil
+	}
+
+	data, err := w.downloadArchive(apiURL, latest.SHA)
+	if err != nil {
+		return fmt.Errorf("syncGitOps: %w", err)
+	}
+
+	// Whatever the outcome, the commit is not tried again, so a broken one
+	// is reported once rather than on every scan.
+	w.gitopsSHA = latest.SHA
+
+	defs, err := gitops.ReadArchive(data, cfg.Path)
+	if errors.Is(err, gitops.ErrNoDefinitions) && w.managesNothing() {
+		// Nothing is defined yet and nothing runs, so there is nothing to
+		// protect.
+		return nil
+	}
+	if err != nil {
+		slog.Error("infra repo rejected, keeping the running watchlist and services", "sha", latest.SHA, "err", err)
+		return fmt.Errorf("syncGitOps: %w", err)
+	}
+
+	if err := w.applyDefinitions(defs, cfg.Prune); err != nil {
+		slog.Error("failed to apply infra repo", "sha", latest.SHA, "err", err)
+		return fmt.Errorf("syncGitOps: %w", err)
+	}
+
+	slog.Info("infra repo applied", "sha", latest.SHA, "definitions", len(defs))
+	return nil
+}
+
+// managesNothing reports whether the watchlist and services are empty.
+func (w *Watcher) managesNothing() bool {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.WatchList) == 0 && len(w.Services) == 0
+}
+
+// downloadArchive fetches the infra repo at sha as a zip.
+func (w *Watcher) downloadArchive(apiURL string, sha string) ([]byte, error) {
+
+	req, err := http.NewRequest("GET", apiURL+"/zipball/"+sha, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+w.Token())
+
+	resp, err := w.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &apiError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// applyDefinitions makes the watchlist and services match defs, keeping the
+// stats and history of those that stay. With prune, the containers of those
+// that were removed are deleted. Must be called with w.run held.
+func (w *Watcher) applyDefinitions(defs []gitops.Definition, prune bool) error {
+
+	var repos []models.WatchedRepo
+	var services []models.ManagedService
+	for _, d := range defs {
+		if d.IsRepo() {
+			repos = append(repos, models.WatchedRepo{
+				DisplayName:  d.Name,
+				URL:          d.Repo,
+				Dir:          d.Dir,
+				DependsOn:    d.DependsOn,
+				Desired:      d.Desired,
+				PollInterval: d.PollInterval,
+				Windows:      d.Windows,
+				Paths:        d.Paths,
+				IgnorePaths:  d.IgnorePaths,
+				Approval:     d.Approval,
+			})
+			continue
+		}
+		services = append(services, definedService(d))
+	}
+
+	w.mu.Lock()
+	_, _, removedRepos, _, err := mergeWatchList(w.WatchList, repos)
+	_, _, removedServices, _ := mergeServices(w.Services, services)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	removed := append(slices.Clone(removedRepos), removedServices...)
+
+	// The containers of removed entries have to be found while the entries
+	// still exist.
+	var orphans []string
+	var errs []error
+	for _, name := range removed {
+		containers, err := w.ResolveContainers(name)
+		if err != nil {
+			continue
+		}
+		if !prune {
+			slog.Warn("definition removed, its containers are left running unmanaged", "name", name, "containers", containers)
+			continue
+		}
+		orphans = append(orphans, containers...)
+	}
+
+	// Merged again, as the running entries may have changed while the
+	// containers were looked up.
+	w.mu.Lock()
+	nextRepos, addedRepos, removedRepos, changedRepos, err := mergeWatchList(w.WatchList, repos)
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	nextServices, addedServices, removedServices, changedServices := mergeServices(w.Services, services)
+
+	for _, name := range append(slices.Clone(removedRepos), removedServices...) {
+		w.Builder.Ports.Release(name)
+	}
+
+	w.WatchList = nextRepos
+	w.Builder.SetWatchList(nextRepos)
+	w.storeWatchList()
+	w.Services = nextServices
+	w.Builder.SetServices(nextServices)
+	w.storeServices()
+	w.mu.Unlock()
+
+	for _, c := range orphans {
+		slog.Info("pruning container of removed definition", "container", c)
+		if err := w.Builder.RemoveContainer(c); err != nil {
+			errs = append(errs, fmt.Errorf("prune %s: %w", c, err))
+		}
+	}
+	if len(orphans) > 0 && w.Builder.Proxy != nil {
+		if err := w.Builder.SyncRoutes(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(addedRepos)+len(removedRepos)+len(changedRepos)+len(addedServices)+len(removedServices)+len(changedServices) > 0 {
+		slog.Info("definitions applied",
+			"repos_added", addedRepos, "repos_removed", removedRepos, "repos_changed", changedRepos,
+			"services_added", addedServices, "services_removed", removedServices, "services_changed", changedServices)
+	}
+
+	return errors.Join(errs...)
+}
+
+// definedService returns the managed service d declares.
+func definedService(d gitops.Definition) models.ManagedService {
+
+	kind, source := models.ServiceKindImage, d.Image
+	switch {
+	case d.Compose != "":
+		kind, source = models.ServiceKindCompose, d.Compose
+	case d.Manifest != "":
+		kind, source = models.ServiceKindManifest, d.Manifest
+	}
+
+	svc := models.NewManagedService(d.Name, strings.ToLower(d.Name), kind, source, d.WatchImage)
+	svc.TagPolicy = d.TagPolicy
+	svc.RegistryAuthFromCove = d.RegistryAuthFromCove
+	svc.DependsOn = d.DependsOn
+	svc.Desired = d.Desired
+
+	return svc
+}
+
+// mergeServices returns the running services updated to declared, in the
+// order of declared, with the names of the services added, removed and
+// changed. Services that stay keep their stats and history.
+func mergeServices(running, declared []models.ManagedService) (next []models.ManagedService, added, removed, changed []string) {
+
+	current := map[string]models.ManagedService{}
+	for _, svc := range running {
+		current[svc.Name] = svc
+	}
+	declaredNames := map[string]bool{}
+	for _, svc := range declared {
+		declaredNames[svc.Name] = true
+	}
+	for _, svc := range running {
+		if !declaredNames[svc.Name] {
+			removed = append(removed, svc.Name)
+		}
+	}
+
+	for _, svc := range declared {
+		old, ok := current[svc.Name]
+		if !ok {
+			next = append(next, svc)
+			added = append(added, svc.Name)
+			continue
+		}
+
+		updated := old
+		updated.Image = svc.Image
+		updated.ComposePath = svc.ComposePath
+		updated.ManifestPath = svc.ManifestPath
+		updated.WatchImage = svc.WatchImage
+		updated.TagPolicy = svc.TagPolicy
+		updated.RegistryAuthFromCove = svc.RegistryAuthFromCove
+		updated.DependsOn = svc.DependsOn
+		updated.Desired = svc.Desired
+
+		if updated.Image != old.Image || updated.ComposePath != old.ComposePath || updated.ManifestPath != old.ManifestPath ||
+			updated.WatchImage != old.WatchImage || updated.TagPolicy != old.TagPolicy || updated.RegistryAuthFromCove != old.RegistryAuthFromCove ||
+			!slices.Equal(updated.DependsOn, old.DependsOn) || updated.Desired != old.Desired {
+			lastModified := time.Now()
+			updated.Stats.Meta.LastModifiedAt = &lastModified
+			// A new source or tag policy is picked up by the next image check.
+			updated.Stats.Updates.LastCheckedAt = nil
+			changed = append(changed, svc.Name)
+		}
+		next = append(next, updated)
+	}
+
+	return next, added, removed, changed
+}
@@ -0,0 +1,72 @@
+package watcher
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+func TestMergeServices(t *testing.T) {
+
+	checked := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	digest := "sha256:abc"
+
+	redis := models.NewManagedService("redis", "redis", models.ServiceKindImage, "redis:7", true)
+	redis.Stats.Updates.LastCheckedAt = &checked
+	redis.Stats.Updates.LastSeenDigest = &digest
+	redis.Stats.Deploys.DeployCount = 4
+	redis.History = []models.HistoryEntry{{Event: "deploy.succeeded", Message: "d1"}}
+
+	db := models.NewManagedService("db", "db", models.ServiceKindImage, "postgres:16", false)
+	db.Stats.Updates.LastCheckedAt = &checked
+	db.Stats.Deploys.DeployCount = 2
+
+	old := models.NewManagedService("old", "old", models.ServiceKindImage, "old:1", false)
+
+	running := []models.ManagedService{redis, db, old}
+
+	declaredRedis := models.NewManagedService("redis", "redis", models.ServiceKindImage, "redis:7", true)
+	declaredDB := models.NewManagedService("db", "db", models.ServiceKindImage, "postgres:17", false)
+	declaredDB.DependsOn = []string{"redis"}
+	web := models.NewManagedService("web", "web", models.ServiceKindCompose, "web/compose.yml", false)
+
+	next, added, removed, changed := mergeServices(running, []models.ManagedService{web, declaredDB, declaredRedis})
+
+	var names []string
+	for _, svc := range next {
+		names = append(names, svc.Name)
+	}
+	if !slices.Equal(names, []string{"web", "db", "redis"}) {
+		t.Errorf("next = %v, want the declared order", names)
+	}
+	if !slices.Equal(added, []string{"web"}) || !slices.Equal(removed, []string{"old"}) || !slices.Equal(changed, []string{"db"}) {
+		t.Errorf("added %v, removed %v, changed %v", added, removed, changed)
+	}
+
+	// An unchanged service keeps everything it had.
+	gotRedis := next[2]
+	if gotRedis.Stats.Updates.LastCheckedAt != &checked || gotRedis.Stats.Updates.LastSeenDigest != &digest {
+		t.Errorf("redis lost its image check: %+v", gotRedis.Stats.Updates)
+	}
+	if gotRedis.Stats.Deploys.DeployCount != 4 || len(gotRedis.History) != 1 {
+		t.Errorf("redis lost its stats or history: %+v, %v", gotRedis.Stats.Deploys, gotRedis.History)
+	}
+	if gotRedis.Stats.Meta.LastModifiedAt != nil {
+		t.Errorf("unchanged redis marked modified")
+	}
+
+	// A changed one takes the declared settings, keeps its stats and is
+	// checked again.
+	gotDB := next[1]
+	if gotDB.Image != "postgres:17" || !slices.Equal(gotDB.DependsOn, []string{"redis"}) {
+		t.Errorf("db not updated: %q %v", gotDB.Image, gotDB.DependsOn)
+	}
+	if gotDB.Stats.Deploys.DeployCount != 2 || !gotDB.Stats.Meta.StartedWatchingAt.Equal(db.Stats.Meta.StartedWatchingAt) {
+		t.Errorf("db lost its stats: %+v", gotDB.Stats)
+	}
+	if gotDB.Stats.Updates.LastCheckedAt != nil || gotDB.Stats.Meta.LastModifiedAt == nil {
+		t.Errorf("changed db not queued for a check: %+v", gotDB.Stats)
+	}
+}
@@ -0,0 +1,302 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/builder"
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/metrics"
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+const (
+	// How long to wait after a container stops before reconciling, so a
+	// burst of events from one container results in a single pass.
+	reconcileDebounce = 2 * time.Second
+)
+
+// RunReconciler converges containers onto their desired state every
+// reconcile interval and shortly after a managed container stops. It also
+// records container events from the bus against their repo or service.
+func (w *Watcher) RunReconciler() {
+
+	go w.watchContainerEvents()
+
+	ticker := time.NewTicker(w.Config().ReconcileInterval)
+	defer ticker.Stop()
+
+	debounce := time.NewTimer(reconcileDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-w.Ctx.Done():
+			return
+		case <-w.containerStopped:
+			debounce.Reset(reconcileDebounce)
+			continue
+		case <-w.reconcileReset:
+			ticker.Reset(w.Config().ReconcileInterval)
+			continue
+		case <-ticker.C:
+		case <-debounce.C:
+		}
+
+		if err := w.Reconcile(); err != nil {
+			slog.Error("reconcile failed", "err", err)
+		}
+	}
+}
+
+// watchContainerEvents records container events as they arrive. It runs
+// apart from the reconcile loop so events keep being drained while a
+// reconcile pass is rebuilding, and it subscribes to container events only
+// so build logs cannot crowd them out of the channel.
+func (w *Watcher) watchContainerEvents() {
+
+	ch, cancel := w.Builder.Events.SubscribeContainers()
+	defer cancel()
+
+	for {
+		select {
+		case <-w.Ctx.Done():
+			return
+		case e := <-ch:
+			w.recordContainerEvent(e)
+			switch e.Kind {
+			case events.KindContainerDied, events.KindContainerOOM, events.KindContainerStopped:
+				wake(w.containerStopped)
+			}
+		}
+	}
+}
+
+// Reconcile makes one pass over every repo and managed service, starting,
+// stopping or redeploying whatever does not match its desired state.
+func (w *Watcher) Reconcile() error {
+
+	w.run.Lock()
+	defer w.run.Unlock()
+
+	w.mu.Lock()
+	repos := slices.Clone(w.WatchList)
+	services := slices.Clone(w.Services)
+	w.mu.Unlock()
+
+	var errs []error
+
+	for _, repo := range repos {
+		if err := w.reconcileRepo(repo); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.DisplayName, err))
+		}
+	}
+
+	for _, svc := range services {
+		if err := w.reconcileService(svc); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", svc.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetDesiredState records whether a repo or managed service should be
+// running and converges it straight away.
+func (w *Watcher) SetDesiredState(name string, state string) error {
+
+	if state != models.DesiredRunning && state != models.DesiredStopped {
+		return fmt.Errorf("unknown desired state %q", state)
+	}
+
+	w.run.Lock()
+	defer w.run.Unlock()
+
+	var svc models.ManagedService
+	err := w.updateService(name, func(s *models.ManagedService) error {
+		s.Desired = state
+		svc = *s
+		return nil
+	})
+	if err == nil {
+		return w.reconcileService(svc)
+	}
+
+	repo, ok := w.lookupRepo(name)
+	if !ok {
+		return fmt.Errorf("%s is not a watched repo or managed service", name)
+	}
+	w.withRepo(repo.DisplayName, func(r *models.WatchedRepo) {
+		r.Desired = state
+		repo = *r
+	})
+
+	return w.reconcileRepo(repo)
+}
+
+// Manages reports whether name is a watched repo or managed service, by
+// display name or container name.
+func (w *Watcher) Manages(name string) bool {
+
+	if _, ok := w.GetService(name); ok {
+		return true
+	}
+	_, ok := w.lookupRepo(name)
+
+	return ok
+}
+
+// SetAllDesiredState records state for every repo and managed service.
+// Nothing is converged; callers start or stop everything themselves.
+func (w *Watcher) SetAllDesiredState(state string) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.WatchList {
+		w.WatchList[i].Desired = state
+	}
+	for i := range w.Services {
+		w.Services[i].Desired = state
+	}
+	w.Builder.SetWatchList(w.WatchList)
+	w.Builder.SetServices(w.Services)
+
+	w.storeWatchList()
+	w.storeServices()
+}
+
+// reconcileRepo converges repo, a copy of its watchlist entry.
+func (w *Watcher) reconcileRepo(repo models.WatchedRepo) error {
+
+	name := strings.ToLower(repo.ContainerName)
+
+	if strings.EqualFold(name, w.Builder.SelfName()) {
+		return nil
+	}
+
+	status, err := w.Builder.ContainerStatus(name)
+	if err != nil {
+		return err
+	}
+
+	if !repo.WantsRunning() {
+		if status.Running {
+			w.correct(repo.DisplayName, "stop", "container is running but should be stopped")
+			return w.Builder.StopContainer(name)
+		}
+		return nil
+	}
+
+	expected := repo.Stats.Builds.DeployedSha
+	switch {
+	case !status.Exists:
+		// Never deployed, or deploys keep failing: wait for a new commit.
+		if expected == nil || repo.Stats.Builds.Broken {
+			return nil
+		}
+		w.correct(repo.DisplayName, "rebuild", "container is missing")
+		return w.rebuildRepo(repo)
+
+	case expected != nil && status.Labels[builder.LabelSHA] != "" && status.Labels[builder.LabelSHA] != *expected:
+		if repo.Stats.Builds.Broken {
+			return nil
+		}
+		w.correct(repo.DisplayName, "rebuild", fmt.Sprintf("container runs %s, expected %s", status.Labels[builder.LabelSHA], *expected))
+		return w.rebuildRepo(repo)
+
+	case !status.Running:
+		w.correct(repo.DisplayName, "start", "container is stopped but should be running")
+		return w.Builder.StartContainer(name)
+	}
+
+	return nil
+}
+
+// reconcileService converges svc, a copy of its entry.
+func (w *Watcher) reconcileService(svc models.ManagedService) error {
+
+	status, err := w.Builder.ServiceStatus(svc)
+	if err != nil {
+		return err
+	}
+
+	if !svc.WantsRunning() {
+		if status.Running {
+			w.correct(svc.Name, "stop", "service is running but should be stopped")
+			return w.Builder.StopService(svc)
+		}
+		return nil
+	}
+
+	if !status.Exists || !status.Running {
+		w.correct(svc.Name, "start", "service is not running")
+		return w.Builder.StartService(svc)
+	}
+
+	// A failed deploy leaves the old container in place on purpose, so
+	// only chase the expected image once a deploy has gone through.
+	if last := svc.Stats.Deploys.LastDeployStatus; last != nil && *last == "failed" {
+		return nil
+	}
+
+	running := status.Labels[builder.LabelImage]
+	if running == "" {
+		return nil
+	}
+	expected, err := w.Builder.ExpectedImage(svc)
+	if err != nil {
+		return err
+	}
+	if running != expected {
+		w.correct(svc.Name, "redeploy", fmt.Sprintf("container runs %s, expected %s", running, expected))
+		return w.deployService(svc)
+	}
+
+	return nil
+}
+
+// rebuildRepo redeploys a repo's current commit and records the outcome
+// like a build triggered by a new commit.
+func (w *Watcher) rebuildRepo(repo models.WatchedRepo) error {
+
+	// The commit last deployed, not the branch head, which may be waiting
+	// for approval or a maintenance window.
+	target := repo
+	if sha := repo.Stats.Builds.DeployedSha; sha != nil {
+		target = atCommit(repo, *sha)
+	}
+
+	buildID, err := w.Builder.Build(target)
+
+	found := w.withRepo(repo.DisplayName, func(repo *models.WatchedRepo) {
+		repo.Stats.Builds.LastBuildID = buildID
+		repo.History = models.AppendHistory(repo.History, buildHistory(target, buildID, "rebuild", err))
+		if err != nil {
+			*repo = models.UpdateBuildStats(*repo, "failed")
+			if sha := target.Stats.Updates.LastSeenCommitSha; sha != nil {
+				*repo = models.RecordBuildFailure(*repo, *sha, maxBuildAttempts)
+			}
+		} else {
+			*repo = models.UpdateBuildStats(*repo, "success")
+			*repo = models.ClearBuildFailures(*repo)
+			if sha := target.Stats.Updates.LastSeenCommitSha; sha != nil {
+				*repo = models.RecordDeployedSha(*repo, *sha)
+			}
+		}
+	})
+	if !found {
+		slog.Warn("repo removed while it was rebuilt, outcome not recorded", "repo", repo.DisplayName, "build_id", buildID)
+	}
+
+	return err
+}
+
+func (w *Watcher) correct(name string, action string, reason string) {
+	slog.Info("reconcile", "name", name, "action", action, "reason", reason)
+	metrics.ReconcileActions.WithLabelValues(name, action).Inc()
+}
@@ -0,0 +1,319 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/logging"
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/schedule"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Editors and GitOps tools often write a file in several steps, so a reload
+// waits for the writes to settle.
+const reloadDebounce = 500 * time.Millisecond
+
+// WatchReload reloads the config file and the watchlist when either changes
+// on disk, and both on every signal from hup. Edits the file watch cannot
+// see, such as to a bind mounted file from the host, need a signal.
+func (w *Watcher) WatchReload(hup <-chan os.Signal) {
+
+	cfgFile := w.Config().File()
+	repoFile := w.Config().Paths.Repos
+	if w.gitOps() {
+		// The infra repo is the source of the watchlist, repos.json only
+		// caches it.
+		repoFile = ""
+	}
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("file watch unavailable, reloading on SIGHUP only", "err", err)
+	} else {
+		defer fw.Close()
+
+		// Watching the directory rather than the file survives editors that
+		// replace the file instead of writing to it.
+		dirs := map[string]bool{}
+		for _, f := range []string{cfgFile, repoFile} {
+			if f == "" {
+				continue
+			}
+			dir := filepath.Dir(f)
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			if err := fw.Add(dir); err != nil {
+				slog.Error("failed to watch for changes", "dir", dir, "err", err)
+			}
+		}
+	}
+
+	var fsEvents <-chan fsnotify.Event
+	var fsErrors <-chan error
+	if fw != nil {
+		fsEvents, fsErrors = fw.Events, fw.Errors
+	}
+
+	cfgTimer := time.NewTimer(reloadDebounce)
+	cfgTimer.Stop()
+	repoTimer := time.NewTimer(reloadDebounce)
+	repoTimer.Stop()
+
+	for {
+		select {
+		case <-w.Ctx.Done():
+			return
+		case <-hup:
+			slog.Info("reloading on SIGHUP")
+			w.Reload()
+		case e := <-fsEvents:
+			if !e.Has(fsnotify.Write) && !e.Has(fsnotify.Create) && !e.Has(fsnotify.Rename) {
+				continue
+			}
+			switch filepath.Clean(e.Name) {
+			case filepath.Clean(cfgFile):
+				cfgTimer.Reset(reloadDebounce)
+			case filepath.Clean(repoFile):
+				repoTimer.Reset(reloadDebounce)
+			}
+		case err := <-fsErrors:
+			slog.Warn("file watch error", "err", err)
+		case <-cfgTimer.C:
+			w.reloadConfig()
+		case <-repoTimer.C:
+			if err := w.reloadWatchList(); err != nil {
+				slog.Error("watchlist reload rejected, keeping the running watchlist", "err", err)
+			}
+		}
+	}
+}
+
+// Reload applies the config file and the watchlist on disk to the running
+// daemon.
+func (w *Watcher) Reload() {
+
+	w.reloadConfig()
+	if err := w.reloadWatchList(); err != nil {
+		slog.Error("watchlist reload rejected, keeping the running watchlist", "err", err)
+	}
+}
+
+// reloadConfig swaps in the config on disk and wakes the loops whose
+// interval it may have changed. An invalid config is logged and the last
+// good one keeps running.
+func (w *Watcher) reloadConfig() {
+
+	applied, restart, err := w.Settings.Reload()
+	if err != nil {
+		slog.Error("config reload rejected, keeping the running config", "err", err)
+		return
+	}
+	if len(restart) > 0 {
+		slog.Warn("config changes need a restart to take effect", "keys", restart)
+	}
+	if len(applied) == 0 {
+		return
+	}
+
+	slog.Info("config reloaded", "changed", applied)
+
+	if slices.Contains(applied, "log.level") {
+		if err := logging.SetLevel(w.Config().Log.Level); err != nil {
+			slog.Error("failed to set log level", "err", err)
+		}
+	}
+	if slices.Contains(applied, "poll_interval") {
+		wake(w.pollReset)
+	}
+	if slices.Contains(applied, "reconcile_interval") {
+		wake(w.reconcileReset)
+	}
+}
+
+// reloadWatchList applies repos.json to the running watchlist. Repos are
+// matched by display name: new ones are watched, missing ones dropped, and
+// for the rest the url, monorepo dir, dependencies, desired state, poll
+// interval, maintenance windows, path filters and approval come from the
+// file while the stats, history, pause and approval queue the daemon keeps
+// are left alone. Writes of the daemon's own match the running watchlist
+// and change nothing. With GitOps the infra repo is the source instead and
+// nothing is reloaded.
+func (w *Watcher) reloadWatchList() error {
+
+	if w.gitOps() {
+		return nil
+	}
+
+	data, err := os.ReadFile(w.Config().Paths.Repos)
+	if err != nil {
+		return fmt.Errorf("reloadWatchList: %w", err)
+	}
+
+	var onDisk []models.WatchedRepo
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		return fmt.Errorf("reloadWatchList: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next, added, removed, changed, err := mergeWatchList(w.WatchList, onDisk)
+	if err != nil {
+		return fmt.Errorf("reloadWatchList: %w", err)
+	}
+	if len(added)+len(removed)+len(changed) == 0 {
+		return nil
+	}
+
+	for _, name := range removed {
+		w.Builder.Ports.Release(name)
+	}
+
+	w.WatchList = next
+	w.Builder.SetWatchList(next)
+	w.storeWatchList()
+
+	slog.Info("watchlist reloaded", "added", added, "removed", removed, "changed", changed)
+	return nil
+}
+
+// mergeWatchList returns the running watchlist updated to onDisk, in the
+// order of onDisk, with the names of the repos added, removed and changed.
+func mergeWatchList(running, onDisk []models.WatchedRepo) (next []models.WatchedRepo, added, removed, changed []string, err error) {
+
+	names := map[string]bool{}
+	urls := map[string]bool{}
+	for i, repo := range onDisk {
+		if repo.DisplayName == "" {
+			return nil, nil, nil, nil, fmt.Errorf("repo %s has no display name", repo.URL)
+		}
+		if names[repo.DisplayName] {
+			return nil, nil, nil, nil, fmt.Errorf("%s is listed twice", repo.DisplayName)
+		}
+		dir, err := models.CleanDir(repo.Dir)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%s: %w", repo.DisplayName, err)
+		}
+		if dir != "" && repo.ContainerName == "" && !validContainerName.MatchString(repo.DisplayName) {
+			return nil, nil, nil, nil, fmt.Errorf("%s: a monorepo service is deployed as a container of the same name, so it may only hold letters, digits, '_', '.' and '-'", repo.DisplayName)
+		}
+		onDisk[i].Dir = dir
+		if urls[repo.URL+"#"+dir] {
+			if dir != "" {
+				return nil, nil, nil, nil, fmt.Errorf("%s %s is watched twice", repo.URL, dir)
+			}
+			return nil, nil, nil, nil, fmt.Errorf("%s is watched twice", repo.URL)
+		}
+		if repo.PollInterval != "" {
+			if _, err := parsePollInterval(repo.PollInterval); err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("%s: %w", repo.DisplayName, err)
+			}
+		}
+		if _, err := schedule.ParseAll(repo.Windows); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%s: %w", repo.DisplayName, err)
+		}
+		if err := repo.Filter().Validate(); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%s: %w", repo.DisplayName, err)
+		}
+		if repo.Approval != "" && repo.Approval != models.ApprovalRequired {
+			return nil, nil, nil, nil, fmt.Errorf("%s: approval %q is not %q or empty", repo.DisplayName, repo.Approval, models.ApprovalRequired)
+		}
+		names[repo.DisplayName] = true
+		urls[repo.URL+"#"+dir] = true
+	}
+
+	current := map[string]models.WatchedRepo{}
+	for _, repo := range running {
+		current[repo.DisplayName] = repo
+		if !names[repo.DisplayName] {
+			removed = append(removed, repo.DisplayName)
+		}
+	}
+
+	for _, repo := range onDisk {
+		rName, apiURL, downloadURL, err := parseURL(repo.URL)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%s: %w", repo.DisplayName, err)
+		}
+
+		old, ok := current[repo.DisplayName]
+		if !ok {
+			fresh := models.NewWatchedRepo(repo.DisplayName, containerName(rName, repo.DisplayName, repo.Dir), repo.URL, apiURL, downloadURL)
+			if repo.ContainerName != "" {
+				fresh.ContainerName = repo.ContainerName
+			}
+			fresh.Dir = repo.Dir
+			if !repo.Stats.Meta.StartedWatchingAt.IsZero() {
+				fresh.Stats = repo.Stats
+				fresh.History = repo.History
+				fresh.PendingApprovals = repo.PendingApprovals
+			}
+			fresh.DependsOn = repo.DependsOn
+			fresh.Desired = repo.Desired
+			fresh.PollInterval = repo.PollInterval
+			fresh.Windows = repo.Windows
+			fresh.Paths = repo.Paths
+			fresh.IgnorePaths = repo.IgnorePaths
+			fresh.Approval = repo.Approval
+			fresh.Paused = repo.Paused
+			next = append(next, fresh)
+			added = append(added, repo.DisplayName)
+			continue
+		}
+
+		updated := old
+		updated.URL = repo.URL
+		updated.APIURL = apiURL
+		updated.DownloadURL = downloadURL
+		updated.Dir = repo.Dir
+		updated.DependsOn = repo.DependsOn
+		updated.Desired = repo.Desired
+		updated.PollInterval = repo.PollInterval
+		updated.Windows = repo.Windows
+		updated.Paths = repo.Paths
+		updated.IgnorePaths = repo.IgnorePaths
+		updated.Approval = repo.Approval
+		if updated.URL != old.URL || updated.Dir != old.Dir || !slices.Equal(updated.DependsOn, old.DependsOn) || updated.Desired != old.Desired ||
+			updated.PollInterval != old.PollInterval || !slices.Equal(updated.Windows, old.Windows) ||
+			!slices.Equal(updated.Paths, old.Paths) || !slices.Equal(updated.IgnorePaths, old.IgnorePaths) || updated.Approval != old.Approval {
+			lastModified := time.Now()
+			updated.Stats.Meta.LastModifiedAt = &lastModified
+			changed = append(changed, repo.DisplayName)
+		}
+		next = append(next, updated)
+	}
+
+	containers := map[string]string{}
+	for _, repo := range next {
+		name := strings.ToLower(repo.ContainerName)
+		if other, ok := containers[name]; ok {
+			return nil, nil, nil, nil, fmt.Errorf("%s and %s are both deployed as container %s", other, repo.DisplayName, name)
+		}
+		containers[name] = repo.DisplayName
+	}
+
+	// A reordered file is not a change worth a write, so keep the running
+	// order when nothing else differs.
+	if len(added)+len(removed)+len(changed) == 0 {
+		return running, nil, nil, nil, nil
+	}
+
+	return next, added, removed, changed, nil
+}
+
+// wake signals ch without blocking when a signal is already pending.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,226 @@
+package watcher
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/schedule"
+)
+
+// pollJitter spreads the polls of repos sharing an interval by up to this
+// fraction of it either way, so they do not all reach GitHub at once.
+const pollJitter = 0.1
+
+// pollInterval returns how often repo is polled.
+func (w *Watcher) pollInterval(repo models.WatchedRepo) time.Duration {
+
+	if repo.PollInterval != "" {
+		if d, err := parsePollInterval(repo.PollInterval); err == nil {
+			return d
+		}
+	}
+
+	return w.Config().PollInterval
+}
+
+func parsePollInterval(s string) (time.Duration, error) {
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("poll interval %q is not a duration such as 5m", s)
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("poll interval %s is shorter than 1s", d)
+	}
+
+	return d, nil
+}
+
+// dueRepos reports which repos are due a poll at now. Must be called with
+// w.mu held.
+func (w *Watcher) dueRepos(now time.Time) []bool {
+
+	due := make([]bool, len(w.WatchList))
+	for i, repo := range w.WatchList {
+		next, ok := w.nextPoll[repo.DisplayName]
+		due[i] = !ok || !now.Before(next)
+	}
+
+	return due
+}
+
+// schedulePoll sets when repo is polled next, its interval from now with
+// jitter. Must be called with w.mu held.
+func (w *Watcher) schedulePoll(repo models.WatchedRepo, now time.Time) {
+
+	interval := float64(w.pollInterval(repo))
+	jitter := interval * pollJitter * (2*rand.Float64() - 1)
+	w.nextPoll[repo.DisplayName] = now.Add(time.Duration(interval + jitter))
+}
+
+// untilNextScan returns how long the poll loop sleeps: until the next repo
+// is due or a maintenance window holding a commit opens, but no longer than
+// the daemon's poll interval, which also paces the infra repo and image
+// checks.
+func (w *Watcher) untilNextScan() time.Duration {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	wait := w.Config().PollInterval
+	for _, repo := range w.WatchList {
+		next, ok := w.nextPoll[repo.DisplayName]
+		if !ok {
+			return 0
+		}
+		if open, ok := windowOpens(repo, now); ok && open.Before(next) {
+			next = open
+		}
+		if d := next.Sub(now); d < wait {
+			wait = max(d, 0)
+		}
+	}
+
+	return wait
+}
+
+// windowOpens returns when the maintenance windows holding the pending
+// commit of repo next open. It reports false when nothing is held by a
+// window.
+func windowOpens(repo models.WatchedRepo, now time.Time) (time.Time, bool) {
+
+	if repo.Stats.Updates.PendingCommitSha == nil || repo.Paused {
+		return time.Time{}, false
+	}
+
+	windows, err := schedule.ParseAll(repo.Windows)
+	if err != nil || windows.Open(now) {
+		return time.Time{}, false
+	}
+
+	return windows.NextOpen(now)
+}
+
+// holdReason says why a commit of repo may not be deployed at now, or
+// returns an empty string when it may.
+func holdReason(repo models.WatchedRepo, now time.Time) string {
+
+	if repo.Paused {
+		return "repo is paused"
+	}
+
+	windows, err := schedule.ParseAll(repo.Windows)
+	if err != nil {
+		// Windows are validated when set, so this is a hand edited file.
+		// Holding is the safe side.
+		return err.Error()
+	}
+	if !windows.Open(now) {
+		return "outside maintenance windows " + strings.Join(repo.Windows, "; ")
+	}
+
+	return ""
+}
+
+// Pause keeps polling repo but holds new commits until Resume.
+func (w *Watcher) Pause(name string) error {
+
+	return w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.Paused = true
+		return nil
+	})
+}
+
+// Resume lets repo deploy again, starting with the latest commit held
+// while it was paused, unless a maintenance window still holds it.
+func (w *Watcher) Resume(name string) error {
+
+	err := w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.Paused = false
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.pollSoon(name)
+	return nil
+}
+
+// SetPollInterval changes how often a repo is polled. An empty interval
+// goes back to the daemon's.
+func (w *Watcher) SetPollInterval(name string, interval string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+	if interval != "" {
+		if _, err := parsePollInterval(interval); err != nil {
+			return err
+		}
+	}
+
+	err := w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.PollInterval = interval
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.pollSoon(name)
+	return nil
+}
+
+// SetWindows replaces the maintenance windows of a repo. No windows allows
+// deploys at any time.
+func (w *Watcher) SetWindows(name string, windows []string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+	if _, err := schedule.ParseAll(windows); err != nil {
+		return err
+	}
+
+	return w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.Windows = windows
+		return nil
+	})
+}
+
+// pollSoon makes repo due at the next scan and wakes the poll loop.
+func (w *Watcher) pollSoon(name string) {
+
+	w.mu.Lock()
+	delete(w.nextPoll, name)
+	w.mu.Unlock()
+
+	wake(w.pollReset)
+}
+
+func (w *Watcher) updateRepo(name string, update func(*models.WatchedRepo) error) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.WatchList {
+		if w.WatchList[i].DisplayName != name {
+			continue
+		}
+		if err := update(&w.WatchList[i]); err != nil {
+			return err
+		}
+		lastModified := time.Now()
+		w.WatchList[i].Stats.Meta.LastModifiedAt = &lastModified
+		w.Builder.SetWatchList(w.WatchList)
+		w.storeWatchList()
+		return nil
+	}
+
+	return fmt.Errorf("%s is not a watched repo", name)
+}
@@ -0,0 +1,337 @@
+package watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LSariol/LightHouse/internal/models"
+	"github.com/LSariol/LightHouse/internal/registry"
+)
+
+// How often managed services with WatchImage set are checked for a newer image.
+const imageCheckInterval = 5 * time.Minute
+
+func (w *Watcher) AddService(name string, kind string, source string, watch bool) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	switch kind {
+	case models.ServiceKindImage, models.ServiceKindCompose, models.ServiceKindManifest:
+	default:
+		return fmt.Errorf("unknown service kind %q, expected image, compose or manifest", kind)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.findService(name); ok {
+		return fmt.Errorf("%s is already managed", name)
+	}
+	if _, ok := w.findRepo(name); ok {
+		return fmt.Errorf("%s is already used by a watched repo", name)
+	}
+
+	svc := models.NewManagedService(name, strings.ToLower(name), kind, source, watch)
+	w.Services = append(w.Services, svc)
+	w.Builder.SetServices(w.Services)
+	w.storeServices()
+
+	return nil
+}
+
+func (w *Watcher) RemoveService(name string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, svc := range w.Services {
+		if svc.Name == name {
+			w.Services = slices.Delete(w.Services, i, i+1)
+			w.Builder.SetServices(w.Services)
+			w.Builder.Ports.Release(name)
+			slog.Info("service removed", "service", name)
+			w.storeServices()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unable to remove %s, it is not a managed service", name)
+}
+
+// GetService returns the managed service with the given name.
+func (w *Watcher) GetService(name string) (models.ManagedService, bool) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.findService(name)
+}
+
+// findService is GetService for callers holding w.mu.
+func (w *Watcher) findService(name string) (models.ManagedService, bool) {
+
+	for _, svc := range w.Services {
+		if svc.Name == name {
+			return svc, true
+		}
+	}
+
+	return models.ManagedService{}, false
+}
+
+// SetServiceTagPolicy changes which tags a service follows. The new policy
+// is applied on the next image check.
+func (w *Watcher) SetServiceTagPolicy(name string, policy string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	if _, err := registry.ParsePolicy(policy); err != nil {
+		return err
+	}
+
+	return w.updateService(name, func(svc *models.ManagedService) error {
+		if svc.Kind() == models.ServiceKindCompose {
+			return fmt.Errorf("%s is a compose service, tag policies apply to image and manifest services", name)
+		}
+		svc.TagPolicy = policy
+		svc.Stats.Updates.LastCheckedAt = nil
+		return nil
+	})
+}
+
+// SetServiceRegistryAuth sets the Cove key holding the registry login of a
+// service. An empty key pulls anonymously.
+func (w *Watcher) SetServiceRegistryAuth(name string, coveKey string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	return w.updateService(name, func(svc *models.ManagedService) error {
+		svc.RegistryAuthFromCove = coveKey
+		return nil
+	})
+}
+
+func (w *Watcher) updateService(name string, update func(*models.ManagedService) error) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.Services {
+		if w.Services[i].Name != name {
+			continue
+		}
+		if err := update(&w.Services[i]); err != nil {
+			return err
+		}
+		w.Builder.SetServices(w.Services)
+		w.storeServices()
+		return nil
+	}
+
+	return fmt.Errorf("%s is not a managed service", name)
+}
+
+// DeployService pulls and recreates a managed service and records the result.
+func (w *Watcher) DeployService(name string) error {
+
+	w.run.Lock()
+	defer w.run.Unlock()
+
+	svc, ok := w.GetService(name)
+	if !ok {
+		return fmt.Errorf("%s is not a managed service", name)
+	}
+
+	return w.deployService(svc)
+}
+
+// deployService deploys svc, a copy of its entry, and records the outcome
+// on the entry as it is once the deploy is done.
+func (w *Watcher) deployService(svc models.ManagedService) error {
+
+	deployID, err := w.Builder.DeployService(svc)
+	status := "success"
+	if err != nil {
+		status = "failed"
+	}
+	w.recordService(svc.Name, func(s *models.ManagedService) {
+		s.History = models.AppendHistory(s.History, deployHistory(deployID, err))
+		*s = models.UpdateDeployStats(*s, deployID, status)
+	})
+
+	return err
+}
+
+// recordService stores the outcome of work done on a service without w.mu
+// held, unless the service was removed in the meantime.
+func (w *Watcher) recordService(name string, update func(*models.ManagedService)) {
+
+	err := w.updateService(name, func(s *models.ManagedService) error {
+		update(s)
+		return nil
+	})
+	if err != nil {
+		slog.Warn("service removed while it was deployed, outcome not recorded", "service", name)
+	}
+}
+
+// checkServiceImages redeploys managed services whose registry digest or
+// tag policy has moved on. Each service is checked at most once per
+// imageCheckInterval, and a digest that failed to deploy is not retried.
+func (w *Watcher) checkServiceImages() error {
+
+	var errs []error
+
+	w.mu.Lock()
+	services := slices.Clone(w.Services)
+	w.mu.Unlock()
+
+	for _, svc := range services {
+		if !svc.WatchImage {
+			continue
+		}
+		if last := svc.Stats.Updates.LastCheckedAt; last != nil && time.Since(*last) < imageCheckInterval {
+			continue
+		}
+
+		check, err := w.Builder.CheckServiceImage(models.UpdateImageCheckStats(svc))
+		if err != nil {
+			slog.Warn("image check failed", "service", svc.Name, "err", err)
+			errs = append(errs, fmt.Errorf("check image of %s: %w", svc.Name, err))
+		}
+		if err != nil || !check.Changed {
+			w.recordService(svc.Name, func(s *models.ManagedService) {
+				*s = models.UpdateImageCheckStats(*s)
+			})
+			continue
+		}
+
+		slog.Info("new image detected", "service", svc.Name, "tag", check.Tag, "digest", check.Digest)
+
+		// Deploy the candidate tag, but only keep it once it is running.
+		candidate := svc
+		if check.Tag != "" {
+			candidate.Stats.Updates.CurrentTag = check.Tag
+		}
+
+		deployID, err := w.Builder.DeployService(candidate)
+		status := "success"
+		if err != nil {
+			status = "failed"
+			errs = append(errs, fmt.Errorf("deploy %s: %w", svc.Name, err))
+		}
+
+		w.recordService(svc.Name, func(s *models.ManagedService) {
+			*s = models.UpdateImageCheckStats(*s)
+			s.History = models.AppendHistory(s.History, deployHistory(deployID, err))
+			switch {
+			case err != nil:
+				if s.Kind() != models.ServiceKindCompose {
+					*s = models.RecordFailedDigest(*s, check.Digest)
+				}
+			case s.Kind() == models.ServiceKindCompose:
+				*s = models.UpdateImageStats(*s, check.Digest)
+			default:
+				*s = models.UpdateDigestStats(*s, check.Tag, check.Digest)
+			}
+			*s = models.UpdateDeployStats(*s, deployID, status)
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *Watcher) loadServices() error {
+	var services []models.ManagedService
+
+	data, err := os.ReadFile(w.Config().Paths.Services)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("loadServices: %w", err)
+	}
+
+	err = json.Unmarshal(data, &services)
+	if err != nil {
+		return fmt.Errorf("loadServices: %w", err)
+	}
+
+	w.mu.Lock()
+	w.Services = services
+	w.Builder.SetServices(services)
+	w.mu.Unlock()
+	return nil
+}
+
+// storeServices writes the managed services to disk. Must be called with
+// w.mu held.
+func (w *Watcher) storeServices() {
+
+	path := w.Config().Paths.Services
+
+	updatedData, err := json.MarshalIndent(w.Services, "", "	")
+	if err != nil {
+		slog.Error("failed to marshal services", "err", err)
+		return
+	}
+
+	err = os.WriteFile(path, updatedData, 0644)
+	if err != nil {
+		slog.Error("failed to write services", "path", path, "err", err)
+		return
+	}
+}
+
+// Display managed services in a nice format
+func (w *Watcher) DisplayServices() {
+
+	w.mu.Lock()
+	services := slices.Clone(w.Services)
+	w.mu.Unlock()
+
+	fmt.Printf("%-20s | %-8s | %-40s | %-10s | %-5s | %s\n", "Name", "Kind", "Source", "State", "Watch", "Host Ports")
+	fmt.Println(strings.Repeat("-", 20) + "-+-" + strings.Repeat("-", 8) + "-+-" + strings.Repeat("-", 40) + "-+-" + strings.Repeat("-", 10) + "-+-" + strings.Repeat("-", 5) + "-+-" + strings.Repeat("-", 10))
+
+	for _, svc := range services {
+		source := svc.Image
+		if tag := svc.Stats.Updates.CurrentTag; tag != "" {
+			source += " @ " + tag
+		}
+		if svc.TagPolicy != "" {
+			source += " (" + svc.TagPolicy + ")"
+		}
+		switch svc.Kind() {
+		case models.ServiceKindCompose:
+			source = svc.ComposePath
+		case models.ServiceKindManifest:
+			source = svc.ManifestPath
+		}
+
+		state, err := w.Builder.ContainerHealth(svc.ContainerName)
+		if err != nil {
+			state = "unknown"
+		}
+		if svc.Kind() == models.ServiceKindCompose {
+			state = "-"
+		}
+
+		fmt.Printf("%-20s | %-8s | %-40s | %-10s | %-5t | %s\n", svc.Name, svc.Kind(), source, state, svc.WatchImage, w.hostPorts(svc.Name))
+	}
+}
@@ -0,0 +1,80 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LSariol/LightHouse/internal/builder"
+	"github.com/LSariol/LightHouse/internal/models"
+)
+
+// Snapshots lists the volume snapshots of a repo or manifest service,
+// newest first.
+func (w *Watcher) Snapshots(name string) ([]builder.Snapshot, error) {
+
+	owner, _, err := w.volumeOwner(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.Builder.Snapshots(owner)
+}
+
+// Restore puts the volumes of a repo or manifest service back to snapshot
+// id. The containers only get their data back, not their previous image.
+func (w *Watcher) Restore(name string, id string) error {
+
+	w.run.Lock()
+	defer w.run.Unlock()
+
+	owner, containers, err := w.volumeOwner(name)
+	if err != nil {
+		return err
+	}
+
+	err = w.Builder.RestoreSnapshot(owner, containers, id)
+
+	entry := models.HistoryEntry{Event: "restore", Message: "snapshot " + id}
+	if err != nil {
+		entry.Message = fmt.Sprintf("snapshot %s: %v", id, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.WatchList {
+		if strings.EqualFold(w.WatchList[i].ContainerName, owner) {
+			w.WatchList[i].History = models.AppendHistory(w.WatchList[i].History, entry)
+			w.Builder.SetWatchList(w.WatchList)
+			w.storeWatchList()
+		}
+	}
+	for i := range w.Services {
+		if w.Services[i].ContainerName == owner {
+			w.Services[i].History = models.AppendHistory(w.Services[i].History, entry)
+			w.Builder.SetServices(w.Services)
+			w.storeServices()
+		}
+	}
+
+	return err
+}
+
+// volumeOwner returns the container whose name prefixes the volumes of a
+// repo or manifest service, and the containers using them.
+func (w *Watcher) volumeOwner(name string) (string, []string, error) {
+
+	if svc, ok := w.GetService(name); ok {
+		if svc.Kind() != models.ServiceKindManifest {
+			return "", nil, fmt.Errorf("%s is a %s service, only manifest services have volumes managed by Lighthouse", name, svc.Kind())
+		}
+		return svc.ContainerName, []string{svc.ContainerName}, nil
+	}
+
+	if repo, ok := w.lookupRepo(name); ok {
+		containers, err := w.Builder.RepoContainers(repo)
+		return strings.ToLower(repo.ContainerName), containers, err
+	}
+
+	return "", nil, fmt.Errorf("%s is not a watched repo or managed service", name)
+}
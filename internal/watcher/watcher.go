@@ -2,90 +2,515 @@ package watcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/LSariol/LightHouse/internal/builder"
+	"github.com/LSariol/LightHouse/internal/config"
+	"github.com/LSariol/LightHouse/internal/events"
+	"github.com/LSariol/LightHouse/internal/metrics"
 	"github.com/LSariol/LightHouse/internal/models"
 	"github.com/lsariol/coveclient"
 )
 
 type Watcher struct {
+	Settings  *config.Store
 	CC        *coveclient.Client
 	HTTP      *http.Client
 	Builder   *builder.Builder
 	Ctx       context.Context
 	WatchList []models.WatchedRepo
+	Services  []models.ManagedService
 	HomePath  string
-	GitToken  string
+
+	authFailing bool
+
+	// gitToken is the GitHub PAT, read through Token.
+	gitToken string
+
+	// nextPoll is when each repo is due its next poll.
+	nextPoll map[string]time.Time
+
+	// gitopsSHA is the infra repo commit last applied.
+	gitopsSHA string
+
+	// pollReset and reconcileReset wake the poll and reconcile loops after
+	// a reload so a new interval applies straight away.
+	pollReset      chan struct{}
+	reconcileReset chan struct{}
+
+	// containerStopped wakes the reconcile loop when a managed container
+	// dies or stops.
+	containerStopped chan struct{}
+
+	// run serialises scans, reconcile passes, deploys and restores so they
+	// never act on the same container at once. It is held across builds.
+	run sync.Mutex
+
+	// mu guards WatchList, Services, the poll schedule and the GitHub PAT.
+	// It is only held while they are read or changed, never across a build
+	// or a call to GitHub or Docker, so the CLI, the API and container
+	// events are not kept waiting by a build.
+	mu sync.Mutex
 }
 
-func NewWatcher(cloveClient *coveclient.Client, http *http.Client, builder *builder.Builder, ctx context.Context) *Watcher {
+// Number of failed builds of the same commit before a repo is marked broken.
+const maxBuildAttempts = 3
+
+func NewWatcher(settings *config.Store, cloveClient *coveclient.Client, http *http.Client, builder *builder.Builder, ctx context.Context) *Watcher {
 	return &Watcher{
-		CC:      cloveClient,
-		HTTP:    http,
-		Builder: builder,
-		Ctx:     ctx,
+		Settings: settings,
+		CC:       cloveClient,
+		HTTP:     http,
+		Builder:  builder,
+		Ctx:      ctx,
+
+		nextPoll:         map[string]time.Time{},
+		pollReset:        make(chan struct{}, 1),
+		reconcileReset:   make(chan struct{}, 1),
+		containerStopped: make(chan struct{}, 1),
 	}
 }
 
-func (w *Watcher) Run() error {
+// Config returns the running config. It can change on a reload.
+func (w *Watcher) Config() *config.Config {
+	return w.Settings.Current()
+}
 
-	err := w.loadWatchList()
-	if err != nil {
+// Load reads the watchlist, managed services and port registry from disk.
+func (w *Watcher) Load() error {
+
+	if err := w.loadWatchList(); err != nil {
+		return err
+	}
+	if err := w.loadServices(); err != nil {
 		return err
 	}
 
-	w.loadGitCredentials()
-	if err != nil {
+	return w.Builder.Ports.Load()
+}
+
+// Run polls the watched repos until the daemon stops. Cove may still be
+// coming up at boot, so the GitHub PAT is retried with backoff first.
+func (w *Watcher) Run() error {
+
+	if err := w.awaitGitCredentials(); err != nil {
 		return err
 	}
 
 	for {
 
-		if err := w.Scan(); err != nil {
-			fmt.Printf("ERROR IN SCAN: %v", err)
+		if err := w.scan(false); err != nil {
+			slog.Error("scan failed", "err", err)
+		}
+
+		select {
+		case <-time.After(w.untilNextScan()):
+		case <-w.pollReset:
 		}
-		time.Sleep(10 * time.Second)
 
 	}
 
 }
 
+// Scan polls every repo now, whatever its interval, and deploys the new
+// commits that are allowed.
 func (w *Watcher) Scan() error {
+	return w.scan(true)
+}
+
+// scan polls the repos that are due, or all of them, and deploys new and
+// held commits that are allowed at this time. Repos that are not due still
+// deploy a held commit once their window opens or they are resumed.
+func (w *Watcher) scan(all bool) error {
+
+	w.run.Lock()
+	defer w.run.Unlock()
+
+	var errs []error
+
+	if err := w.syncGitOps(); err != nil {
+		errs = append(errs, err)
+	}
+
+	now := time.Now()
+
+	w.mu.Lock()
+	w.expireApprovals(now)
+	repos := slices.Clone(w.WatchList)
+	due := w.dueRepos(now)
+	if all {
+		for i := range due {
+			due[i] = true
+		}
+	}
+	for i, repo := range repos {
+		if due[i] {
+			w.schedulePoll(repo, now)
+		}
+	}
+	w.mu.Unlock()
+
+	polls := w.pollAll(repos, due)
 
-	for i, repo := range w.WatchList {
-		repo = w.WatchList[i]
-		currentHash, err := w.getLatestSHA(repo.APIURL, w.GitToken)
+	for i, repo := range repos {
+		var err error
+		if due[i] {
+			err = w.scanRepo(repo, polls[i], now)
+		} else {
+			err = w.deployPending(repo.DisplayName, now)
+		}
 		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := w.checkServiceImages(); err != nil {
+		errs = append(errs, err)
+	}
 
-			repo = models.UpdateErrorStats(repo, err.Error())
-			repo = models.UpdateQueryStats(repo)
-			w.WatchList[i] = repo
-			w.storeWatchList()
-			return fmt.Errorf("scanner.scan() - getLatestSha: %v", err)
+	return errors.Join(errs...)
 
+}
+
+// scanRepo records the poll of repo, a copy of its watchlist entry, and
+// deploys its pending commit when that is allowed. The build runs without
+// w.mu held, so its outcome is stored on the entry as it is by then, and
+// dropped if the repo was removed in the meantime.
+func (w *Watcher) scanRepo(repo models.WatchedRepo, p poll, now time.Time) error {
+
+	name := repo.DisplayName
+
+	if p.err != nil {
+		errType := pollErrorType(p.err)
+		metrics.PollErrors.WithLabelValues(name, errType).Inc()
+		slog.Warn("poll failed", "repo", name, "type", errType, "err", p.err)
+		if errType == "auth" {
+			w.reportAuthFailure(p.err)
 		}
+		w.withRepo(name, func(repo *models.WatchedRepo) {
+			*repo = models.UpdateErrorStats(*repo, p.err.Error())
+			*repo = models.UpdateQueryStats(*repo)
+		})
+		return fmt.Errorf("scanner.scan() - getLatestSha: %v", p.err)
+	}
+	w.authFailing = false
+
+	latest := p.latest
+
+	// Deciding on a skip may ask GitHub for the changed files, so it is
+	// done before the entry is locked.
+	skip := ""
+	if previous := repo.Stats.Updates.LastSeenCommitSha; previous == nil || *previous != latest.SHA {
+		skip = w.skipReason(repo, latest)
+	}
+
+	var target *models.WatchedRepo
+	w.withRepo(name, func(repo *models.WatchedRepo) {
 
-		if repo.Stats.Updates.LastSeenCommitSha == nil || *repo.Stats.Updates.LastSeenCommitSha != currentHash {
+		previousSha := repo.Stats.Updates.LastSeenCommitSha
+		if previousSha == nil || *previousSha != latest.SHA {
+			slog.Info("new commit detected", "repo", name, "sha", latest.SHA)
+			*repo = models.UpdateUpdateStats(*repo, latest.SHA, latest.CommittedAt)
 
-			repo = models.UpdateUpdateStats(repo, currentHash)
-			err := w.Builder.Build(repo)
-			if err != nil {
-				builder.ErrorHandler()
-				return fmt.Errorf("scanner.scan() - error in build: %v", err)
+			if skip != "" {
+				slog.Info("commit skipped", "repo", name, "sha", latest.SHA, "reason", skip)
+				repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "build.skipped", SHA: latest.SHA, Message: skip})
+			} else if repo.RequiresApproval() {
+				*repo = w.requestApproval(*repo, latest)
+			} else {
+				repo.Stats.Updates.PendingCommitSha = &latest.SHA
+				if reason := holdReason(*repo, now); reason != "" {
+					slog.Info("deploy held", "repo", name, "sha", latest.SHA, "reason", reason)
+					repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "build.held", SHA: latest.SHA, Message: reason})
+				}
 			}
+		}
+		*repo = models.UpdateQueryStats(*repo)
 
+		// Build the pending commit itself, which may be an approved one
+		// behind the branch head.
+		if pending := repo.Stats.Updates.PendingCommitSha; pending != nil && holdReason(*repo, now) == "" {
+			t := atCommit(*repo, *pending)
+			target = &t
 		}
+	})
+	if target == nil {
+		return nil
+	}
 
-		repo = models.UpdateQueryStats(repo)
-		w.WatchList[i] = repo
-		w.storeWatchList()
+	return w.buildCommit(*target)
+}
 
-		continue
+// deployPending builds the pending commit of the repo named name when
+// nothing holds it any more.
+func (w *Watcher) deployPending(name string, now time.Time) error {
+
+	w.mu.Lock()
+	repo, ok := w.findRepo(name)
+	w.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	pending := repo.Stats.Updates.PendingCommitSha
+	if pending == nil || holdReason(repo, now) != "" {
+		return nil
+	}
+	// A commit that failed to build is retried on the repo's own poll.
+	if failed := repo.Stats.Builds.FailedCommitSha; failed != nil && *failed == *pending {
+		return nil
 	}
 
+	return w.buildCommit(atCommit(repo, *pending))
+}
+
+// buildCommit builds target, a copy of a watchlist entry set up by atCommit,
+// and records the outcome.
+func (w *Watcher) buildCommit(target models.WatchedRepo) error {
+
+	sha := *target.Stats.Updates.LastSeenCommitSha
+	buildID, err := w.Builder.Build(target)
+
+	found := w.withRepo(target.DisplayName, func(repo *models.WatchedRepo) {
+
+		// Approving another commit during the build makes that one pending.
+		stillPending := repo.Stats.Updates.PendingCommitSha != nil && *repo.Stats.Updates.PendingCommitSha == sha
+
+		repo.Stats.Builds.LastBuildID = buildID
+		repo.History = models.AppendHistory(repo.History, buildHistory(target, buildID, "commit", err))
+		if err != nil {
+			builder.ErrorHandler()
+			*repo = models.UpdateBuildStats(*repo, "failed")
+			*repo = models.RecordBuildFailure(*repo, sha, maxBuildAttempts)
+			if repo.Stats.Builds.Broken {
+				if stillPending {
+					repo.Stats.Updates.PendingCommitSha = nil
+				}
+				slog.Error("repo marked broken", "repo", repo.DisplayName, "sha", sha, "attempts", repo.Stats.Builds.ConsecutiveFailures)
+				w.publish(events.Event{
+					Kind:    events.KindRepoBroken,
+					Repo:    repo.DisplayName,
+					SHA:     sha,
+					Message: fmt.Sprintf("%d consecutive failed builds: %v", repo.Stats.Builds.ConsecutiveFailures, err),
+				})
+			}
+			// Otherwise the commit stays pending and the next poll retries it.
+		} else {
+			*repo = models.UpdateBuildStats(*repo, "success")
+			*repo = models.ClearBuildFailures(*repo)
+			if stillPending {
+				repo.Stats.Updates.PendingCommitSha = nil
+			}
+			*repo = models.RecordDeployedSha(*repo, sha)
+		}
+	})
+	if !found {
+		slog.Warn("repo removed while it was built, outcome not recorded", "repo", target.DisplayName, "build_id", buildID)
+	}
+
+	if err != nil {
+		return fmt.Errorf("scanner.scan() - error in build: %v", err)
+	}
 	return nil
+}
+
+// RecordSelfUpdate marks the commit of repo, a copy set up by atCommit, as
+// deployed before Lighthouse hands its own container over to the updater.
+// The daemon the updater starts reads the watchlist afresh and would
+// otherwise find the commit still pending and update itself again. The
+// previous commit is kept for FinishSelfUpdate in case the update is rolled
+// back.
+func (w *Watcher) RecordSelfUpdate(repo models.WatchedRepo) error {
+
+	sha := repo.Stats.Updates.LastSeenCommitSha
+	if sha == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.WatchList {
+		entry := &w.WatchList[i]
+		if entry.DisplayName != repo.DisplayName {
+			continue
+		}
+		if entry.Stats.Updates.LastSeenCommitSha == nil {
+			entry.Stats.Updates.LastSeenCommitSha = sha
+		}
+		if pending := entry.Stats.Updates.PendingCommitSha; pending != nil && *pending == *sha {
+			entry.Stats.Updates.PendingCommitSha = nil
+		}
+		entry.Stats.Builds.HandoverSha = sha
+		entry.Stats.Builds.HandoverFromSha = entry.Stats.Builds.DeployedSha
+		*entry = models.RecordDeployedSha(*entry, *sha)
+		w.Builder.SetWatchList(w.WatchList)
+		return w.saveWatchList()
+	}
+
+	return fmt.Errorf("%s is not watched", repo.DisplayName)
+}
+
+// FinishSelfUpdate records the outcome of the self-update RecordSelfUpdate
+// noted. A rolled back commit counts as a failed build: the previous commit
+// is deployed again and the rolled back one stays pending, so the next poll
+// retries it until the repo is marked broken.
+func (w *Watcher) FinishSelfUpdate(rolledBack bool) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	finished := false
+	for i := range w.WatchList {
+		repo := &w.WatchList[i]
+		sha := repo.Stats.Builds.HandoverSha
+		if sha == nil {
+			continue
+		}
+		finished = true
+
+		if !rolledBack {
+			*repo = models.UpdateBuildStats(*repo, "success")
+			*repo = models.ClearBuildFailures(*repo)
+		} else {
+			repo.Stats.Builds.DeployedSha = repo.Stats.Builds.HandoverFromSha
+			*repo = models.UpdateBuildStats(*repo, "failed")
+			*repo = models.RecordBuildFailure(*repo, *sha, maxBuildAttempts)
+			repo.History = models.AppendHistory(repo.History, models.HistoryEntry{Event: "build.failed", SHA: *sha, Message: "self-update rolled back"})
+			slog.Error("self-update rolled back", "repo", repo.DisplayName, "sha", *sha)
+			w.publish(events.Event{
+				Kind:    events.KindRollback,
+				Repo:    repo.DisplayName,
+				SHA:     *sha,
+				Message: "new LightHouse daemon did not become healthy, previous version restored",
+			})
+
+			if !repo.Stats.Builds.Broken {
+				pending := *sha
+				repo.Stats.Updates.PendingCommitSha = &pending
+			} else {
+				slog.Error("repo marked broken", "repo", repo.DisplayName, "sha", *sha, "attempts", repo.Stats.Builds.ConsecutiveFailures)
+				w.publish(events.Event{
+					Kind:    events.KindRepoBroken,
+					Repo:    repo.DisplayName,
+					SHA:     *sha,
+					Message: fmt.Sprintf("%d consecutive failed builds: self-update rolled back", repo.Stats.Builds.ConsecutiveFailures),
+				})
+			}
+		}
+
+		repo.Stats.Builds.HandoverSha = nil
+		repo.Stats.Builds.HandoverFromSha = nil
+	}
+
+	if finished {
+		w.Builder.SetWatchList(w.WatchList)
+		w.storeWatchList()
+	}
+}
+
+// withRepo applies update to the watchlist entry named name and stores the
+// watchlist. It reports false when there is no such entry.
+func (w *Watcher) withRepo(name string, update func(*models.WatchedRepo)) bool {
 
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.WatchList {
+		if w.WatchList[i].DisplayName != name {
+			continue
+		}
+		update(&w.WatchList[i])
+		w.Builder.SetWatchList(w.WatchList)
+		w.storeWatchList()
+		return true
+	}
+
+	return false
+}
+
+type poll struct {
+	latest latestCommit
+	err    error
+}
+
+// pollAll asks GitHub for the latest commit of every due repo, Workers at
+// a time. Results are in watchlist order. The services of a monorepo share
+// one poll.
+func (w *Watcher) pollAll(repos []models.WatchedRepo, due []bool) []poll {
+
+	polls := make([]poll, len(repos))
+	token := w.Token()
+	sem := make(chan struct{}, w.Config().Workers)
+	var wg sync.WaitGroup
+
+	first := map[string]int{}
+	shared := map[int]int{}
+
+	for i, repo := range repos {
+		if !due[i] {
+			continue
+		}
+		if j, ok := first[repo.APIURL]; ok {
+			shared[i] = j
+			continue
+		}
+		first[repo.APIURL] = i
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			metrics.Polls.WithLabelValues(repo.DisplayName).Inc()
+			polls[i].latest, polls[i].err = w.getLatestSHA(repo.APIURL, token)
+		}()
+	}
+	wg.Wait()
+
+	for i, j := range shared {
+		polls[i] = polls[j]
+	}
+
+	return polls
+}
+
+// atCommit returns repo set up to build sha rather than the head of its
+// branch.
+func atCommit(repo models.WatchedRepo, sha string) models.WatchedRepo {
+
+	repo.DownloadURL = strings.TrimSuffix(repo.URL, "/") + "/archive/" + sha + ".zip"
+	repo.Stats.Updates.LastSeenCommitSha = &sha
+
+	return repo
+}
+
+// reportAuthFailure publishes a GitHub auth failure once per outage rather
+// than on every poll.
+func (w *Watcher) reportAuthFailure(err error) {
+
+	if w.authFailing {
+		return
+	}
+	w.authFailing = true
+
+	w.publish(events.Event{
+		Kind:    events.KindGitHubAuthFailed,
+		Message: err.Error(),
+	})
+}
+
+func (w *Watcher) publish(e events.Event) {
+	if w.Builder == nil || w.Builder.Events == nil {
+		return
+	}
+	w.Builder.Events.Publish(e)
 }
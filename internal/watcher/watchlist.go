@@ -3,30 +3,53 @@ package watcher
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/LSariol/LightHouse/internal/models"
 )
 
-func (w *Watcher) AddNewRepo(displayName string, url string) error {
+// AddNewRepo watches the repo at url. A dir makes the entry one service of
+// a monorepo, built from that directory.
+func (w *Watcher) AddNewRepo(displayName string, url string, dir string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	dir, err := models.CleanDir(dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	// Check if new URL is already being watched
-	exists := w.repoExists(displayName, url)
+	exists := w.repoExists(displayName, url, dir)
 	if exists {
-		fmt.Printf("%s is already being watched.\n", url)
+		slog.Info("repo already watched", "repo", displayName, "url", url, "dir", dir)
 		return nil
 	}
 
+	if dir != "" && !validContainerName.MatchString(displayName) {
+		return fmt.Errorf("%q names the container of a monorepo service, so it may only hold letters, digits, '_', '.' and '-'", displayName)
+	}
+
 	rName, rAPIURL, rDownloadURL, err := parseURL(url)
 	if err != nil {
 		return err
 	}
 
-	newRepo := models.NewWatchedRepo(displayName, rName, url, rAPIURL, rDownloadURL)
+	newRepo := models.NewWatchedRepo(displayName, containerName(rName, displayName, dir), url, rAPIURL, rDownloadURL)
+	newRepo.Dir = dir
 
 	w.WatchList = append(w.WatchList, newRepo)
+	w.Builder.SetWatchList(w.WatchList)
 
 	w.storeWatchList()
 
@@ -36,6 +59,13 @@ func (w *Watcher) AddNewRepo(displayName string, url string) error {
 
 func (w *Watcher) RemoveRepo(toRemove string) error {
 
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	indexToRemove := -1
 
 	for index, existingRepo := range w.WatchList {
@@ -46,8 +76,10 @@ func (w *Watcher) RemoveRepo(toRemove string) error {
 	}
 
 	if indexToRemove != -1 {
-		w.WatchList = append(w.WatchList[:indexToRemove], w.WatchList[indexToRemove+1:]...)
-		fmt.Printf("%s has been removed from the watchlist.\n", toRemove)
+		w.WatchList = slices.Delete(w.WatchList, indexToRemove, indexToRemove+1)
+		w.Builder.SetWatchList(w.WatchList)
+		w.Builder.Ports.Release(toRemove)
+		slog.Info("repo removed from watchlist", "repo", toRemove)
 		w.storeWatchList()
 		return nil
 	}
@@ -59,6 +91,13 @@ func (w *Watcher) RemoveRepo(toRemove string) error {
 func (w *Watcher) ChangeRepoName(currentName string, name string) error {
 	updated := false
 
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	if w.checkNamingConflicts(name, currentName) {
 		return fmt.Errorf("this name is already being used to watch a different repo")
 	}
@@ -77,16 +116,56 @@ func (w *Watcher) ChangeRepoName(currentName string, name string) error {
 		return fmt.Errorf("changeRepoName: %s does not exist", currentName)
 	}
 
+	w.Builder.Ports.Rename(currentName, name)
+	w.Builder.SetWatchList(w.WatchList)
 	w.storeWatchList()
 
 	return nil
 }
 
+// SetDependencies replaces what a repo or managed service waits for at boot.
+func (w *Watcher) SetDependencies(name string, deps []string) error {
+
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	for _, d := range deps {
+		if d == name {
+			return fmt.Errorf("%s cannot depend on itself", name)
+		}
+	}
+
+	if _, ok := w.GetService(name); ok {
+		return w.updateService(name, func(svc *models.ManagedService) error {
+			svc.DependsOn = deps
+			return nil
+		})
+	}
+
+	err := w.updateRepo(name, func(repo *models.WatchedRepo) error {
+		repo.DependsOn = deps
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("setDependencies: %s does not exist", name)
+	}
+
+	return nil
+}
+
 func (w *Watcher) ChangeRepoURL(dName string, newURL string) error {
 	updated := false
 
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	if w.checkURLConflicts(dName, newURL) {
-		return fmt.Errorf("this url is already being watched under a different name")
+		return fmt.Errorf("this url and dir are already being watched under a different name")
 	}
 
 	for i := range w.WatchList {
@@ -112,6 +191,7 @@ func (w *Watcher) ChangeRepoURL(dName string, newURL string) error {
 		return fmt.Errorf("changeRepoURL: %s does not exist", dName)
 	}
 
+	w.Builder.SetWatchList(w.WatchList)
 	w.storeWatchList()
 
 	return nil
@@ -120,8 +200,15 @@ func (w *Watcher) ChangeRepoURL(dName string, newURL string) error {
 func (w *Watcher) UpdateRepo(dName string, newURL string) error {
 	updated := false
 
-	if w.isRepoWatched(newURL) {
-		return fmt.Errorf("this url is already being watched")
+	if w.gitOps() {
+		return errGitOps
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.checkURLConflicts(dName, newURL) {
+		return fmt.Errorf("this url and dir are already being watched")
 	}
 
 	for i := range w.WatchList {
@@ -146,18 +233,67 @@ func (w *Watcher) UpdateRepo(dName string, newURL string) error {
 		return fmt.Errorf("changeRepoURL: %s does not exist", dName)
 	}
 
+	w.Builder.SetWatchList(w.WatchList)
 	w.storeWatchList()
 
 	return nil
 }
 
+// GetRepo returns the watched repo with the given display name.
+func (w *Watcher) GetRepo(displayName string) (models.WatchedRepo, bool) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.findRepo(displayName)
+}
+
+// findRepo is GetRepo for callers holding w.mu.
+func (w *Watcher) findRepo(displayName string) (models.WatchedRepo, bool) {
+
+	for _, repo := range w.WatchList {
+		if repo.DisplayName == displayName {
+			return repo, true
+		}
+	}
+
+	return models.WatchedRepo{}, false
+}
+
+// lookupRepo returns the watched repo with the given display name or
+// container name.
+func (w *Watcher) lookupRepo(name string) (models.WatchedRepo, bool) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, repo := range w.WatchList {
+		if repo.DisplayName == name || strings.EqualFold(repo.ContainerName, name) {
+			return repo, true
+		}
+	}
+
+	return models.WatchedRepo{}, false
+}
+
+// RepoFullName returns the "owner/name" of a watched repo.
+func (w *Watcher) RepoFullName(displayName string) (string, bool) {
+
+	repo, ok := w.GetRepo(displayName)
+	if !ok {
+		return "", false
+	}
+
+	return strings.TrimPrefix(repo.URL, "https://github.com/"), true
+}
+
 //Helper Functions
 
 // Returns a boolean if repo exists
-func (w *Watcher) repoExists(displayName string, url string) bool {
+func (w *Watcher) repoExists(displayName string, url string, dir string) bool {
 
 	for _, existingRepo := range w.WatchList {
-		if existingRepo.URL == url {
+		if existingRepo.URL == url && existingRepo.Dir == dir {
 			return true
 		}
 		if existingRepo.DisplayName == displayName {
@@ -180,10 +316,13 @@ func (w *Watcher) checkNamingConflicts(name string, currentName string) bool {
 	return false
 }
 
+// checkURLConflicts reports whether another repo watches currentURL with
+// the same dir as name.
 func (w *Watcher) checkURLConflicts(name string, currentURL string) bool {
 
+	current, _ := w.findRepo(name)
 	for _, repo := range w.WatchList {
-		if repo.URL == currentURL && repo.DisplayName != name {
+		if repo.URL == currentURL && repo.Dir == current.Dir && repo.DisplayName != name {
 			return true
 		}
 	}
@@ -191,72 +330,109 @@ func (w *Watcher) checkURLConflicts(name string, currentURL string) bool {
 	return false
 }
 
-// checkWatchedReposConflicts verifies that the new url is not currently being watched.
-func (w *Watcher) isRepoWatched(currentURL string) bool {
+// validContainerName matches the names Docker accepts for a container.
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
 
-	for _, repo := range w.WatchList {
-		if repo.URL == currentURL {
-			return true
-		}
+// containerName is the container a new entry is deployed as: the repo's
+// name, or for a monorepo service its own display name.
+func containerName(repoName string, displayName string, dir string) string {
+
+	if dir != "" {
+		return strings.ToLower(displayName)
 	}
 
-	return false
+	return repoName
 }
 
 func (w *Watcher) loadWatchList() error {
 	var watchList []models.WatchedRepo
 
 	//read json file
-	data, err := os.ReadFile(os.Getenv("APP_REPO_PATH"))
+	data, err := os.ReadFile(w.Config().Paths.Repos)
 	if err != nil {
-		fmt.Println("Watcher - LoadWatchList: Failed to load repos.json")
 		return fmt.Errorf("loadWatchList: %w", err)
 	}
 
 	//Unmarshal repos.json into watchList
 	err = json.Unmarshal([]byte(data), &watchList)
 	if err != nil {
-		fmt.Println("Watcher - LoadWatchList: Failed to Unmarshal json into WatchedRepos.")
 		return fmt.Errorf("loadWatchList: %w", err)
 	}
 
+	w.mu.Lock()
 	w.WatchList = watchList
-	w.Builder.WatchList = watchList
+	w.Builder.SetWatchList(watchList)
+	w.mu.Unlock()
 	return nil
 }
 
+// storeWatchList writes the watchlist to disk. Must be called with w.mu
+// held.
 func (w *Watcher) storeWatchList() {
 
+	if err := w.saveWatchList(); err != nil {
+		slog.Error("failed to store watchlist", "path", w.Config().Paths.Repos, "err", err)
+	}
+}
+
+// saveWatchList writes the watchlist to disk. Must be called with w.mu held.
+func (w *Watcher) saveWatchList() error {
+
 	updatedData, err := json.MarshalIndent(w.WatchList, "", "	")
 	if err != nil {
-		fmt.Println("Watcher - storeWatchList: Failed to Marhsal json into UpdatedData.")
-		return
+		return fmt.Errorf("marshal watchlist: %w", err)
 	}
 
-	err = os.WriteFile(os.Getenv("APP_REPO_PATH"), updatedData, 0644)
-	if err != nil {
-		fmt.Println("Watcher - storeWatchList: Failed to write to repos.json." + err.Error())
-		return
+	if err := os.WriteFile(w.Config().Paths.Repos, updatedData, 0644); err != nil {
+		return fmt.Errorf("write watchlist: %w", err)
 	}
+
+	return nil
 }
 
 // Display WatchList in a nice format
 func (w *Watcher) DisplayWatchList() {
 
-	fmt.Printf("%-20s | %-40s | %-20s | %-15s\n", "Name", "URL", "Started Watching", "Query Count")
-	fmt.Println(strings.Repeat("-", 20) + "-+-" + strings.Repeat("-", 40) + "-+-" + strings.Repeat("-", 20) + "-+-" + strings.Repeat("-", 15))
+	fmt.Printf("%-20s | %-40s | %-20s | %-15s | %-16s | %s\n", "Name", "URL", "Started Watching", "Query Count", "Deploys", "Host Ports")
+	fmt.Println(strings.Repeat("-", 20) + "-+-" + strings.Repeat("-", 40) + "-+-" + strings.Repeat("-", 20) + "-+-" + strings.Repeat("-", 15) + "-+-" + strings.Repeat("-", 16) + "-+-" + strings.Repeat("-", 10))
 
-	for _, repo := range w.WatchList {
+	w.mu.Lock()
+	repos := slices.Clone(w.WatchList)
+	w.mu.Unlock()
+
+	for _, repo := range repos {
 		fmt.Printf(
-			"%-20s | %-40s | %-20s | %-15d \n",
+			"%-20s | %-40s | %-20s | %-15d | %-16s | %s\n",
 			repo.DisplayName,
 			repo.URL,
 			repo.Stats.Meta.StartedWatchingAt.Format("2006-01-02 15:04:05"),
 			repo.Stats.Queries.QueryCount,
+			deployState(repo),
+			w.hostPorts(repo.DisplayName),
 		)
 	}
 }
 
+// deployState sums up whether a repo deploys new commits, for display.
+func deployState(repo models.WatchedRepo) string {
+
+	state := "on"
+	switch {
+	case repo.Paused:
+		state = "paused"
+	case len(repo.Windows) > 0:
+		state = "windowed"
+	}
+	if sha := repo.Stats.Updates.PendingCommitSha; sha != nil && len(*sha) >= 7 {
+		state += ", held " + (*sha)[:7]
+	}
+	if n := len(repo.PendingApprovals); n > 0 {
+		state += fmt.Sprintf(", %d to approve", n)
+	}
+
+	return state
+}
+
 func parseURL(url string) (string, string, string, error) {
 
 	trim := strings.TrimPrefix(url, "https://github.com/")